@@ -13,6 +13,9 @@ type Event struct {
 	// should be dropped instead of getting sent. Zero value should be treated as
 	// unset and the event sent with a sample rate of 1
 	SampleRate int
+	// Dataset is the Honeycomb dataset to send the event to. Empty means the
+	// dataset honeytail was configured with
+	Dataset string
 	// Data is a map[string]interface{} containing key/value pairs for all the
 	// metrics to submit in this event
 	Data map[string]interface{}
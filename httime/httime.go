@@ -1,7 +1,9 @@
 package httime
 
 import (
+	"fmt"
 	"math"
+	"math/big"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +14,10 @@ import (
 const (
 	StrftimeChar     = "%"
 	UnixTimestampFmt = "%s(%L)?"
+	// UnixMultiplierPrefix starts a format like unix_mul:0.1 for numeric
+	// timestamps in an unusual unit, here tenths of a second since the epoch.
+	// The value is multiplied by the number after the prefix to get seconds.
+	UnixMultiplierPrefix = "unix_mul:"
 )
 
 var (
@@ -76,16 +82,22 @@ var (
 	}
 )
 
+// Nower is the clock honeytail reads the current time from. Swap out
+// DefaultNower (eg for an httimetest.FakeNower) to make anything that falls
+// back to the current time deterministic.
 type Nower interface {
 	Now() time.Time
 }
 
+// RealNower is the real clock, in UTC
 type RealNower struct{}
 
 func (r *RealNower) Now() time.Time {
 	return time.Now().UTC()
 }
 
+// Now returns the current time according to DefaultNower. Use it instead of
+// time.Now wherever an event's timestamp may come from the clock.
 func Now() time.Time {
 	return DefaultNower.Now()
 }
@@ -106,13 +118,8 @@ func GetTimestamp(m map[string]interface{}, timeFieldName, timeFieldFormat strin
 	)
 	if timeFieldName != "" {
 		if t, found := m[timeFieldName]; found {
-			timeStr := ""
-			switch v := t.(type) {
-			case string:
-				timeStr = v
-			case int:
-				timeStr = strconv.Itoa(v)
-			default:
+			timeStr, ok := timeString(t)
+			if !ok {
 				warnAboutTime(timeFieldName, t, timeFoundImproperTypeMsg)
 				ts = Now()
 			}
@@ -155,11 +162,136 @@ func GetTimestamp(m map[string]interface{}, timeFieldName, timeFieldFormat strin
 	return ts
 }
 
+// GetTimestampFromCandidates is like GetTimestamp with a list of time fields
+// to try in order. The first field that is present and parses with
+// timeFieldFormat provides the timestamp, and is deleted from the map. If none
+// does, it returns the current time.
+func GetTimestampFromCandidates(m map[string]interface{}, candidates []string, timeFieldFormat string) time.Time {
+	if ts, ok := ParseTimeField(m, timeFieldFormat, candidates...); ok {
+		return ts
+	}
+	warnAboutTime(strings.Join(candidates, ","), nil, "Couldn't find a time field that parses using specified format")
+	return Now()
+}
+
+// ParseTimeField parses the first of fields that is present and parses with
+// timeFieldFormat, deleting it from the map. Unlike GetTimestamp it doesn't
+// fall back to the current time, but returns false if no field parses.
+func ParseTimeField(m map[string]interface{}, timeFieldFormat string, fields ...string) (time.Time, bool) {
+	for _, field := range fields {
+		t, found := m[field]
+		if !found {
+			continue
+		}
+		if timeStr, ok := timeString(t); ok && timeStr != "" {
+			if ts := tryTimeFormats(timeStr, timeFieldFormat); !ts.IsZero() {
+				delete(m, field)
+				return ts, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// timeString returns the string to parse a time field's value from, if it
+// has a type that can hold a timestamp
+func timeString(t interface{}) (string, bool) {
+	switch v := t.(type) {
+	case string:
+		return v, true
+	case int:
+		return strconv.Itoa(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
 // Parse wraps time.ParseInLocation to use httime's Location from parsers
 func Parse(format, timespec string) (time.Time, error) {
 	return time.ParseInLocation(format, timespec, Location)
 }
 
+// ParseStrict parses timespec using only format, with no guessing. format may
+// be a strftime format or a Go layout and defaults to RFC3339 with optional
+// nanoseconds.
+func ParseStrict(format, timespec string) (time.Time, error) {
+	if format == "" {
+		format = time.RFC3339Nano
+	}
+	if strings.HasPrefix(format, UnixMultiplierPrefix) {
+		return parseUnixMultiplied(format, timespec)
+	}
+	if strings.Contains(format, StrftimeChar) {
+		format = convertTimeFormat(format)
+	}
+	return Parse(format, delocalize(timespec))
+}
+
+// parseUnixMultiplied parses timespec, a number, with a unix_mul:multiplier
+// format. The arithmetic is exact, so eg tenths of a second don't pick up
+// floating point noise in the nanoseconds.
+func parseUnixMultiplied(format, timespec string) (time.Time, error) {
+	multiplier, ok := new(big.Rat).SetString(strings.TrimPrefix(format, UnixMultiplierPrefix))
+	if !ok || multiplier.Sign() <= 0 {
+		return time.Time{}, fmt.Errorf("%q must be of the form %s followed by a positive number", format, UnixMultiplierPrefix)
+	}
+	value, ok := new(big.Rat).SetString(timespec)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%q is not a number", timespec)
+	}
+	nanos := new(big.Rat).Mul(value, multiplier)
+	nanos.Mul(nanos, big.NewRat(int64(time.Second), 1))
+	n := new(big.Int).Quo(nanos.Num(), nanos.Denom())
+	// big.Int's BitLen is of the absolute value, so this keeps n within int64
+	if n.BitLen() >= 64 {
+		return time.Time{}, fmt.Errorf("%q is out of range", timespec)
+	}
+	return time.Unix(0, n.Int64()), nil
+}
+
+// ValidateFormat makes a best effort at checking that format is something
+// GetTimestamp can use: either a strftime format made up of known directives
+// or a Go layout containing at least one layout element that can parse its own
+// output. It errs on the side of accepting unusual layouts.
+func ValidateFormat(format string) error {
+	if format == "" || format == UnixTimestampFmt {
+		return nil
+	}
+	if strings.HasPrefix(format, UnixMultiplierPrefix) {
+		_, err := parseUnixMultiplied(format, "0")
+		return err
+	}
+	format = strings.Replace(format, ",", ".", -1)
+	if strings.Contains(format, StrftimeChar) {
+		for i := 0; i < len(format); i++ {
+			if format[i] != '%' {
+				continue
+			}
+			if i+1 == len(format) {
+				return fmt.Errorf("strftime format %q ends with a bare %%", format)
+			}
+			directive := format[i : i+2]
+			if _, ok := convertMapping[directive]; !ok {
+				return fmt.Errorf("unknown strftime directive %s in %q", directive, format)
+			}
+			i++
+		}
+		return nil
+	}
+	// anything but Go's own reference time, so layout elements show up as
+	// changes when formatting
+	ref := time.Date(2017, 11, 23, 19, 57, 38, 123456789, time.UTC)
+	formatted := ref.Format(format)
+	if formatted == format {
+		return fmt.Errorf("%q contains neither strftime directives nor Go time layout elements", format)
+	}
+	if _, err := time.Parse(format, formatted); err != nil {
+		return fmt.Errorf("%q can't parse times it formats: %s", format, err)
+	}
+	return nil
+}
+
 // convertTimeFormat tries to handle C-style time formats alongside Go's
 // existing time.Parse behavior.
 func convertTimeFormat(layout string) string {
@@ -173,7 +305,7 @@ func tryTimeFormats(t, intendedFormat string) time.Time {
 	// golang can't parse times with decimal fractional seconds marked by a comma
 	// hack it by just replacing all commas with periods and hope it works out.
 	// https://github.com/golang/go/issues/6189
-	t = strings.Replace(t, ",", ".", -1)
+	t = strings.Replace(delocalize(t), ",", ".", -1)
 	if intendedFormat == UnixTimestampFmt {
 		if unix, err := strconv.ParseInt(t, 0, 64); err == nil {
 			return time.Unix(unix, 0)
@@ -189,6 +321,10 @@ func tryTimeFormats(t, intendedFormat string) time.Time {
 			}
 		}
 	}
+	if strings.HasPrefix(intendedFormat, UnixMultiplierPrefix) {
+		ts, _ := parseUnixMultiplied(intendedFormat, t)
+		return ts
+	}
 	if intendedFormat != "" {
 		format := strings.Replace(intendedFormat, ",", ".", -1)
 		if strings.Contains(format, StrftimeChar) {
@@ -212,6 +348,12 @@ func tryTimeFormats(t, intendedFormat string) time.Time {
 		ts = tOther
 	} else if tOther, err := Parse(time.UnixDate, t); err == nil {
 		ts = tOther
+	} else if tOther, err := Parse("2006-01-02 15:04:05.999999999", t); err == nil {
+		// eg Python logging's asctime, 2014-04-10 19:57:38,123, in Location
+		ts = tOther
+	} else if tOther, err := Parse("2006/01/02 15:04:05.999999999", t); err == nil {
+		// eg Go's log package, 2014/04/10 19:57:38.123456, in Location
+		ts = tOther
 	}
 	return ts
 }
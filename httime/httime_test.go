@@ -88,6 +88,29 @@ var tts = []testTimestamp{
 		auto:      true,
 		expected:  time.Unix(1397188658, 123456789),
 	},
+	{
+		format:    "2006-01-02 15:04:05,000",
+		fieldName: "asctime",
+		input:     "2014-04-10 19:57:38,123",
+		tz:        utc,
+		expected:  time.Unix(1397159858, 123000000),
+	},
+	{
+		format:    "2006-01-02 15:04:05,000",
+		fieldName: "time",
+		input:     "2014-04-10 19:57:38,123",
+		tz:        pacific,
+		auto:      true,
+		expected:  time.Unix(1397185058, 123000000),
+	},
+	{
+		format:    "2006/01/02 15:04:05.000000",
+		fieldName: "time",
+		input:     "2014/04/10 19:57:38.123456",
+		tz:        utc,
+		auto:      true,
+		expected:  time.Unix(1397159858, 123456000),
+	},
 	{
 		format:    "%Y-%m-%d %H:%M",
 		fieldName: "time",
@@ -138,6 +161,35 @@ var tts = []testTimestamp{
 		tz:        utc,
 		expected:  time.Unix(1440116565, 123000000),
 	},
+	// tenths of a second
+	{
+		format:    UnixMultiplierPrefix + "0.1",
+		fieldName: "time",
+		input:     "14401165651",
+		tz:        utc,
+		expected:  time.Unix(1440116565, 100000000),
+	},
+	{
+		format:    UnixMultiplierPrefix + "0.1",
+		fieldName: "time",
+		input:     14401165651,
+		tz:        utc,
+		expected:  time.Unix(1440116565, 100000000),
+	},
+	{
+		format:    UnixMultiplierPrefix + "0.1",
+		fieldName: "time",
+		input:     14401165651.5,
+		tz:        utc,
+		expected:  time.Unix(1440116565, 150000000),
+	},
+	{
+		format:    UnixMultiplierPrefix + "60",
+		fieldName: "time",
+		input:     "24001942",
+		tz:        utc,
+		expected:  time.Unix(1440116520, 0),
+	},
 	{
 		format:    "%Y-%m-%d %z",
 		input:     "2014-04-10 -0700",
@@ -147,6 +199,51 @@ var tts = []testTimestamp{
 	},
 }
 
+func TestValidateFormat(t *testing.T) {
+	valid := []string{
+		"",
+		UnixTimestampFmt,
+		UnixMultiplierPrefix + "0.1",
+		"2006-01-02 15:04:05",
+		time.RFC3339Nano,
+		"02/Jan/2006:15:04:05 -0700",
+		"2006-01-02 15:04:05,000",
+		"%Y-%m-%d %H:%M:%S",
+		"%d/%b/%Y:%H:%M:%S %z",
+		"[%c]",
+	}
+	for _, format := range valid {
+		if err := ValidateFormat(format); err != nil {
+			t.Errorf("expected %q to be valid, got %s", format, err)
+		}
+	}
+	invalid := []string{
+		"yyyy-mm-dd",
+		"%Y-%m-%d %Q",
+		"%Y-%m-%d %",
+		UnixMultiplierPrefix + "tenth",
+		UnixMultiplierPrefix + "-1",
+	}
+	for _, format := range invalid {
+		if err := ValidateFormat(format); err == nil {
+			t.Errorf("expected %q to be invalid, got nil", format)
+		}
+	}
+}
+
+func TestParseUnixMultipliedRange(t *testing.T) {
+	format := UnixMultiplierPrefix + "1"
+	if ts, err := parseUnixMultiplied(format, "-1440116565"); err != nil || !ts.Equal(time.Unix(-1440116565, 0)) {
+		t.Errorf("expected a negative time to parse, got %v (%v)", ts, err)
+	}
+	// int64 nanoseconds run out in 2262
+	for _, timespec := range []string{"9300000000", "-9300000000"} {
+		if _, err := parseUnixMultiplied(format, timespec); err == nil {
+			t.Errorf("expected %s to be out of range", timespec)
+		}
+	}
+}
+
 func TestGetTimestampValid(t *testing.T) {
 	for i, tTimeSet := range tts {
 		Location = tTimeSet.tz
@@ -206,6 +303,45 @@ func TestGetTimestampCustomFormat(t *testing.T) {
 	}
 }
 
+func TestGetTimestampFromCandidates(t *testing.T) {
+	candidates := []string{"request_time", "ts"}
+	expected := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC)
+
+	// the first candidate is absent, so the second provides the time
+	m := map[string]interface{}{"ts": "2017-11-23T19:57:38Z", "other": 1}
+	resp := GetTimestampFromCandidates(m, candidates, time.RFC3339)
+	if !resp.Equal(expected) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, expected)
+	}
+	if _, ok := m["ts"]; ok {
+		t.Error("expected the time field used to be deleted")
+	}
+
+	// the first candidate present wins, and one that won't parse is skipped
+	m = map[string]interface{}{
+		"request_time": "2017-11-23T19:57:38Z",
+		"ts":           "2010-01-01T00:00:00Z",
+	}
+	resp = GetTimestampFromCandidates(m, candidates, time.RFC3339)
+	if !resp.Equal(expected) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, expected)
+	}
+	m = map[string]interface{}{"request_time": "soon", "ts": "2017-11-23T19:57:38Z"}
+	resp = GetTimestampFromCandidates(m, candidates, time.RFC3339)
+	if !resp.Equal(expected) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, expected)
+	}
+	if m["request_time"] != "soon" {
+		t.Error("expected the unparseable candidate to be left alone")
+	}
+
+	// no candidates at all
+	resp = GetTimestampFromCandidates(map[string]interface{}{}, candidates, time.RFC3339)
+	if !resp.Equal(Now()) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, Now())
+	}
+}
+
 func TestCommaInTimestamp(t *testing.T) {
 	commaTimes := []testTimestamp{
 		{ // test commas as the fractional portion separator
@@ -230,3 +366,66 @@ func TestCommaInTimestamp(t *testing.T) {
 	}
 
 }
+
+func TestFallbackTimestampPrecision(t *testing.T) {
+	// the fallback should keep the real clock's sub-second precision so that
+	// rapidly generated events stay ordered
+	defer func(nower Nower) { DefaultNower = nower }(DefaultNower)
+	DefaultNower = &RealNower{}
+
+	seen := make(map[time.Time]bool)
+	var subsecond bool
+	for i := 0; i < 1000; i++ {
+		ts := GetTimestamp(map[string]interface{}{"key": "val"}, "", "")
+		if ts.Nanosecond() != 0 {
+			subsecond = true
+		}
+		seen[ts] = true
+	}
+	if !subsecond {
+		t.Error("expected fallback timestamps to have sub-second precision")
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected rapidly generated fallback timestamps to differ, got %d distinct", len(seen))
+	}
+}
+
+func TestLocalizedNames(t *testing.T) {
+	defer SetLocale("")
+	tsts := []struct {
+		locale, format, timespec string
+	}{
+		{"fr", "%d %B %Y %H:%M:%S", "14 février 2018 10:30:00"},
+		{"fr_FR", "%a %d %b %Y %H:%M:%S", "mer. 14 févr. 2018 10:30:00"},
+		{"de", "%A, %d. %B %Y %H:%M:%S", "Mittwoch, 14. Februar 2018 10:30:00"},
+		{"de-DE", "%a, %d. %b %Y %H:%M:%S", "Mi, 14. Feb 2018 10:30:00"},
+	}
+	expected := time.Date(2018, 2, 14, 10, 30, 0, 0, time.UTC)
+	for _, tst := range tsts {
+		if err := SetLocale(tst.locale); err != nil {
+			t.Fatal(err)
+		}
+		ts := GetTimestamp(map[string]interface{}{"time": tst.timespec}, "time", tst.format)
+		if !ts.Equal(expected) {
+			t.Errorf("parsing %q in %s: expected %s, got %s", tst.timespec, tst.locale, expected, ts)
+		}
+		if ts, err := ParseStrict(tst.format, tst.timespec); err != nil || !ts.Equal(expected) {
+			t.Errorf("strictly parsing %q in %s: expected %s, got %s (%v)", tst.timespec, tst.locale, expected, ts, err)
+		}
+	}
+
+	// march and tuesday are both mar in French; the period tells them apart
+	SetLocale("fr")
+	if got := delocalize("mar. 6 mars 2018"); got != "Tue 6 March 2018" {
+		t.Errorf("expected Tue 6 March 2018, got %q", got)
+	}
+	// English names still work
+	if got := delocalize("Wed Feb 14 UTC"); got != "Wed Feb 14 UTC" {
+		t.Errorf("expected English names to be left alone, got %q", got)
+	}
+	for _, locale := range []string{"tlh", "_", "-", "-_"} {
+		if err := SetLocale(locale); err == nil {
+			t.Errorf("expected an error setting unsupported locale %q", locale)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package httime
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// localeNames maps the lowercased month and weekday names, full and
+// abbreviated, of each supported locale to the English names Go's time
+// layouts understand. Abbreviations are listed with and without the trailing
+// period they're usually written with.
+var localeNames = map[string]map[string]string{
+	"fr": {
+		"janvier": "January", "février": "February", "mars": "March", "avril": "April",
+		"mai": "May", "juin": "June", "juillet": "July", "août": "August",
+		"septembre": "September", "octobre": "October", "novembre": "November", "décembre": "December",
+		"janv.": "Jan", "févr.": "Feb", "avr.": "Apr", "juil.": "Jul",
+		"sept.": "Sep", "oct.": "Oct", "nov.": "Nov", "déc.": "Dec",
+		"janv": "Jan", "févr": "Feb", "avr": "Apr", "juil": "Jul",
+		"sept": "Sep", "oct": "Oct", "nov": "Nov", "déc": "Dec",
+		"lundi": "Monday", "mardi": "Tuesday", "mercredi": "Wednesday", "jeudi": "Thursday",
+		"vendredi": "Friday", "samedi": "Saturday", "dimanche": "Sunday",
+		"lun.": "Mon", "mar.": "Tue", "mer.": "Wed", "jeu.": "Thu", "ven.": "Fri", "sam.": "Sat", "dim.": "Sun",
+		"lun": "Mon", "mar": "Tue", "mer": "Wed", "jeu": "Thu", "ven": "Fri", "sam": "Sat", "dim": "Sun",
+	},
+	"de": {
+		"januar": "January", "februar": "February", "märz": "March", "april": "April",
+		"mai": "May", "juni": "June", "juli": "July", "august": "August",
+		"september": "September", "oktober": "October", "november": "November", "dezember": "December",
+		"jan": "Jan", "feb": "Feb", "mär": "Mar", "mrz": "Mar", "apr": "Apr", "jun": "Jun",
+		"jul": "Jul", "aug": "Aug", "sep": "Sep", "okt": "Oct", "nov": "Nov", "dez": "Dec",
+		"jan.": "Jan", "feb.": "Feb", "mär.": "Mar", "apr.": "Apr", "aug.": "Aug",
+		"sep.": "Sep", "okt.": "Oct", "nov.": "Nov", "dez.": "Dec",
+		"montag": "Monday", "dienstag": "Tuesday", "mittwoch": "Wednesday", "donnerstag": "Thursday",
+		"freitag": "Friday", "samstag": "Saturday", "sonnabend": "Saturday", "sonntag": "Sunday",
+		"mo": "Mon", "di": "Tue", "mi": "Wed", "do": "Thu", "fr": "Fri", "sa": "Sat", "so": "Sun",
+		"mo.": "Mon", "di.": "Tue", "mi.": "Wed", "do.": "Thu", "fr.": "Fri", "sa.": "Sat", "so.": "Sun",
+	},
+}
+
+// localNames is the table for the locale set with SetLocale, if any
+var localNames map[string]string
+
+// SetLocale makes parsing timestamps recognize the month and weekday names of
+// locale, eg fr or de, in place of English ones. A region (as in fr_FR) is
+// ignored. An empty locale goes back to English only.
+func SetLocale(locale string) error {
+	if locale == "" {
+		localNames = nil
+		return nil
+	}
+	parts := strings.FieldsFunc(locale, func(r rune) bool { return r == '_' || r == '-' })
+	var names map[string]string
+	var ok bool
+	if len(parts) > 0 {
+		names, ok = localeNames[strings.ToLower(parts[0])]
+	}
+	if !ok {
+		return fmt.Errorf("time locale %q isn't supported; use fr or de", locale)
+	}
+	localNames = names
+	return nil
+}
+
+// delocalize replaces the localized month and weekday names in timespec with
+// English ones
+func delocalize(timespec string) string {
+	if localNames == nil {
+		return timespec
+	}
+	var out bytes.Buffer
+	for i := 0; i < len(timespec); {
+		r, size := utf8.DecodeRuneInString(timespec[i:])
+		if !unicode.IsLetter(r) {
+			out.WriteRune(r)
+			i += size
+			continue
+		}
+		end := i
+		for end < len(timespec) {
+			r, size := utf8.DecodeRuneInString(timespec[end:])
+			if !unicode.IsLetter(r) {
+				break
+			}
+			end += size
+		}
+		word := strings.ToLower(timespec[i:end])
+		if end < len(timespec) && timespec[end] == '.' {
+			if english, ok := localNames[word+"."]; ok {
+				out.WriteString(english)
+				i = end + 1
+				continue
+			}
+		}
+		if english, ok := localNames[word]; ok {
+			out.WriteString(english)
+		} else {
+			out.WriteString(timespec[i:end])
+		}
+		i = end
+	}
+	return out.String()
+}
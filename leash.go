@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"regexp"
@@ -23,6 +25,7 @@ import (
 	"github.com/honeycombio/honeytail/event"
 	"github.com/honeycombio/honeytail/parsers"
 	"github.com/honeycombio/honeytail/parsers/arangodb"
+	"github.com/honeycombio/honeytail/parsers/docker"
 	"github.com/honeycombio/honeytail/parsers/htjson"
 	"github.com/honeycombio/honeytail/parsers/keyval"
 	"github.com/honeycombio/honeytail/parsers/mongodb"
@@ -30,6 +33,7 @@ import (
 	"github.com/honeycombio/honeytail/parsers/nginx"
 	"github.com/honeycombio/honeytail/parsers/postgresql"
 	"github.com/honeycombio/honeytail/parsers/regex"
+	"github.com/honeycombio/honeytail/sink"
 	"github.com/honeycombio/honeytail/tail"
 )
 
@@ -72,25 +76,52 @@ func run(options GlobalOptions) {
 	if options.PrefixRegex == "" {
 		prefixRegex = nil
 	} else {
-		prefixRegex = &parsers.ExtRegexp{regexp.MustCompile(options.PrefixRegex)}
+		prefixRegex = parsers.NewExtRegexp(regexp.MustCompile(options.PrefixRegex))
 	}
 
 	// get our lines channel from which to read log lines
 	var linesChans []chan string
-	var err error
-	tc := tail.Config{
-		Paths:   options.Reqs.LogFiles,
-		Type:    tail.RotateStyleSyslog,
-		Options: options.Tail,
-	}
-	if options.TailSample {
-		linesChans, err = tail.GetSampledEntries(ctx, tc, options.SampleRate)
+	var filenames []string
+	if options.ListenAddr != "" || options.SyslogUDPAddr != "" {
+		var lines chan string
+		var addr net.Addr
+		var err error
+		if options.ListenAddr != "" {
+			lines, addr, err = tail.ListenTCP(ctx, options.ListenAddr)
+		} else {
+			lines, addr, err = tail.ListenUDP(ctx, options.SyslogUDPAddr)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+				"Error occurred while trying to listen for connections")
+		}
+		logrus.WithField("addr", addr.String()).Info("Listening for lines to parse")
+		linesChans = []chan string{lines}
+		filenames = []string{addr.String()}
 	} else {
-		linesChans, err = tail.GetEntries(ctx, tc)
-	}
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"err": err}).Fatal(
-			"Error occurred while trying to tail logfile")
+		tc := tail.Config{
+			Paths:   options.Reqs.LogFiles,
+			Type:    tail.RotateStyleSyslog,
+			Options: options.Tail,
+			Shed:    stats.linesShed,
+		}
+		// expand the globs once so we know which file each lines channel reads
+		var err error
+		filenames, err = tail.ExpandPaths(tc)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+				"Error occurred while trying to tail logfile")
+		}
+		tc.Paths = filenames
+		if options.TailSample {
+			linesChans, err = tail.GetSampledEntries(ctx, tc, options.SampleRate)
+		} else {
+			linesChans, err = tail.GetEntries(ctx, tc)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+				"Error occurred while trying to tail logfile")
+		}
 	}
 
 	// set up our signal handler and support canceling
@@ -110,16 +141,48 @@ func run(options GlobalOptions) {
 		}
 	}()
 
+	// open the local file outputs, if we're writing any
+	var sinks []sink.Sink
+	if options.JSONOutputFile != "" {
+		jsonSink, err := sink.NewJSONFile(options.JSONOutputFile)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+				"Error occurred while trying to open the JSON output file")
+		}
+		sinks = append(sinks, jsonSink)
+	}
+	if options.MsgpackOutputFile != "" {
+		msgpackSink, err := sink.NewMsgpackFile(options.MsgpackOutputFile)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+				"Error occurred while trying to open the MessagePack output file")
+		}
+		sinks = append(sinks, msgpackSink)
+	}
+	if options.OTLPLogsEndpoint != "" {
+		sinks = append(sinks, sink.NewOTLPLogs(options.OTLPLogsEndpoint, options.OTLPHeaders))
+	}
+
 	// for each channel we got back from tail.GetEntries, spin up a parser.
 	parsersWG := sync.WaitGroup{}
 	responsesWG := sync.WaitGroup{}
-	for _, lines := range linesChans {
+	sinkWG := sync.WaitGroup{}
+	var parsedChans []chan event.Event
+	// every file's parser counts towards the same max_events
+	eventsSent := new(int64)
+	for i, lines := range linesChans {
 		// get our parser
-		parser, opts := getParserAndOptions(options)
+		parser, opts := getParserAndOptions(options, filenames[i])
 		if parser == nil {
 			logrus.WithFields(logrus.Fields{"parser": options.Reqs.ParserName}).Fatal(
 				"Parser not found. Use --list to show valid parsers")
 		}
+		if kv, ok := parser.(*keyval.Parser); ok {
+			kv.EventsSent = eventsSent
+			// stop tailing every file, including the quiet ones, once the
+			// limit has been reached
+			kv.MaxEventsReached = cancel
+		}
 
 		// and initialize it
 		if err := parser.Init(opts); err != nil {
@@ -127,8 +190,45 @@ func run(options GlobalOptions) {
 				"err initializing parser module")
 		}
 
-		// create a channel for sending events into libhoney
-		toBeSent := make(chan event.Event, options.NumSenders)
+		// buffer enough events from each file to merge them, if we're merging
+		parsedSize := options.NumSenders
+		if options.MergeByTime {
+			parsedSize = options.MergeWindow
+		}
+		parsed := make(chan event.Event, parsedSize)
+		parsedChans = append(parsedChans, parsed)
+		go func(plines chan string) {
+			// ProcessLines won't return until lines is closed
+			parser.ProcessLines(plines, parsed, prefixRegex)
+			// trigger the sending goroutine to finish up
+			close(parsed)
+		}(lines)
+	}
+
+	// interleave the files' events in time order if asked to
+	if options.MergeByTime && len(parsedChans) > 1 {
+		ins := make([]<-chan event.Event, len(parsedChans))
+		for i, parsed := range parsedChans {
+			ins[i] = parsed
+		}
+		merged := make(chan event.Event, options.NumSenders)
+		go parsers.MergeByTime(merged, ins...)
+		parsedChans = []chan event.Event{merged}
+	}
+
+	for _, toBeSent := range parsedChans {
+		// spread out runs of identical timestamps, while they're still in order
+		if options.DistinctTimestamps {
+			distinct := make(chan event.Event, options.NumSenders)
+			go parsers.DistinctTimestamps(toBeSent, distinct)
+			toBeSent = distinct
+		}
+		// shed load instead of stalling the parsers, if asked to
+		if options.SendFullAction != "" && options.SendFullAction != parsers.SendFullBlock {
+			forwarded := make(chan event.Event, options.NumSenders)
+			go parsers.Forward(toBeSent, forwarded, options.SendFullAction)
+			toBeSent = forwarded
+		}
 		doneSending := make(chan bool)
 
 		// two channels to handle backing off when rate limited and resending failed
@@ -140,13 +240,27 @@ func run(options GlobalOptions) {
 		// apply any filters to the events before they get sent
 		modifiedToBeSent := modifyEventContents(toBeSent, options)
 
+		// tee events off to the output files if there are any. Don't stop on
+		// ctx cancellation; everything upstream needs to be drained to shut down.
+		toHoneycomb := modifiedToBeSent
+		if len(sinks) > 0 {
+			toHoneycomb = make(chan event.Event, options.NumSenders)
+			toSink := make(chan event.Event, options.NumSenders)
+			go parsers.FanOut(context.Background(), modifiedToBeSent, toHoneycomb, toSink)
+			sinkWG.Add(1)
+			go func() {
+				writeToSinks(sinks, toSink)
+				sinkWG.Done()
+			}()
+		}
+
 		realToBeSent := make(chan event.Event, 10*options.NumSenders)
 		go func() {
 			wg := sync.WaitGroup{}
-			for i := uint(0); i < options.NumSenders; i++ {
+			for i := uint(0); i < numWorkers(options); i++ {
 				wg.Add(1)
 				go func() {
-					for ev := range modifiedToBeSent {
+					for ev := range toHoneycomb {
 						realToBeSent <- ev
 					}
 					wg.Done()
@@ -169,17 +283,20 @@ func run(options GlobalOptions) {
 		}()
 
 		parsersWG.Add(1)
-		go func(plines chan string) {
-			// ProcessLines won't return until lines is closed
-			parser.ProcessLines(plines, toBeSent, prefixRegex)
-			// trigger the sending goroutine to finish up
-			close(toBeSent)
+		go func() {
 			// wait for all the events in toBeSent to be handed to libhoney
 			<-doneSending
 			parsersWG.Done()
-		}(lines)
+		}()
 	}
 	parsersWG.Wait()
+	sinkWG.Wait()
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error(
+				"Error occurred while closing an output")
+		}
+	}
 	// tell libhoney to finish up sending events
 	libhoney.Close()
 	// print out what we've done one last time
@@ -191,44 +308,68 @@ func run(options GlobalOptions) {
 	logrus.Info("Honeytail is all done, goodbye!")
 }
 
+// numWorkers is how many goroutines parse, and then modify, each file's
+// events. Merging by time and making timestamps distinct need every file's
+// events kept in order, so they get just one.
+func numWorkers(options GlobalOptions) uint {
+	if options.MergeByTime || options.DistinctTimestamps {
+		return 1
+	}
+	return options.NumSenders
+}
+
 // getParserOptions takes a parser name and the global options struct
-// it returns the options group for the specified parser
-func getParserAndOptions(options GlobalOptions) (parsers.Parser, interface{}) {
+// it returns the options group for the specified parser. sourceFile is the
+// file from which the parser will be reading lines.
+func getParserAndOptions(options GlobalOptions, sourceFile string) (parsers.Parser, interface{}) {
 	var parser parsers.Parser
 	var opts interface{}
+	numParsers := int(numWorkers(options))
 	switch options.Reqs.ParserName {
 	case "regex":
 		parser = &regex.Parser{}
 		opts = &options.Regex
-		opts.(*regex.Options).NumParsers = int(options.NumSenders)
+		opts.(*regex.Options).NumParsers = numParsers
 	case "nginx":
 		parser = &nginx.Parser{}
 		opts = &options.Nginx
-		opts.(*nginx.Options).NumParsers = int(options.NumSenders)
+		opts.(*nginx.Options).NumParsers = numParsers
+	case "docker":
+		parser = &docker.Parser{}
+		opts = &options.Docker
+		opts.(*docker.Options).NumParsers = numParsers
 	case "json":
 		parser = &htjson.Parser{}
 		opts = &options.JSON
-		opts.(*htjson.Options).NumParsers = int(options.NumSenders)
+		opts.(*htjson.Options).NumParsers = numParsers
 	case "keyval":
 		parser = &keyval.Parser{}
 		opts = &options.KeyVal
-		opts.(*keyval.Options).NumParsers = int(options.NumSenders)
+		opts.(*keyval.Options).NumParsers = numParsers
+		opts.(*keyval.Options).SourceFile = sourceFile
 	case "mongo", "mongodb":
 		parser = &mongodb.Parser{}
 		opts = &options.Mongo
-		opts.(*mongodb.Options).NumParsers = int(options.NumSenders)
+		opts.(*mongodb.Options).NumParsers = numParsers
 	case "mysql":
 		parser = &mysql.Parser{
 			SampleRate: int(options.SampleRate),
 		}
 		opts = &options.MySQL
-		opts.(*mysql.Options).NumParsers = int(options.NumSenders)
+		opts.(*mysql.Options).NumParsers = numParsers
 	case "postgresql":
 		opts = &options.PostgreSQL
 		parser = &postgresql.Parser{}
 	case "arangodb":
 		parser = &arangodb.Parser{}
 		opts = &options.ArangoDB
+	default:
+		if _, ok := parsers.Lookup(options.Reqs.ParserName); ok {
+			parser = &parsers.RegisteredParser{
+				Name:       options.Reqs.ParserName,
+				NumParsers: numParsers,
+			}
+		}
 	}
 	parser, _ = parser.(parsers.Parser)
 	return parser, opts
@@ -248,7 +389,13 @@ func modifyEventContents(toBeSent chan event.Event, options GlobalOptions) chan
 				"add_field": addField,
 			}).Fatal("unable to separate provided field into a key=val pair")
 		}
-		parsedAddFields[splitField[0]] = splitField[1]
+		parsedAddFields[splitField[0]] = expandEnv(splitField[1])
+	}
+	if options.AddVersionField {
+		parsedAddFields["_honeytail_version"] = version
+	}
+	if options.AddConfigHashField {
+		parsedAddFields["_config_hash"] = configHash(options)
 	}
 	// do all the advance work for request shaping
 	shaper := &requestShaper{}
@@ -266,6 +413,10 @@ func modifyEventContents(toBeSent chan event.Event, options GlobalOptions) chan
 			shaper.pr.Patterns = append(shaper.pr.Patterns, &pat)
 		}
 	}
+	keepFields := make(map[string]bool, len(options.KeepFields))
+	for _, field := range options.KeepFields {
+		keepFields[field] = true
+	}
 	// initialize the dynamic sampler
 	var sampler dynsampler.Sampler
 	if len(options.DynSample) != 0 {
@@ -282,7 +433,7 @@ func modifyEventContents(toBeSent chan event.Event, options GlobalOptions) chan
 	newSent := make(chan event.Event, options.NumSenders)
 	go func() {
 		wg := sync.WaitGroup{}
-		for i := uint(0); i < options.NumSenders; i++ {
+		for i := uint(0); i < numWorkers(options); i++ {
 			wg.Add(1)
 			go func() {
 				for ev := range toBeSent {
@@ -318,6 +469,11 @@ func modifyEventContents(toBeSent chan event.Event, options GlobalOptions) chan
 							ev.SampleRate = sr
 						}
 					}
+					// collapse the overflow after sampling, which may need the
+					// fields that are about to go
+					if options.OverflowField != "" {
+						overflowFields(&ev, keepFields, options.OverflowField)
+					}
 					newSent <- ev
 				}
 				wg.Done()
@@ -459,6 +615,80 @@ func sendToLibhoney(ctx context.Context, toBeSent chan event.Event, toBeResent c
 	}
 }
 
+// expandEnv replaces $VAR or ${VAR} in s with the value of the environment
+// variable, eg to add_field region=${AWS_REGION}. Undefined variables are
+// replaced with nothing, with a warning. $$ is a literal $.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			logrus.WithField("variable", name).Warn("environment variable in add_field is not set; leaving it empty")
+		}
+		return val
+	})
+}
+
+// configHash returns a hash of the options honeytail is running with. The
+// write key and the flags that only choose what honeytail does at startup
+// (rather than how it processes events) are left out.
+func configHash(options GlobalOptions) string {
+	options.Reqs.WriteKey = ""
+	options.ConfigFile = ""
+	options.Modes = OtherModes{}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		logrus.WithField("error", err).Fatal("unable to encode the options to hash them")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(encoded))[:16]
+}
+
+// overflowFields moves every field of ev not in keep into a single field,
+// overflowField, as a JSON object
+func overflowFields(ev *event.Event, keep map[string]bool, overflowField string) {
+	overflow := make(map[string]interface{})
+	for k, v := range ev.Data {
+		if !keep[k] {
+			overflow[k] = v
+		}
+	}
+	if len(overflow) == 0 {
+		return
+	}
+	encoded, err := json.Marshal(overflow)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"event": ev,
+			"error": err,
+		}).Error("Unexpected error encoding fields for overflow_field; sending them as they are")
+		return
+	}
+	for k := range overflow {
+		delete(ev.Data, k)
+	}
+	ev.Data[overflowField] = string(encoded)
+}
+
+// writeToSinks writes all the events it reads from toSink to each of the
+// output files, skipping any that have been dropped by sampling
+func writeToSinks(sinks []sink.Sink, toSink chan event.Event) {
+	for ev := range toSink {
+		if ev.SampleRate == -1 {
+			continue
+		}
+		for _, s := range sinks {
+			if err := s.Write(ev); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"event": ev,
+					"error": err,
+				}).Error("Unexpected error writing event to an output")
+			}
+		}
+	}
+}
+
 // sendEvent does the actual handoff to libhoney
 func sendEvent(ev event.Event) {
 	if ev.SampleRate == -1 {
@@ -472,6 +702,9 @@ func sendEvent(ev event.Event) {
 	libhEv.Metadata = ev
 	libhEv.Timestamp = ev.Timestamp
 	libhEv.SampleRate = uint(ev.SampleRate)
+	if ev.Dataset != "" {
+		libhEv.Dataset = ev.Dataset
+	}
 	if err := libhEv.Add(ev.Data); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"event": ev,
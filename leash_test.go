@@ -12,13 +12,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sys/unix"
 
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
 	"github.com/honeycombio/honeytail/tail"
 )
 
@@ -231,6 +234,97 @@ func TestDropField(t *testing.T) {
 	assert.Contains(t, ts.rsp.reqBody, `{"format":"json"}`)
 }
 
+func TestOverflowField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/overflow.log"
+	fh, _ := os.Create(logFileName)
+	defer fh.Close()
+	fmt.Fprintf(fh, `{"format":"json","status":200,"pod":"web-1","zone":"a"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.KeepFields = []string{"format", "status"}
+	opts.OverflowField = "extra"
+	run(opts)
+	assert.Equal(t, ts.rsp.reqCounter, 1)
+	assert.Contains(t, ts.rsp.reqBody, `{"extra":"{\"pod\":\"web-1\",\"zone\":\"a\"}","format":"json","status":200}`)
+}
+
+func TestVersionAndConfigHashFields(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/stamp.log"
+	fh, _ := os.Create(logFileName)
+	defer fh.Close()
+	fmt.Fprintf(fh, `{"format":"json"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.AddVersionField = true
+	opts.AddConfigHashField = true
+	defer func(v string) { version = v }(version)
+	version = "1.2.3"
+	run(opts)
+	assert.Equal(t, ts.rsp.reqCounter, 1)
+	hash := configHash(opts)
+	assert.Len(t, hash, 16)
+	assert.Contains(t, ts.rsp.reqBody, fmt.Sprintf(`{"_config_hash":"%s","_honeytail_version":"1.2.3","format":"json"}`, hash))
+
+	// the hash only depends on the config, and doesn't give away the write key
+	same := opts
+	same.Reqs.WriteKey = "another key"
+	assert.Equal(t, hash, configHash(same))
+	different := opts
+	different.DropFields = []string{"format"}
+	assert.NotEqual(t, hash, configHash(different))
+}
+
+func TestAddFieldExpandsEnv(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/addenv.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintf(logfh, `{"format":"json"}`)
+	os.Setenv("HONEYTAIL_TEST_REGION", "us-east-1")
+	defer os.Unsetenv("HONEYTAIL_TEST_REGION")
+	os.Unsetenv("HONEYTAIL_TEST_UNSET")
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.AddFields = []string{`region=${HONEYTAIL_TEST_REGION}`, `zone=$HONEYTAIL_TEST_REGION-a`, `missing=[${HONEYTAIL_TEST_UNSET}]`, `price=$$5`}
+	run(opts)
+	assert.Contains(t, ts.rsp.reqBody, `{"format":"json","missing":"[]","price":"$5","region":"us-east-1","zone":"us-east-1-a"}`)
+}
+
+// upperParser is a LineParser that records the line uppercased
+type upperParser struct{}
+
+func (upperParser) ParseLine(line string) (map[string]interface{}, error) {
+	return map[string]interface{}{"upper": strings.ToUpper(line)}, nil
+}
+
+func TestRegisteredParser(t *testing.T) {
+	err := parsers.Register("leash_test_upper", func() (parsers.LineParser, error) { return upperParser{}, nil })
+	assert.Nil(t, err)
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/registered.log"
+	fh, _ := os.Create(logFileName)
+	defer fh.Close()
+	fmt.Fprintf(fh, "shout this")
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Reqs.ParserName = "leash_test_upper"
+	run(opts)
+	assert.Equal(t, ts.rsp.reqCounter, 1)
+	assert.Contains(t, ts.rsp.reqBody, `{"upper":"SHOUT THIS"}`)
+}
+
 func TestScrubField(t *testing.T) {
 	opts := defaultOptions
 	ts := &testSetup{}
@@ -265,6 +359,163 @@ func TestAddField(t *testing.T) {
 	assert.Contains(t, ts.rsp.reqBody, `{"format":"json","newfield":"newval","second":"new"}`)
 }
 
+func TestJSONOutputFile(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/tee.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintf(logfh, "{\"format\":\"json\"}\n{\"format\":\"also json\"}")
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.JSONOutputFile = ts.tmpdir + "/events.json"
+	opts.AddFields = []string{"newfield=newval"}
+	run(opts)
+	// events still go to Honeycomb
+	assert.Equal(t, ts.rsp.evtCounter, 2)
+	// and to the file, after being modified
+	contents, err := ioutil.ReadFile(opts.JSONOutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(contents), `"data":{"format":"json","newfield":"newval"}`)
+	assert.Contains(t, string(contents), `"data":{"format":"also json","newfield":"newval"}`)
+}
+
+func TestMergeByTime(t *testing.T) {
+	for _, numSenders := range []uint{1, 8} {
+		testMergeByTime(t, numSenders)
+	}
+}
+
+func testMergeByTime(t *testing.T, numSenders uint) {
+	opts := defaultOptions
+	opts.NumSenders = numSenders
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	// the first file has the even milliseconds, bar a run of odd ones in the
+	// middle, and the second file the rest
+	const numEvents = 400
+	var logfhs []*os.File
+	for i := 0; i < 2; i++ {
+		logFileName := fmt.Sprintf("%s/merge%d.log", ts.tmpdir, i)
+		logfh, _ := os.Create(logFileName)
+		defer logfh.Close()
+		logfhs = append(logfhs, logfh)
+		opts.Reqs.LogFiles = append(opts.Reqs.LogFiles, logFileName)
+	}
+	for n := 0; n < numEvents; n++ {
+		file := n % 2
+		if n >= 100 && n < 110 {
+			file = 0
+		}
+		fmt.Fprintf(logfhs[file], "{\"time\":\"2017-11-23T19:57:04.%03dZ\",\"n\":%d}\n", n, n)
+	}
+	opts.MergeByTime = true
+	opts.JSONOutputFile = ts.tmpdir + "/events.json"
+	run(opts)
+	assert.Equal(t, ts.rsp.evtCounter, numEvents)
+	contents, err := ioutil.ReadFile(opts.JSONOutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if assert.Equal(t, len(lines), numEvents) {
+		for i, line := range lines {
+			if !strings.Contains(line, fmt.Sprintf(`"data":{"n":%d}`, i)) {
+				t.Errorf("with %d senders, expected event %d next, got %s", numSenders, i, line)
+				break
+			}
+		}
+	}
+}
+
+func TestMaxEventsStopsFollowing(t *testing.T) {
+	opts := defaultOptions
+	opts.Reqs.ParserName = "keyval"
+	opts.KeyVal.MaxEvents = 3
+	// follow the files rather than stopping at the end of them
+	opts.Tail.Stop = false
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	busy := ts.tmpdir + "/busy.log"
+	logfh, _ := os.Create(busy)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(logfh, "n=%d\n", i)
+	}
+	logfh.Close()
+	// nothing is ever written to the quiet file, so only stopping the tail
+	// ends its parser
+	quiet := ts.tmpdir + "/quiet.log"
+	logfh, _ = os.Create(quiet)
+	logfh.Close()
+	opts.Reqs.LogFiles = []string{busy, quiet}
+	done := make(chan struct{})
+	go func() {
+		run(opts)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run didn't return after max_events with a quiet file being followed")
+	}
+	assert.Equal(t, ts.rsp.evtCounter, 3)
+}
+
+func TestDistinctTimestamps(t *testing.T) {
+	// with one sender and with the default pool size
+	for _, numSenders := range []uint{1, 80} {
+		testDistinctTimestamps(t, numSenders)
+	}
+}
+
+func testDistinctTimestamps(t *testing.T, numSenders uint) {
+	opts := defaultOptions
+	opts.NumSenders = numSenders
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	const numEvents = 400
+	logFileName := ts.tmpdir + "/distinct.log"
+	logfh, _ := os.Create(logFileName)
+	for i := 0; i < numEvents; i++ {
+		fmt.Fprintf(logfh, "{\"time\":\"2017-11-23T19:57:04Z\",\"n\":%d}\n", i)
+	}
+	logfh.Close()
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.DistinctTimestamps = true
+	opts.JSONOutputFile = ts.tmpdir + "/events.json"
+	run(opts)
+	assert.Equal(t, ts.rsp.evtCounter, numEvents)
+	fh, err := os.Open(opts.JSONOutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	// the nudges follow the order of the lines
+	start := time.Date(2017, 11, 23, 19, 57, 4, 0, time.UTC)
+	dec := json.NewDecoder(fh)
+	for i := 0; i < numEvents; i++ {
+		var ev struct {
+			Time time.Time `json:"time"`
+			Data struct {
+				N int `json:"n"`
+			} `json:"data"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if expected := start.Add(time.Duration(ev.Data.N) * time.Microsecond); !ev.Time.Equal(expected) {
+			t.Errorf("with %d senders, expected line %d at %v, got %v", numSenders, ev.Data.N, expected, ev.Time)
+			break
+		}
+	}
+}
+
 func TestLinePrefix(t *testing.T) {
 	opts := defaultOptions
 	// linePrefix of "Nov 13 10:19:31 app23 process.port[pid]: "
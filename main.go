@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 	"time"
@@ -16,13 +17,17 @@ import (
 	flag "github.com/jessevdk/go-flags"
 
 	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/parsers"
 	"github.com/honeycombio/honeytail/parsers/arangodb"
+	"github.com/honeycombio/honeytail/parsers/docker"
 	"github.com/honeycombio/honeytail/parsers/htjson"
 	"github.com/honeycombio/honeytail/parsers/keyval"
 	"github.com/honeycombio/honeytail/parsers/mongodb"
 	"github.com/honeycombio/honeytail/parsers/mysql"
 	"github.com/honeycombio/honeytail/parsers/nginx"
 	"github.com/honeycombio/honeytail/parsers/postgresql"
+	// registers the preset parsers for common formats
+	_ "github.com/honeycombio/honeytail/parsers/preset"
 	"github.com/honeycombio/honeytail/parsers/regex"
 	"github.com/honeycombio/honeytail/tail"
 )
@@ -35,6 +40,7 @@ var version string
 
 var validParsers = []string{
 	"arangodb",
+	"docker",
 	"json",
 	"keyval",
 	"mongo",
@@ -59,22 +65,37 @@ type GlobalOptions struct {
 	StatusInterval   uint `long:"status_interval" description:"How frequently, in seconds, to print out summary info" default:"60"`
 	Backfill         bool `long:"backfill" description:"Configure honeytail to ingest old data in order to backfill Honeycomb. Sets the correct values for --backoff, --tail.read_from, and --tail.stop"`
 
-	Localtime         bool     `long:"localtime" description:"When parsing a timestamp that has no time zone, assume it is in the same timezone as localhost instead of UTC (the default)"`
-	Timezone          string   `long:"timezone" description:"When parsing a timestamp use this time zone instead of UTC (the default). Must be specified in TZ format as seen here: https://en.wikipedia.org/wiki/List_of_tz_database_time_zones"`
-	ScrubFields       []string `long:"scrub_field" description:"For the field listed, apply a one-way hash to the field content. May be specified multiple times"`
-	DropFields        []string `long:"drop_field" description:"Do not send the field to Honeycomb. May be specified multiple times"`
-	AddFields         []string `long:"add_field" description:"Add the field to every event. Field should be key=val. May be specified multiple times"`
-	RequestShape      []string `long:"request_shape" description:"Identify a field that contains an HTTP request of the form 'METHOD /path HTTP/1.x' or just the request path. Break apart that field into subfields that contain components. May be specified multiple times. Defaults to 'request' when using the nginx parser"`
-	ShapePrefix       string   `long:"shape_prefix" description:"Prefix to use on fields generated from request_shape to prevent field collision"`
-	RequestPattern    []string `long:"request_pattern" description:"A pattern for the request path on which to base the derived request_shape. May be specified multiple times. Patterns are considered in order; first match wins."`
-	RequestParseQuery string   `long:"request_parse_query" description:"How to parse the request query parameters. 'whitelist' means only extract listed query keys. 'all' means to extract all query parameters as individual columns" default:"whitelist"`
-	RequestQueryKeys  []string `long:"request_query_keys" description:"Request query parameter key names to extract, when request_parse_query is 'whitelist'. May be specified multiple times."`
-	BackOff           bool     `long:"backoff" description:"When rate limited by the API, back off and retry sending failed events. Otherwise failed events are dropped. When --backfill is set, it will override this option=true"`
-	PrefixRegex       string   `long:"log_prefix" description:"pass a regex to this flag to strip the matching prefix from the line before handing to the parser. Useful when log aggregation prepends a line header. Use named groups to extract fields into the event."`
-	DynSample         []string `long:"dynsampling" description:"enable dynamic sampling using the field listed in this option. May be specified multiple times; fields will be concatenated to form the dynsample key. WARNING increases CPU utilization dramatically over normal sampling"`
-	DynWindowSec      int      `long:"dynsample_window" description:"measurement window size for the dynsampler, in seconds" default:"30"`
-	GoalSampleRate    int      `hidden:"true" description:"used to hold the desired sample rate and set tailing sample rate to 1"`
-	MinSampleRate     int      `long:"dynsample_minimum" description:"if the rate of traffic falls below this, dynsampler won't sample" default:"1"`
+	Localtime          bool              `long:"localtime" description:"When parsing a timestamp that has no time zone, assume it is in the same timezone as localhost instead of UTC (the default)"`
+	Timezone           string            `long:"timezone" description:"When parsing a timestamp use this time zone instead of UTC (the default). Must be specified in TZ format as seen here: https://en.wikipedia.org/wiki/List_of_tz_database_time_zones"`
+	TimeLocale         string            `long:"time_locale" description:"When parsing a timestamp, read month and weekday names in this language instead of English. Values: fr, de"`
+	ScrubFields        []string          `long:"scrub_field" description:"For the field listed, apply a one-way hash to the field content. May be specified multiple times"`
+	DropFields         []string          `long:"drop_field" description:"Do not send the field to Honeycomb. May be specified multiple times"`
+	AddFields          []string          `long:"add_field" description:"Add the field to every event. Field should be key=val. Environment variables in val, eg ${AWS_REGION}, are expanded at startup; write $$ for a literal $. May be specified multiple times"`
+	KeepFields         []string          `long:"keep_field" description:"When overflow_field is set, send this field as a column of its own. May be specified multiple times"`
+	OverflowField      string            `long:"overflow_field" description:"Collapse every field not named by keep_field into this one field, as a JSON object. Saves columns for fields that are rarely queried"`
+	AddVersionField    bool              `long:"add_version_field" description:"Add the version of honeytail that sent it to every event, as _honeytail_version"`
+	AddConfigHashField bool              `long:"add_config_hash_field" description:"Add a hash of the honeytail options in effect to every event, as _config_hash, to tell which configuration sent it. The write key is left out of the hash"`
+	RequestShape       []string          `long:"request_shape" description:"Identify a field that contains an HTTP request of the form 'METHOD /path HTTP/1.x' or just the request path. Break apart that field into subfields that contain components. May be specified multiple times. Defaults to 'request' when using the nginx parser"`
+	ShapePrefix        string            `long:"shape_prefix" description:"Prefix to use on fields generated from request_shape to prevent field collision"`
+	RequestPattern     []string          `long:"request_pattern" description:"A pattern for the request path on which to base the derived request_shape. May be specified multiple times. Patterns are considered in order; first match wins."`
+	RequestParseQuery  string            `long:"request_parse_query" description:"How to parse the request query parameters. 'whitelist' means only extract listed query keys. 'all' means to extract all query parameters as individual columns" default:"whitelist"`
+	RequestQueryKeys   []string          `long:"request_query_keys" description:"Request query parameter key names to extract, when request_parse_query is 'whitelist'. May be specified multiple times."`
+	BackOff            bool              `long:"backoff" description:"When rate limited by the API, back off and retry sending failed events. Otherwise failed events are dropped. When --backfill is set, it will override this option=true"`
+	PrefixRegex        string            `long:"log_prefix" description:"pass a regex to this flag to strip the matching prefix from the line before handing to the parser. Useful when log aggregation prepends a line header. Use named groups to extract fields into the event."`
+	DynSample          []string          `long:"dynsampling" description:"enable dynamic sampling using the field listed in this option. May be specified multiple times; fields will be concatenated to form the dynsample key. WARNING increases CPU utilization dramatically over normal sampling"`
+	DynWindowSec       int               `long:"dynsample_window" description:"measurement window size for the dynsampler, in seconds" default:"30"`
+	GoalSampleRate     int               `hidden:"true" description:"used to hold the desired sample rate and set tailing sample rate to 1"`
+	MinSampleRate      int               `long:"dynsample_minimum" description:"if the rate of traffic falls below this, dynsampler won't sample" default:"1"`
+	MergeByTime        bool              `long:"merge_by_time" description:"When reading several files, merge their events into a single stream in timestamp order. Each file's lines must already be in order, and are parsed by a single goroutine to keep them that way. A file with nothing new to read holds up the rest, so this is best used with --backfill"`
+	MergeWindow        uint              `long:"merge_window" description:"When merging by time, the number of parsed events to buffer from each file" default:"1000"`
+	DistinctTimestamps bool              `long:"distinct_timestamps" description:"When consecutive events from a file have exactly the same timestamp, as happens when logs only record the second, add a microsecond to each after the first so their order is kept, moving on any later events they catch up with too. Each file is parsed by a single goroutine so lines are nudged in the order they were written. Events that arrive out of order are left alone"`
+	SendFullAction     string            `long:"send_full_action" description:"What to do with parsed events when sending can't keep up. Values: block (slow down reading the logs), drop_new (drop events that don't fit), drop_oldest (drop the longest waiting events to make room). Drops are reported as warnings" default:"block"`
+	JSONOutputFile     string            `long:"json_output_file" description:"In addition to sending events to Honeycomb, append each one as a line of JSON to this file. Useful for checking what honeytail is sending"`
+	MsgpackOutputFile  string            `long:"msgpack_output_file" description:"In addition to sending events to Honeycomb, append each one in MessagePack to this file, preceded by its length as a 4 byte big-endian integer. Smaller and cheaper to write than json_output_file, eg for throughput tests"`
+	OTLPLogsEndpoint   string            `long:"otlp_logs_endpoint" description:"In addition to sending events to Honeycomb, send each one as an OpenTelemetry log record to this OTLP/HTTP endpoint (eg http://localhost:4318/v1/logs), with the event's fields as attributes. Records are sent in the background; if the endpoint can't keep up, batches are dropped rather than slowing down sending to Honeycomb"`
+	OTLPHeaders        map[string]string `long:"otlp_header" description:"Header to add to requests to otlp_logs_endpoint, in the form name:value (eg x-honeycomb-team:abc123). May be specified multiple times"`
+	ListenAddr         string            `long:"listen_addr" description:"Instead of reading log files, listen for TCP connections on this address (eg :5140) and parse each line sent on them. Stops on SIGINT or SIGTERM"`
+	SyslogUDPAddr      string            `long:"syslog_udp_addr" description:"Instead of reading log files, listen for syslog messages, or anything else sent one line per datagram, on this UDP address (eg :514) and parse each one as a line. Stops on SIGINT or SIGTERM"`
 
 	Reqs  RequiredOptions `group:"Required Options"`
 	Modes OtherModes      `group:"Other Modes"`
@@ -82,6 +103,7 @@ type GlobalOptions struct {
 	Tail tail.TailOptions `group:"Tail Options" namespace:"tail"`
 
 	ArangoDB   arangodb.Options   `group:"ArangoDB Parser Options" namespace:"arangodb"`
+	Docker     docker.Options     `group:"Docker Parser Options" namespace:"docker"`
 	JSON       htjson.Options     `group:"JSON Parser Options" namespace:"json"`
 	KeyVal     keyval.Options     `group:"KeyVal Parser Options" namespace:"keyval"`
 	Mongo      mongodb.Options    `group:"MongoDB Parser Options" namespace:"mongo"`
@@ -92,10 +114,11 @@ type GlobalOptions struct {
 }
 
 type RequiredOptions struct {
-	ParserName string   `short:"p" long:"parser" description:"Parser module to use. Use --list to list available options."`
-	WriteKey   string   `short:"k" long:"writekey" description:"Team write key"`
-	LogFiles   []string `short:"f" long:"file" description:"Log file(s) to parse. Use '-' for STDIN, use this flag multiple times to tail multiple files, or use a glob (/path/to/foo-*.log)"`
-	Dataset    string   `short:"d" long:"dataset" description:"Name of the dataset"`
+	ParserName   string   `short:"p" long:"parser" description:"Parser module to use. Use --list to list available options."`
+	WriteKey     string   `short:"k" long:"writekey" env:"HONEYCOMB_WRITEKEY" description:"Team write key. May also be set with the HONEYCOMB_WRITEKEY environment variable or read from --writekey_file, which keeps it out of process listings"`
+	WriteKeyFile string   `long:"writekey_file" description:"File from which to read the team write key. Overrides --writekey"`
+	LogFiles     []string `short:"f" long:"file" description:"Log file(s) to parse. Use '-' for STDIN, use this flag multiple times to tail multiple files, or use a glob (/path/to/foo-*.log)"`
+	Dataset      string   `short:"d" long:"dataset" description:"Name of the dataset"`
 }
 
 type OtherModes struct {
@@ -113,7 +136,7 @@ func main() {
 	flagParser := flag.NewParser(&options, flag.PrintErrors)
 	flagParser.Usage = "-p <parser> -k <writekey> -f </path/to/logfile> -d <mydata> [optional arguments]\n\nSee https://honeycomb.io/docs/connect/agent/ for more detailed usage instructions."
 
-	if extraArgs, err := flagParser.Parse(); err != nil || len(extraArgs) != 0 {
+	if extraArgs, err := flagParser.ParseArgs(migrateArgs(os.Args[1:])); err != nil || len(extraArgs) != 0 {
 		fmt.Println("Error: failed to parse the command line.")
 		if err != nil {
 			fmt.Printf("\t%s\n", err)
@@ -127,7 +150,7 @@ func main() {
 	if options.ConfigFile != "" {
 		ini := flag.NewIniParser(flagParser)
 		ini.ParseAsDefaults = true
-		if err := ini.ParseFile(options.ConfigFile); err != nil {
+		if err := parseConfigFile(ini, options.ConfigFile); err != nil {
 			fmt.Printf("Error: failed to parse the config file %s\n", options.ConfigFile)
 			fmt.Printf("\t%s\n", err)
 			usage()
@@ -163,6 +186,18 @@ func main() {
 		}
 		httime.Location = loc
 	}
+	if err := httime.SetLocale(options.TimeLocale); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		usage()
+		os.Exit(1)
+	}
+
+	if err := resolveWriteKey(&options.Reqs); err != nil {
+		fmt.Printf("Error: failed to read the write key from %s\n", options.Reqs.WriteKeyFile)
+		fmt.Printf("\t%s\n", err)
+		usage()
+		os.Exit(1)
+	}
 
 	setVersionUserAgent(options.Backfill, options.Reqs.ParserName)
 	handleOtherModes(flagParser, options.Modes)
@@ -173,6 +208,122 @@ func main() {
 	run(options)
 }
 
+// resolveWriteKey reads the write key from the write key file, if one was
+// given. The environment variable is handled by the flag parser.
+func resolveWriteKey(reqs *RequiredOptions) error {
+	if reqs.WriteKeyFile == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(reqs.WriteKeyFile)
+	if err != nil {
+		return err
+	}
+	reqs.WriteKey = strings.TrimSpace(string(contents))
+	return nil
+}
+
+// renamedOptions maps the old long names of renamed options, namespace
+// included (eg json.time_field), to their current names so configs written
+// for an older honeytail keep working. Add an entry when renaming an option.
+var renamedOptions = map[string]string{}
+
+// warnedRenames is the old names a deprecation warning has been logged for
+var warnedRenames = map[string]bool{}
+
+// renamedOption returns the current name of the option once called name, if
+// it has been renamed, warning the first time each old name is used
+func renamedOption(name string) (string, bool) {
+	current, ok := renamedOptions[name]
+	if !ok {
+		return name, false
+	}
+	if !warnedRenames[name] {
+		logrus.WithFields(logrus.Fields{
+			"option":  name,
+			"renamed": current,
+		}).Warn("Option has been renamed; the old name is deprecated and will stop working in a future release")
+		warnedRenames[name] = true
+	}
+	return current, true
+}
+
+// migrateArgs rewrites any renamed long options on the command line to their
+// current names
+func migrateArgs(args []string) []string {
+	migrated := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(migrated, args[i:]...)
+		}
+		if strings.HasPrefix(arg, "--") {
+			name, value := arg[2:], ""
+			if eq := strings.Index(name, "="); eq != -1 {
+				name, value = name[:eq], name[eq:]
+			}
+			if current, ok := renamedOption(name); ok {
+				arg = "--" + current + value
+			}
+		}
+		migrated = append(migrated, arg)
+	}
+	return migrated
+}
+
+// configSectionNamespaces maps the INI sections of option groups with a
+// namespace (eg [JSON Parser Options]) to the namespace (eg json)
+func configSectionNamespaces() map[string]string {
+	namespaces := make(map[string]string)
+	t := reflect.TypeOf(GlobalOptions{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		if group, namespace := tag.Get("group"), tag.Get("namespace"); group != "" && namespace != "" {
+			namespaces[group] = namespace
+		}
+	}
+	return namespaces
+}
+
+// migrateConfig rewrites any renamed options in the contents of an INI config
+// file to their current names. In the section of a namespaced group, old
+// names are also recognized without the namespace (eg timefield under [JSON
+// Parser Options]). Options named by their struct field are left alone, as
+// renaming the long name doesn't change the field.
+func migrateConfig(contents string) string {
+	namespaces := configSectionNamespaces()
+	var namespace string
+	lines := strings.Split(contents, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			namespace = namespaces[strings.TrimSpace(trimmed[1:len(trimmed)-1])]
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq == -1 || strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		name := strings.TrimSpace(line[:eq])
+		current, ok := renamedOption(name)
+		if !ok && namespace != "" {
+			current, ok = renamedOption(namespace + "." + name)
+		}
+		if ok {
+			lines[i] = current + " " + line[eq:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseConfigFile reads the INI config file at path with ini, after migrating
+// any renamed options
+func parseConfigFile(ini *flag.IniParser, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ini.Parse(strings.NewReader(migrateConfig(string(contents))))
+}
+
 // setVersion sets the internal version ID and updates libhoney's user-agent
 func setVersionUserAgent(backfill bool, parserName string) {
 	if BuildID == "" {
@@ -214,7 +365,14 @@ func handleOtherModes(fp *flag.Parser, modes OtherModes) {
 	}
 
 	if modes.ListParsers {
-		fmt.Println("Available parsers:", strings.Join(validParsers, ", "))
+		available := append([]string{}, validParsers...)
+		for _, name := range parsers.Registered() {
+			// built in parsers register their line parsers for sub_parse
+			if !whitelistKey(validParsers, name) {
+				available = append(available, name)
+			}
+		}
+		fmt.Println("Available parsers:", strings.Join(available, ", "))
 		os.Exit(0)
 	}
 }
@@ -242,6 +400,17 @@ func addParserDefaultOptions(options *GlobalOptions) {
 	}
 }
 
+// countSet returns how many of its arguments are true
+func countSet(set ...bool) int {
+	n := 0
+	for _, s := range set {
+		if s {
+			n++
+		}
+	}
+	return n
+}
+
 func sanityCheckOptions(options *GlobalOptions) {
 	switch {
 	case options.Reqs.ParserName == "":
@@ -252,8 +421,12 @@ func sanityCheckOptions(options *GlobalOptions) {
 		fmt.Println("Write key required to be specified with the --writekey flag.")
 		usage()
 		os.Exit(1)
-	case len(options.Reqs.LogFiles) == 0:
-		fmt.Println("Log file name or '-' required to be specified with the --file flag.")
+	case len(options.Reqs.LogFiles) == 0 && options.ListenAddr == "" && options.SyslogUDPAddr == "":
+		fmt.Println("Log file name or '-' required to be specified with the --file flag, unless listening with --listen_addr or --syslog_udp_addr.")
+		usage()
+		os.Exit(1)
+	case countSet(len(options.Reqs.LogFiles) != 0, options.ListenAddr != "", options.SyslogUDPAddr != "") > 1:
+		fmt.Println("Only one of --file, --listen_addr and --syslog_udp_addr can be used.")
 		usage()
 		os.Exit(1)
 	case options.Reqs.Dataset == "":
@@ -272,6 +445,15 @@ func sanityCheckOptions(options *GlobalOptions) {
 		fmt.Println("request_parse_query flag must be either 'whitelist' or 'all'.")
 		usage()
 		os.Exit(1)
+	case options.SendFullAction != parsers.SendFullBlock && options.SendFullAction != parsers.SendFullDropNew &&
+		options.SendFullAction != parsers.SendFullDropOldest:
+		fmt.Println("send_full_action flag must be one of 'block', 'drop_new' or 'drop_oldest'.")
+		usage()
+		os.Exit(1)
+	case options.OverflowField != "" && len(options.KeepFields) == 0:
+		fmt.Println("keep_field must be set when overflow_field is.")
+		usage()
+		os.Exit(1)
 	case len(options.DynSample) != 0 && options.SampleRate <= 1 && options.GoalSampleRate <= 1:
 		fmt.Println("sample rate flag must be set >= 2 when dynamic sampling is enabled")
 		usage()
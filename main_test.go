@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveWriteKeyFromFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	keyFile := filepath.Join(tmpdir, "writekey")
+	if err := ioutil.WriteFile(keyFile, []byte("abcabc123123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := RequiredOptions{WriteKey: "fromflag", WriteKeyFile: keyFile}
+	assert.Nil(t, resolveWriteKey(&reqs))
+	assert.Equal(t, "abcabc123123", reqs.WriteKey)
+
+	// without a file the write key is left alone
+	reqs = RequiredOptions{WriteKey: "fromflag"}
+	assert.Nil(t, resolveWriteKey(&reqs))
+	assert.Equal(t, "fromflag", reqs.WriteKey)
+
+	reqs = RequiredOptions{WriteKeyFile: filepath.Join(tmpdir, "missing")}
+	assert.NotNil(t, resolveWriteKey(&reqs))
+}
+
+func TestWriteKeyFromEnv(t *testing.T) {
+	defer os.Unsetenv("HONEYCOMB_WRITEKEY")
+	os.Setenv("HONEYCOMB_WRITEKEY", "fromenv")
+
+	var options GlobalOptions
+	_, err := flag.NewParser(&options, flag.None).ParseArgs([]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, "fromenv", options.Reqs.WriteKey)
+
+	// an explicit flag wins over the environment
+	options = GlobalOptions{}
+	_, err = flag.NewParser(&options, flag.None).ParseArgs([]string{"-k", "fromflag"})
+	assert.Nil(t, err)
+	assert.Equal(t, "fromflag", options.Reqs.WriteKey)
+}
+
+func TestRenamedOptions(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logrus.SetOutput(buf)
+	defer logrus.SetOutput(os.Stderr)
+	defer func(renamed map[string]string) {
+		renamedOptions = renamed
+		warnedRenames = map[string]bool{}
+	}(renamedOptions)
+	// pretend the parsers' timefield options used to be called time_key
+	renamedOptions = map[string]string{
+		"json.time_key":   "json.timefield",
+		"keyval.time_key": "keyval.timefield",
+		"regex.time_key":  "regex.timefield",
+	}
+
+	var options GlobalOptions
+	fp := flag.NewParser(&options, flag.None)
+	args := migrateArgs([]string{"--json.time_key=ts", "-p", "json", "--json.time_key", "at", "--", "--json.time_key"})
+	assert.Equal(t, []string{"--json.timefield=ts", "-p", "json", "--json.timefield", "at", "--", "--json.time_key"}, args)
+	_, err := fp.ParseArgs(args[:5])
+	assert.Nil(t, err)
+	assert.Equal(t, "at", options.JSON.TimeFieldName)
+
+	// and in a config file, with or without the namespace in its section
+	options = GlobalOptions{}
+	fp = flag.NewParser(&options, flag.None)
+	config := "[Application Options]\n; json.time_key = commented\njson.time_key = cfg\n" +
+		"[KeyVal Parser Options]\ntime_key = ts\n" +
+		"[Regex Parser Options]\nregex.time_key = at\n"
+	assert.Nil(t, flag.NewIniParser(fp).Parse(strings.NewReader(migrateConfig(config))))
+	assert.Equal(t, "cfg", options.JSON.TimeFieldName)
+	assert.Equal(t, "ts", options.KeyVal.TimeFieldName)
+	assert.Equal(t, "at", options.Regex.TimeFieldName)
+	// the namespace is only implied in its own section
+	assert.Equal(t, "[Application Options]\ntime_key = x", migrateConfig("[Application Options]\ntime_key = x"))
+
+	// the warning is logged once however often the old name is used
+	assert.Equal(t, 1, strings.Count(buf.String(), `option="json.time_key"`))
+	assert.Contains(t, buf.String(), `option="json.time_key" renamed=json.timefield`)
+	assert.Contains(t, buf.String(), `option="keyval.time_key" renamed=keyval.timefield`)
+}
@@ -0,0 +1,153 @@
+// Package docker parses the lines written by Docker's json-file log driver,
+// which wraps each line a container logs in a json blob
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/keyval"
+)
+
+type Options struct {
+	PayloadFormat string `long:"payload_format" description:"How to parse the line the container logged. Values: keyval, raw. Raw keeps the line as a string in the log field, as do keyval lines in which no key=val pairs are found" default:"keyval"`
+	NestPayload   string `long:"nest_payload" description:"Put the fields parsed from a keyval payload in an object in this field instead of at the top level of the event"`
+
+	NumParsers int `hidden:"true" description:"number of docker parsers to spin up"`
+}
+
+type Parser struct {
+	conf          Options
+	lineParser    parsers.LineParser
+	payloadParser parsers.LineParser
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	if p.conf.NumParsers < 1 {
+		p.conf.NumParsers = 1
+	}
+	switch p.conf.PayloadFormat {
+	case "", "keyval":
+		p.payloadParser = &keyval.KeyValLineParser{}
+	case "raw":
+	default:
+		return fmt.Errorf("unknown option to --docker.payload_format: %s", p.conf.PayloadFormat)
+	}
+	p.lineParser = &DockerLineParser{}
+	return nil
+}
+
+// DockerLineParser parses a line from the json-file log driver into the
+// line the container logged (in log), the stream it was written to, and when
+// it was written (in time)
+type DockerLineParser struct {
+}
+
+func (d *DockerLineParser) ParseLine(line string) (map[string]interface{}, error) {
+	var entry struct {
+		Log    *string `json:"log"`
+		Stream string  `json:"stream"`
+		Time   string  `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil, err
+	}
+	if entry.Log == nil {
+		return nil, fmt.Errorf("no log field found")
+	}
+	return map[string]interface{}{
+		"log":    strings.TrimRight(*entry.Log, "\r\n"),
+		"stream": entry.Stream,
+		"time":   entry.Time,
+	}, nil
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < p.conf.NumParsers; i++ {
+		wg.Add(1)
+		go func() {
+			for line := range lines {
+				logrus.WithFields(logrus.Fields{
+					"line": line,
+				}).Debug("Attempting to process docker log line")
+
+				// take care of any headers on the line
+				var prefixFields map[string]string
+				if prefixRegex != nil {
+					var prefix string
+					prefix, prefixFields = prefixRegex.FindStringSubmatchMap(line)
+					line = strings.TrimPrefix(line, prefix)
+				}
+
+				entry, err := p.lineParser.ParseLine(line)
+				if err != nil {
+					// truncated or partial lines are worth knowing about
+					logrus.WithFields(logrus.Fields{
+						"line":  line,
+						"error": err,
+					}).Warn("skipping line; failed to parse docker log entry.")
+					continue
+				}
+
+				parsedLine := p.parsePayload(entry["log"].(string))
+				if stream := entry["stream"].(string); stream != "" {
+					parsedLine["stream"] = stream
+				}
+
+				// merge the prefix fields and the parsed line contents
+				for k, v := range prefixFields {
+					parsedLine[k] = v
+				}
+
+				e := event.Event{
+					Timestamp: p.getTimestamp(entry["time"].(string)),
+					Data:      parsedLine,
+				}
+				send <- e
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	logrus.Debug("lines channel is closed, ending docker processor")
+}
+
+// parsePayload parses the line the container logged according to
+// payload_format
+func (p *Parser) parsePayload(payload string) map[string]interface{} {
+	raw := map[string]interface{}{"log": payload}
+	if p.payloadParser == nil {
+		return raw
+	}
+	fields, err := p.payloadParser.ParseLine(payload)
+	if err != nil || parsers.AllEmpty(fields) {
+		// not keyval after all; keep the line as it was
+		return raw
+	}
+	if p.conf.NestPayload != "" {
+		return map[string]interface{}{p.conf.NestPayload: fields}
+	}
+	return fields
+}
+
+// getTimestamp parses the time the log driver recorded, falling back to the
+// current time
+func (p *Parser) getTimestamp(ts string) time.Time {
+	if t, err := httime.Parse(time.RFC3339Nano, ts); err == nil {
+		return t
+	}
+	logrus.WithFields(logrus.Fields{
+		"time": ts,
+	}).Debug("failed to parse docker log time; using the current time")
+	return httime.Now()
+}
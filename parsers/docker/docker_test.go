@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestParseLine(t *testing.T) {
+	dlp := DockerLineParser{}
+	resp, err := dlp.ParseLine(`{"log":"hello world\n","stream":"stdout","time":"2017-11-23T19:57:38.123456789Z"}`)
+	if err != nil {
+		t.Error("dlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected := map[string]interface{}{
+		"log":    "hello world",
+		"stream": "stdout",
+		"time":   "2017-11-23T19:57:38.123456789Z",
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+	for _, line := range []string{
+		`{"log":"hello world\n","stream":"std`,
+		`{"stream":"stdout"}`,
+	} {
+		if _, err := dlp.ParseLine(line); err == nil {
+			t.Errorf("expected an error parsing %s, got nil", line)
+		}
+	}
+}
+
+func TestProcessLines(t *testing.T) {
+	ts := time.Date(2017, 11, 23, 19, 57, 38, 123456789, time.UTC)
+	lines := []string{
+		`{"log":"starting up\n","stream":"stdout","time":"2017-11-23T19:57:38.123456789Z"}`,
+		`{"log":"level=error msg=boom status=500\n","stream":"stderr","time":"2017-11-23T19:57:38.123456789Z"}`,
+		`{"log":"level=error msg=bo`,
+	}
+	tsts := []struct {
+		opts     *Options
+		expected []map[string]interface{}
+	}{
+		{
+			&Options{},
+			[]map[string]interface{}{
+				{"log": "starting up", "stream": "stdout"},
+				{"level": "error", "msg": "boom", "status": 500, "stream": "stderr"},
+			},
+		},
+		{
+			&Options{NestPayload: "app"},
+			[]map[string]interface{}{
+				{"log": "starting up", "stream": "stdout"},
+				{"app": map[string]interface{}{"level": "error", "msg": "boom", "status": 500}, "stream": "stderr"},
+			},
+		},
+		{
+			&Options{PayloadFormat: "raw"},
+			[]map[string]interface{}{
+				{"log": "starting up", "stream": "stdout"},
+				{"log": "level=error msg=boom status=500", "stream": "stderr"},
+			},
+		},
+	}
+	for _, tst := range tsts {
+		evs := processLines(t, tst.opts, lines)
+		if len(evs) != len(tst.expected) {
+			t.Fatalf("%+v: expected %d events, got %d", tst.opts, len(tst.expected), len(evs))
+		}
+		for i, ev := range evs {
+			if !reflect.DeepEqual(ev.Data, tst.expected[i]) {
+				t.Errorf("%+v: got %+v, expected %+v", tst.opts, ev.Data, tst.expected[i])
+			}
+			if !ev.Timestamp.Equal(ts) {
+				t.Errorf("%+v: got timestamp %v, expected %v", tst.opts, ev.Timestamp, ts)
+			}
+		}
+	}
+
+	p := &Parser{}
+	if err := p.Init(&Options{PayloadFormat: "xml"}); err == nil {
+		t.Error("expected error from an unknown payload_format, got nil")
+	}
+}
+
+// processLines runs a parser with opts over lines and returns the events it
+// sent
+func processLines(t *testing.T, opts *Options, lines []string) []event.Event {
+	p := &Parser{}
+	if err := p.Init(opts); err != nil {
+		t.Fatal(err)
+	}
+	linesCh := make(chan string, len(lines))
+	for _, line := range lines {
+		linesCh <- line
+	}
+	close(linesCh)
+	send := make(chan event.Event, len(lines))
+	p.ProcessLines(linesCh, send, nil)
+	close(send)
+	var evs []event.Event
+	for ev := range send {
+		evs = append(evs, ev)
+	}
+	return evs
+}
@@ -1,6 +1,9 @@
 package parsers
 
-import "regexp"
+import (
+	"regexp"
+	"sync"
+)
 
 // ExtRegexp is a Regexp with one additional method to make it easier to work
 // with named groups
@@ -8,24 +11,71 @@ type ExtRegexp struct {
 	*regexp.Regexp
 }
 
+// namedGroup is a capture group with a name, by its submatch index
+type namedGroup struct {
+	index int
+	name  string
+}
+
+// precomputedGroups holds the named groups of each Regexp made into an
+// ExtRegexp by NewExtRegexp. It's kept beside rather than in ExtRegexp so
+// ExtRegexp{re} literals keep working.
+var (
+	precomputedGroupsMu sync.RWMutex
+	precomputedGroups   = map[*regexp.Regexp][]namedGroup{}
+)
+
+// NewExtRegexp returns an ExtRegexp for re that works out its named groups
+// once, up front, rather than on every call to FindStringSubmatchMap. Use it
+// for regexps matched against every line.
+func NewExtRegexp(re *regexp.Regexp) *ExtRegexp {
+	groups := findNamedGroups(re)
+	precomputedGroupsMu.Lock()
+	precomputedGroups[re] = groups
+	precomputedGroupsMu.Unlock()
+	return &ExtRegexp{re}
+}
+
+func findNamedGroups(re *regexp.Regexp) []namedGroup {
+	var groups []namedGroup
+	for i, name := range re.SubexpNames() {
+		if i == 0 || name == "" {
+			// ignore unnamed matches
+			continue
+		}
+		groups = append(groups, namedGroup{i, name})
+	}
+	return groups
+}
+
+func (r *ExtRegexp) namedGroups() []namedGroup {
+	precomputedGroupsMu.RLock()
+	groups, ok := precomputedGroups[r.Regexp]
+	precomputedGroupsMu.RUnlock()
+	if !ok {
+		groups = findNamedGroups(r.Regexp)
+	}
+	return groups
+}
+
 // FindStringSubmatchMap behaves the same as FindStringSubmatch except instead
 // of a list of matches with the names separate, it returns the full match and a
 // map of named submatches
 func (r *ExtRegexp) FindStringSubmatchMap(s string) (string, map[string]string) {
-	match := r.FindStringSubmatch(s)
-	if match == nil {
+	loc := r.FindStringSubmatchIndex(s)
+	if loc == nil {
 		return "", nil
 	}
 
-	captures := make(map[string]string)
-	for i, name := range r.SubexpNames() {
-		if i == 0 {
-			continue
-		}
-		if name != "" {
-			// ignore unnamed matches
-			captures[name] = match[i]
+	groups := r.namedGroups()
+	captures := make(map[string]string, len(groups))
+	for _, g := range groups {
+		// groups that didn't take part in the match capture ""
+		if start := loc[2*g.index]; start >= 0 {
+			captures[g.name] = s[start:loc[2*g.index+1]]
+		} else {
+			captures[g.name] = ""
 		}
 	}
-	return match[0], captures
+	return s[loc[0]:loc[1]], captures
 }
@@ -0,0 +1,79 @@
+package parsers
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// findStringSubmatchMap is the straightforward implementation the fast path
+// has to agree with
+func findStringSubmatchMap(r *regexp.Regexp, s string) (string, map[string]string) {
+	match := r.FindStringSubmatch(s)
+	if match == nil {
+		return "", nil
+	}
+	captures := make(map[string]string)
+	for i, name := range r.SubexpNames() {
+		if i != 0 && name != "" {
+			captures[name] = match[i]
+		}
+	}
+	return match[0], captures
+}
+
+const prefixLine = "Nov 13 10:19:31 app23 process.port[pid]: key1=val1 key2=val2"
+
+var prefixRegex = regexp.MustCompile(`(?P<date>\w+ \d+) (?P<time>[\d:]+) (?P<hostname>[a-zA-Z0-9]+) (?P<process>[\w.]+)\[(?P<pid>\w+)\]:`)
+
+func TestFindStringSubmatchMap(t *testing.T) {
+	tsts := []struct {
+		re, s string
+	}{
+		{prefixRegex.String(), prefixLine},
+		{`(?P<a>x)(?P<b>y)?`, "-x-"},
+		{`(?P<a>\d)(\w)(?P<a>\d)`, "1b2"},
+		{`(\d+)`, "123"},
+		{`^$`, ""},
+		{`(?P<a>x)`, "no match"},
+	}
+	for _, tst := range tsts {
+		re := regexp.MustCompile(tst.re)
+		expectedMatch, expected := findStringSubmatchMap(re, tst.s)
+		// literals work out the groups as they go
+		for _, r := range []*ExtRegexp{{re}, NewExtRegexp(regexp.MustCompile(tst.re))} {
+			match, captures := r.FindStringSubmatchMap(tst.s)
+			if match != expectedMatch || !reflect.DeepEqual(captures, expected) {
+				t.Errorf("%q on %q: got %q %v, expected %q %v",
+					tst.re, tst.s, match, captures, expectedMatch, expected)
+			}
+		}
+	}
+}
+
+func TestFindStringSubmatchMapAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are unreliable with the race detector")
+	}
+	r := NewExtRegexp(prefixRegex)
+	allocs := testing.AllocsPerRun(100, func() { r.FindStringSubmatchMap(prefixLine) })
+	naive := testing.AllocsPerRun(100, func() { findStringSubmatchMap(prefixRegex, prefixLine) })
+	if allocs >= naive {
+		t.Errorf("got %v allocations per line, expected fewer than the %v without the fast path", allocs, naive)
+	}
+}
+
+func BenchmarkFindStringSubmatchMap(b *testing.B) {
+	r := NewExtRegexp(prefixRegex)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.FindStringSubmatchMap(prefixLine)
+	}
+}
+
+func BenchmarkFindStringSubmatchMapNaive(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		findStringSubmatchMap(prefixRegex, prefixLine)
+	}
+}
@@ -0,0 +1,52 @@
+package parsers
+
+import (
+	"context"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// FanOut reads events from in and delivers each one to every channel in outs.
+// It blocks until every out has accepted the event, so a slow consumer slows
+// down all of them rather than losing events. Each out after the first gets
+// its own copy of the event's Data so consumers may modify events
+// independently of each other. FanOut returns when in is closed or ctx is
+// cancelled, closing all of outs on its way out.
+func FanOut(ctx context.Context, in <-chan event.Event, outs ...chan<- event.Event) {
+	defer func() {
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+	for {
+		var ev event.Event
+		var ok bool
+		select {
+		case ev, ok = <-in:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		// make all the copies before handing out any events, since a consumer
+		// may start modifying its event as soon as it gets it
+		outEvs := make([]event.Event, len(outs))
+		for i := range outs {
+			outEvs[i] = ev
+			if i > 0 {
+				outEvs[i].Data = make(map[string]interface{}, len(ev.Data))
+				for k, v := range ev.Data {
+					outEvs[i].Data[k] = v
+				}
+			}
+		}
+		for i, out := range outs {
+			select {
+			case out <- outEvs[i]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package parsers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestFanOut(t *testing.T) {
+	in := make(chan event.Event)
+	out1 := make(chan event.Event)
+	out2 := make(chan event.Event)
+	go FanOut(context.Background(), in, out1, out2)
+
+	counts := make([]int, 2)
+	wg := sync.WaitGroup{}
+	for i, out := range []chan event.Event{out1, out2} {
+		wg.Add(1)
+		go func(i int, out chan event.Event) {
+			for ev := range out {
+				if ev.Data["n"] != counts[i] {
+					t.Errorf("consumer %d: expected event %d, got %v", i, counts[i], ev.Data["n"])
+				}
+				// modifying one consumer's event must not affect the other's
+				ev.Data["consumer"] = i
+				counts[i]++
+			}
+			wg.Done()
+		}(i, out)
+	}
+	for n := 0; n < 100; n++ {
+		in <- event.Event{Data: map[string]interface{}{"n": n}}
+	}
+	close(in)
+	wg.Wait()
+	for i, count := range counts {
+		if count != 100 {
+			t.Errorf("consumer %d: expected 100 events, got %d", i, count)
+		}
+	}
+}
+
+func TestFanOutCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan event.Event, 1)
+	out1 := make(chan event.Event, 1)
+	out2 := make(chan event.Event) // nobody reads this one
+	done := make(chan struct{})
+	go func() {
+		FanOut(ctx, in, out1, out2)
+		close(done)
+	}()
+	in <- event.Event{Data: map[string]interface{}{}}
+	// FanOut is blocked on out2; cancelling should release it
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("FanOut didn't return after its context was cancelled")
+	}
+}
@@ -0,0 +1,68 @@
+package parsers
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// What Forward does when out is full
+const (
+	// SendFullBlock waits for room in out
+	SendFullBlock = "block"
+	// SendFullDropNew drops the event that doesn't fit
+	SendFullDropNew = "drop_new"
+	// SendFullDropOldest drops the oldest event waiting in out to make room
+	SendFullDropOldest = "drop_oldest"
+)
+
+// dropReportInterval is how many dropped events go by between warnings
+const dropReportInterval = 1000
+
+// Forward sends the events it reads from in to out, closing out once in is
+// closed. When out is full, action (one of the SendFull constants) decides
+// whether to wait or to drop an event. The drop actions never block, so a
+// slow consumer of out loses events instead of holding up whatever is
+// feeding in. Drops are reported as warnings, and Forward returns how many
+// events it dropped.
+func Forward(in <-chan event.Event, out chan event.Event, action string) int {
+	defer close(out)
+	var dropped int
+	drop := func() {
+		dropped++
+		if dropped%dropReportInterval == 1 {
+			logrus.WithFields(logrus.Fields{
+				"action":  action,
+				"dropped": dropped,
+			}).Warn("dropping events; the send path can't keep up.")
+		}
+	}
+	for ev := range in {
+		if action != SendFullDropNew && action != SendFullDropOldest {
+			out <- ev
+			continue
+		}
+		select {
+		case out <- ev:
+			continue
+		default:
+		}
+		if action == SendFullDropOldest {
+			select {
+			case <-out:
+				// the evicted event is as lost as one we refuse
+				drop()
+			default:
+			}
+			// the consumer may have made room in the meantime, or may be racing
+			// us for it
+			select {
+			case out <- ev:
+				continue
+			default:
+			}
+		}
+		drop()
+	}
+	return dropped
+}
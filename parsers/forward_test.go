@@ -0,0 +1,55 @@
+package parsers
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestForward(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	tsts := []struct {
+		action   string
+		expected []int
+		dropped  int
+	}{
+		{SendFullBlock, []int{0, 1, 2, 3, 4}, 0},
+		{SendFullDropNew, []int{0, 1}, 3},
+		{SendFullDropOldest, []int{3, 4}, 3},
+	}
+	for _, tst := range tsts {
+		in := make(chan event.Event, 5)
+		for n := 0; n < 5; n++ {
+			in <- event.Event{Data: map[string]interface{}{"n": n}}
+		}
+		close(in)
+		// nothing reads out until Forward is done with in, unless it blocks
+		out := make(chan event.Event, 2)
+		done := make(chan struct{})
+		var dropped int
+		go func() {
+			dropped = Forward(in, out, tst.action)
+			close(done)
+		}()
+		if tst.action != SendFullBlock {
+			<-done
+		}
+		var got []int
+		for ev := range out {
+			got = append(got, ev.Data["n"].(int))
+		}
+		if !reflect.DeepEqual(got, tst.expected) {
+			t.Errorf("%s: got events %v, expected %v", tst.action, got, tst.expected)
+		}
+		<-done
+		if dropped != tst.dropped {
+			t.Errorf("%s: dropped %d events, expected %d", tst.action, dropped, tst.dropped)
+		}
+	}
+}
@@ -16,14 +16,28 @@ import (
 
 type Options struct {
 	TimeFieldName   string `long:"timefield" description:"Name of the field that contains a timestamp"`
-	TimeFieldFormat string `long:"format" description:"Format of the timestamp found in timefield (supports strftime and Golang time formats)"`
+	TimeFieldFormat string `long:"format" description:"Format of the timestamp found in timefield (supports strftime and Golang time formats, and unix_mul:N for numbers that give seconds since the epoch when multiplied by N, eg unix_mul:0.1 for tenths of a second)"`
+
+	SubParse      map[string]string `long:"sub_parse" description:"Parse the string value of a field with another parser and nest what it finds under the field, in the form field:parser (eg msg:keyval). The parser can be json, keyval or anything listed by --list after them. May be specified multiple times"`
+	FlattenNested bool              `long:"flatten_nested" description:"Replace nested objects with a field for each of their values named by the path to it joined with dots (eg {\"req\":{\"user\":{\"id\":5}}} becomes req.user.id=5), including those found by sub_parse. A timefield inside a nested object is then named the same way (eg req.time). Arrays are left as they are"`
 
 	NumParsers int `hidden:"true" description:"number of htjson parsers to spin up"`
 }
 
+func init() {
+	// make the line parser available to other parsers' sub_parse
+	err := parsers.Register("json", func() (parsers.LineParser, error) {
+		return &JSONLineParser{}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
 type Parser struct {
 	conf       Options
 	lineParser parsers.LineParser
+	subParsers parsers.SubParsers
 
 	warnedAboutTime bool
 }
@@ -32,7 +46,9 @@ func (p *Parser) Init(options interface{}) error {
 	p.conf = *options.(*Options)
 
 	p.lineParser = &JSONLineParser{}
-	return nil
+	var err error
+	p.subParsers, err = parsers.NewSubParsers(p.conf.SubParse, "sub_parse")
+	return err
 }
 
 type JSONLineParser struct {
@@ -47,6 +63,55 @@ func (j *JSONLineParser) ParseLine(line string) (map[string]interface{}, error)
 	return parsed, err
 }
 
+// flatten returns the fields of data with any nested objects replaced by their
+// values, named by the keys leading to them joined with dots. When two values
+// end up with the same name, eg in {"a.b":1,"a":{"b":2}}, the one nested
+// least deeply wins, so a literal dotted key is kept. Ties go to the path
+// that sorts first, so the result doesn't depend on map order.
+func flatten(data map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{}, len(data))
+	flattenInto(flat, map[string][]string{}, nil, data)
+	return flat
+}
+
+// flattenInto adds the values in data, found at path, to flat. paths records
+// the path to each nested value in flat; values without one are top level.
+func flattenInto(flat map[string]interface{}, paths map[string][]string, path []string, data map[string]interface{}) {
+	for k, v := range data {
+		kPath := append(path[:len(path):len(path)], k)
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenInto(flat, paths, kPath, nested)
+			continue
+		}
+		key := strings.Join(kPath, ".")
+		if _, exists := flat[key]; exists {
+			if existing, nested := paths[key]; !nested || !pathBefore(kPath, existing) {
+				continue
+			}
+		}
+		flat[key] = v
+		if len(kPath) > 1 {
+			paths[key] = kPath
+		} else {
+			delete(paths, key)
+		}
+	}
+}
+
+// pathBefore reports whether the value at path a beats the one at b for the
+// same flattened name: it's less deeply nested, or sorts first
+func pathBefore(a, b []string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	wg := sync.WaitGroup{}
 	for i := 0; i < p.conf.NumParsers; i++ {
@@ -74,6 +139,17 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 					}).Debug("skipping line; failed to parse.")
 					continue
 				}
+				if parsers.AllEmpty(parsedLine) {
+					// skip events with no content, because that's probably broken
+					logrus.WithFields(logrus.Fields{
+						"line": line,
+					}).Debug("skipping line; no non-empty values found.")
+					continue
+				}
+				p.subParsers.Parse(parsedLine)
+				if p.conf.FlattenNested {
+					parsedLine = flatten(parsedLine)
+				}
 				timestamp := httime.GetTimestamp(parsedLine, p.conf.TimeFieldName, p.conf.TimeFieldFormat)
 
 				// merge the prefix fields and the parsed line contents
@@ -1,8 +1,14 @@
 package htjson
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	// registers the keyval line parser for sub_parse
+	_ "github.com/honeycombio/honeytail/parsers/keyval"
 )
 
 type testLineMap struct {
@@ -49,3 +55,110 @@ func TestParseLine(t *testing.T) {
 		}
 	}
 }
+
+func TestSubParse(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{SubParse: map[string]string{"msg": "keyval"}, NumParsers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	send := make(chan event.Event, 2)
+	go func() {
+		lines <- `{"level":"info","msg":"user=alice dur=12 path=/login"}`
+		lines <- `{"level":"info","msg":5}`
+		close(lines)
+	}()
+	p.ProcessLines(lines, send, nil)
+	close(send)
+	expected := []map[string]interface{}{
+		{"level": "info", "msg": map[string]interface{}{"user": "alice", "dur": 12, "path": "/login"}},
+		{"level": "info", "msg": float64(5)},
+	}
+	var i int
+	for ev := range send {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d events, got %d", len(expected), i)
+	}
+
+	if err := (&Parser{}).Init(&Options{SubParse: map[string]string{"msg": "yaml"}}); err == nil {
+		t.Error("expected an error sub-parsing with an unknown parser")
+	}
+}
+
+func TestFlattenNested(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{FlattenNested: true, TimeFieldName: "req.time", NumParsers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	send := make(chan event.Event, 2)
+	go func() {
+		lines <- `{"level":"info","req":{"time":"2014-03-10T19:57:38Z","path":"/login","ids":[1,2]}}`
+		lines <- `{"req":{"time":"2014-03-10T19:57:39Z"},"a":{"b":{"c":{"d":"deep"},"e":3}}}`
+		close(lines)
+	}()
+	p.ProcessLines(lines, send, nil)
+	close(send)
+	expected := []event.Event{
+		{
+			Timestamp: time.Date(2014, 3, 10, 19, 57, 38, 0, time.UTC),
+			Data: map[string]interface{}{
+				"level":    "info",
+				"req.path": "/login",
+				"req.ids":  []interface{}{float64(1), float64(2)},
+			},
+		},
+		{
+			Timestamp: time.Date(2014, 3, 10, 19, 57, 39, 0, time.UTC),
+			Data: map[string]interface{}{
+				"a.b.c.d": "deep",
+				"a.b.e":   float64(3),
+			},
+		},
+	}
+	var i int
+	for ev := range send {
+		if !ev.Timestamp.Equal(expected[i].Timestamp) {
+			t.Errorf("expected timestamp %s, got %s", expected[i].Timestamp, ev.Timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, expected[i].Data) {
+			t.Errorf("expected %+v, got %+v", expected[i].Data, ev.Data)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d events, got %d", len(expected), i)
+	}
+}
+
+func TestFlattenCollisions(t *testing.T) {
+	tsts := []struct {
+		line     string
+		expected map[string]interface{}
+	}{
+		// the literal key wins, whichever comes first
+		{`{"a.b":1,"a":{"b":2}}`, map[string]interface{}{"a.b": float64(1)}},
+		{`{"a":{"b":2},"a.b":1}`, map[string]interface{}{"a.b": float64(1)}},
+		// then the shallower one, then the one that sorts first
+		{`{"a":{"b":{"c":3},"b.c":2}}`, map[string]interface{}{"a.b.c": float64(2)}},
+		{`{"a.b":{"c":2},"a":{"b.c":1}}`, map[string]interface{}{"a.b.c": float64(1)}},
+	}
+	for _, tst := range tsts {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(tst.line), &data); err != nil {
+			t.Fatal(err)
+		}
+		// map order is random, so give it a few goes
+		for n := 0; n < 20; n++ {
+			if flat := flatten(data); !reflect.DeepEqual(flat, tst.expected) {
+				t.Errorf("%s: expected %v, got %v", tst.line, tst.expected, flat)
+				break
+			}
+		}
+	}
+}
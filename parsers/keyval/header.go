@@ -0,0 +1,34 @@
+package keyval
+
+import (
+	"errors"
+	"strings"
+)
+
+// HeaderLineParser parses lines written like HTTP headers, a name and its
+// value separated by ": " (eg "X-Forwarded-For: 10.0.0.1, 10.0.0.2")
+type HeaderLineParser struct {
+	// SplitValues, if set, splits the value on commas into a list of its
+	// trimmed elements
+	SplitValues bool
+}
+
+func (h *HeaderLineParser) ParseLine(line string) (map[string]interface{}, error) {
+	sep := strings.Index(line, ": ")
+	if sep == -1 {
+		return nil, errors.New("no ': ' separating a header name from its value")
+	}
+	name := strings.TrimSpace(line[:sep])
+	if name == "" {
+		return nil, errors.New("header has no name")
+	}
+	value := strings.TrimSpace(line[sep+2:])
+	if !h.SplitValues {
+		return map[string]interface{}{name: value}, nil
+	}
+	var values []interface{}
+	for _, elem := range strings.Split(value, ",") {
+		values = append(values, strings.TrimSpace(elem))
+	}
+	return map[string]interface{}{name: values}, nil
+}
@@ -2,10 +2,15 @@
 package keyval
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/kr/logfmt"
@@ -16,18 +21,146 @@ import (
 )
 
 type Options struct {
-	TimeFieldName   string `long:"timefield" description:"Name of the field that contains a timestamp"`
-	TimeFieldFormat string `long:"format" description:"Format of the timestamp found in timefield (supports strftime and Golang time formats)"`
-	FilterRegex     string `long:"filter_regex" description:"a regular expression that will filter the input stream and only parse lines that match"`
-	InvertFilter    bool   `long:"invert_filter" description:"change the filter_regex to only process lines that do *not* match"`
+	TimeFieldName           string   `long:"timefield" description:"Name of the field that contains a timestamp"`
+	TimeFieldCandidates     []string `long:"timefield_candidate" description:"Name of a field that may contain the timestamp, for logs whose timestamp is in different fields on different lines. Candidates are tried in the order given and the first that is present and parses with format is used. Use instead of timefield. May be specified multiple times"`
+	TimeFieldFormat         string   `long:"format" description:"Format of the timestamp found in timefield (supports strftime and Golang time formats, and unix_mul:N for numbers that give seconds since the epoch when multiplied by N, eg unix_mul:0.1 for tenths of a second)"`
+	StrictTimeFormat        bool     `long:"strict_time_format" description:"Parse timefield using only format (RFC3339 with optional nanoseconds if format is unset) instead of falling back to guessing. Timestamps that do not match are reported and the event is sent with the current time and timefield left in place"`
+	DropOnTimeParseFailure  bool     `long:"drop_on_time_parse_failure" description:"Drop lines whose timefield is missing or fails to parse, instead of sending them with the current time"`
+	MinTime                 string   `long:"min_time" description:"Drop events whose timestamp is before this time, in RFC3339 format (eg 2017-11-23T00:00:00Z). Useful for backfilling a window of time"`
+	MaxTime                 string   `long:"max_time" description:"Drop events whose timestamp is after this time, in RFC3339 format"`
+	TimeOfDayWindow         string   `long:"time_of_day_window" description:"Drop events whose timestamp is outside this time of day, in the form HH:MM-HH:MM in time_of_day_timezone (eg 09:00-17:00). The start is included and the end is not; a window whose end is before its start runs past midnight (eg 22:00-06:00)"`
+	TimeOfDayTimezone       string   `long:"time_of_day_timezone" description:"Time zone of time_of_day_window, by its tz database name (eg Europe/Berlin)" default:"UTC"`
+	FilterRegex             string   `long:"filter_regex" description:"a regular expression that will filter the input stream and only parse lines that match"`
+	InvertFilter            bool     `long:"invert_filter" description:"change the filter_regex to only process lines that do *not* match"`
+	FilterAfterPrefix       bool     `long:"filter_after_prefix" description:"apply the filter_regex to the line after the log_prefix has been stripped instead of the full line"`
+	FilterAsTag             string   `long:"filter_as_tag" description:"Instead of dropping lines ruled out by filter_regex, keep every line and record in this boolean field whether the filter would have kept it (honoring invert_filter)"`
+	BlockWhen               []string `long:"block_when" description:"Drop events in which a field has a value, in the form field=value (eg path=/healthz or status=204). Values are compared as text, with numbers written in their shortest form (eg ratio=0.5 matches ratio=0.50). Checked after the other transforms; an event matching any condition is dropped. May be specified multiple times"`
+	LastFieldGreedy         string   `long:"last_field_greedy" description:"Name of a key whose unquoted value runs to the end of the line, spaces included (eg msg for 'level=info msg=a long message')"`
+	PairSeparator           string   `long:"pair_separator" description:"Separator between key=val pairs, in addition to whitespace (eg ; for 'a=1;b=2'). Separators inside quoted values are left alone"`
+	LineFormat              string   `long:"line_format" description:"How pairs are written. Values: keyval (key=val pairs), header (one HTTP header style Name: value pair per line, eg X-Forwarded-For: a, b)" default:"keyval"`
+	HeaderSplitValues       bool     `long:"header_split_values" description:"With line_format header, split the value on commas into a list of its trimmed elements"`
+	FirstTokenField         string   `long:"first_token_field" description:"Name of a field in which to put an unkeyed token at the start of the line, such as the level in 'ERROR user=alice'. Lines that start with a key=val pair are parsed as usual"`
+	DecimalComma            bool     `long:"decimal_comma" description:"Parse numbers written with a decimal comma and dot or space thousands separators (eg 1.234,56). Applies to all fields unless decimal_comma_field is set"`
+	DecimalCommaFields      []string `long:"decimal_comma_field" description:"Limit decimal_comma to this field. May be specified multiple times"`
+	CoerceNumericRegex      string   `long:"coerce_numeric_regex" description:"Only turn values into numbers if the whole value matches this regular expression (eg ^-?\\d+$|^-?\\d+\\.\\d+$). Other values are left as strings. By default anything that parses as a number becomes one"`
+	BoolTokensFile          string   `long:"bool_tokens_file" description:"Path to a file of extra words to turn into booleans, one per line as a token and true or false separated by a tab (eg ja<tab>true). Tokens match regardless of case and take precedence over the usual true/false parsing"`
+	KeepParseErrors         bool     `long:"keep_parse_errors" description:"Instead of dropping lines that fail to parse, send an event containing _parse_error=true, the raw line in _raw_line, and the error in _parse_error_message"`
+	EmitUnparsedAsMessage   bool     `long:"emit_unparsed_as_message" description:"Send non-blank lines in which no key=val pairs were found as an event with the whole line in message_field instead of skipping them"`
+	MessageField            string   `long:"message_field" description:"Name of the field used by emit_unparsed_as_message" default:"message"`
+	PrefixFieldNamespace    string   `long:"prefix_field_namespace" description:"Prepend this to the names of fields captured by the log_prefix (eg prefix_ turns host into prefix_host), keeping them apart from fields in the rest of the line. A timefield found only in the prefix may be given with or without the namespace"`
+	AllEmptyAction          string   `long:"all_empty_action" description:"What to do with lines whose values are all the empty string. Values: skip, emit, reject. Reject logs the line as a warning and drops it" default:"skip"`
+	PresenceBoolFields      []string `long:"presence_bool_field" description:"Treat this field as a flag that is set by being present, eg cached in cached= miss=, and make it true whatever its value. Applied before all_empty_action, so lines of nothing but empty flags are kept. May be specified multiple times"`
+	PresenceBoolAbsentFalse bool     `long:"presence_bool_absent_false" description:"Set presence_bool_fields that are missing from a line to false instead of leaving them out"`
+	BareKeyAsTrue           bool     `long:"bare_key_as_true" description:"Make keys with no value, bare (eg verbose) or with nothing after the = (eg verbose=), true instead of the empty string, so lines of nothing but flags are kept. Quoted empty values (eg verbose=\"\") stay empty strings"`
+	DedupeConsecutive       bool     `long:"dedupe_consecutive" description:"Collapse runs of identical lines (after the log_prefix is stripped) into a single event with a repeat_count field. Best effort: each of the parser's goroutines dedupes the lines it sees, and an event is held until a different line arrives"`
+	PreserveOrder           bool     `long:"preserve_order" description:"Send events in the same order as the lines they came from by parsing with a single goroutine instead of one per sender. Costs throughput on busy logs"`
+	ParseTimeoutMs          uint     `long:"parse_timeout_ms" description:"Abandon a line if applying the filter and prefix regexes to it, or parsing it, takes longer than this many milliseconds. Protects against pathological regexes; 0 means no limit"`
+	MaxFieldsPerKB          uint     `long:"max_fields_per_kb" description:"Reject, with a warning, lines with more than this many fields per kilobyte, a sign of corrupt input that would otherwise add heaps of columns. Lines shorter than a kilobyte count as a whole one. 0 means no limit"`
+	MaxEvents               int      `long:"max_events" description:"Stop after sending this many events, counted across all the files being read, eg to sample the start of a file into a test dataset. Lines the parser goroutines are working on when the limit is reached are dropped. 0 means no limit"`
+	RepeatedErrorWindowMs   uint     `long:"repeated_error_window_ms" description:"Log a run of identical parse errors once, followed by a \"(repeated N times)\" summary at most this often in milliseconds, instead of once per line. 0 logs every parse error"`
 
-	NumParsers int `hidden:"true" description:"number of keyval parsers to spin up"`
+	IPFields                  []string          `long:"ip_field" description:"Parse the value of this field as an IP address and add fields describing it (_is_private, _is_ipv6, _network_class). May be specified multiple times"`
+	UUIDFields                []string          `long:"uuid_field" description:"Check the value of this field is an RFC 4122 UUID (eg 123e4567-e89b-42d3-a456-426655440000) and handle invalid ones according to uuid_invalid_action. May be specified multiple times"`
+	SemverFields              []string          `long:"semver_field" description:"Parse the value of this field as a semantic version (eg 2.0.0-rc1+build.5, optionally with a leading v) and add field_major, field_minor and field_patch as numbers, and field_prerelease and field_build when present. Values that are not a semantic version are left alone. May be specified multiple times"`
+	UUIDInvalidAction         string            `long:"uuid_invalid_action" description:"What to do with the value of a uuid_field. Values: mark (add a field_valid field that is true or false), drop (remove invalid values)" default:"mark"`
+	DateOnlyFields            []string          `long:"date_only_field" description:"Turn a date without a time in this field (eg date=2023-01-02) into an RFC3339 timestamp for midnight at the start of that day in date_only_timezone. Values that are not a valid YYYY-MM-DD date are left alone. May be specified multiple times"`
+	DateOnlyTimezone          string            `long:"date_only_timezone" description:"Time zone of the dates in date_only_fields, by its tz database name (eg America/Los_Angeles)" default:"UTC"`
+	Base64DecodeFields        []string          `long:"base64_decode_field" description:"Decode the base64 value of this field, replacing it with the decoded text. Values that are not valid base64 or do not decode to UTF-8 text are left alone. May be specified multiple times"`
+	URLDecodeFields           []string          `long:"url_decode_field" description:"Percent-decode the value of this field (eg /a%20b becomes /a b). Values that are not validly encoded are left alone. May be specified multiple times"`
+	TrimFields                map[string]string `long:"trim_field" description:"Trim these characters from both ends of the value of a field, in the form field:cutset (eg rid:[] turns [abc123] into abc123, and msg::; trims colons and semicolons). May be specified multiple times"`
+	TruncateFields            map[string]int    `long:"truncate_field" description:"Keep only part of the value of a field, in the form field:length. A positive length keeps that many characters from the start (eg sha:8), a negative one that many from the end (eg card:-4). May be specified multiple times"`
+	CollapseWhitespaceFields  []string          `long:"collapse_whitespace_field" description:"Replace runs of whitespace in the value of this field with a single space and trim it from both ends (eg \"a    b \" becomes \"a b\"). May be specified multiple times"`
+	LowercaseValueFields      []string          `long:"lowercase_value_field" description:"Lowercase the value of this field (eg GET becomes get). May be specified multiple times"`
+	UppercaseValueFields      []string          `long:"uppercase_value_field" description:"Uppercase the value of this field (eg us becomes US). May be specified multiple times"`
+	SplitListFields           []string          `long:"split_list_field" description:"Split the value of this field on split_list_separator. May be specified multiple times"`
+	SplitListMode             string            `long:"split_list_mode" description:"How to record the elements of a split_list_field. Values: array (replace the value with a list), indexed (replace the value with fields named field_0, field_1, ...)" default:"array"`
+	SplitListSeparator        string            `long:"split_list_separator" description:"Separator between the elements of a split_list_field" default:","`
+	SplitListDropEmpty        bool              `long:"split_list_drop_empty" description:"Drop empty elements when splitting a split_list_field"`
+	JSONArrayFields           []string          `long:"json_array_field" description:"Parse the value of this field as a JSON array (eg ids=[1,2,3]) and record its elements according to json_array_mode. Values that aren't a JSON array are left alone. May be specified multiple times"`
+	JSONArrayMode             string            `long:"json_array_mode" description:"How to record the elements of a json_array_field. Values: array (replace the value with a list), indexed (replace the value with fields named field_0, field_1, ...), joined (replace the value with the elements separated by commas)" default:"array"`
+	JSONFields                []string          `long:"json_field" description:"Parse the value of this field as a JSON object (eg payload=\"{\\\"a\\\":1}\") and replace the value with the object, so it is sent nested. A JSON string holding an object, as left by escaping it twice, is unwrapped first. Values that are not a JSON object are left alone. May be specified multiple times"`
+	SubParse                  map[string]string `long:"sub_parse" description:"Parse the string value of a field with another parser and nest what it finds under the field, in the form field:parser (eg payload:json). The parser can be json, keyval or anything listed by --list after them. May be specified multiple times"`
+	SplitHostPortFields       []string          `long:"split_host_port_field" description:"Split a value of this field like 10.0.0.1:54321 or [::1]:8080 into field_ip and field_port (as a number). A value that is an IP with no port just gets field_ip. May be specified multiple times"`
+	SplitHostPortDropOriginal bool              `long:"split_host_port_drop_original" description:"Remove a split_host_port_field once it has been split"`
+	CSVFields                 []string          `long:"csv_field" description:"Split the comma separated value of a field into named fields, in the form field=name,name (eg coords=lat,lon turns coords=\"12.3,45.6\" into lat=12.3 and lon=45.6). Numbers are stored as numbers. A value with a different number of parts is left alone. May be specified multiple times"`
+	CookieFields              []string          `long:"cookie_field" description:"Split the Cookie header style value of this field (eg cookie=\"a=1; b=2\") into a field per cookie named field_name (eg cookie_a and cookie_b). Numbers are stored as numbers. The field itself is left as it is. May be specified multiple times"`
+	EnrichFromFile            []string          `long:"enrich_from_file" description:"Add fields looked up from a TSV file, in the form field=/path/to/file.tsv. The file's header row names the key column followed by the fields to add; each following row maps a value of field to the values to add. May be specified multiple times"`
+	ValueMaps                 []string          `long:"value_map" description:"Map the values of a field to new ones, in the form field=value:mapped,value:mapped (eg status=404:Not Found,500:Server Error). Mapped values replace the original unless a target is given as field:target=..., in which case they are added as target. Values not in the map are left alone. May be specified multiple times"`
+	AddSourceFileField        string            `long:"add_source_file_field" description:"Name of a field in which to record the file each line was read from"`
+	DatasetField              string            `long:"dataset_field" description:"Send each event to the Honeycomb dataset named by the value of this field (eg type, to send type=access and type=error lines to the access and error datasets). Events without the field go to the default dataset"`
+	HashCombineFields         []string          `long:"hash_combine_field" description:"Add a field containing a hash of several fields, in the form target=algorithm:field,field (eg dedupe_key=fnv:user_id,path,method). Algorithms: fnv, sha256. Missing fields hash as empty. May be specified multiple times"`
+	BucketHashFields          []string          `long:"bucket_hash_field" description:"Add a field containing which of a number of buckets the value of a field hashes to, in the form field=buckets (eg url=1000 adds url_bucket, a number from 0 to 999). The same value always lands in the same bucket. Name the added field with field:target=buckets. May be specified multiple times"`
+	BucketHashDropOriginal    bool              `long:"bucket_hash_drop_original" description:"Remove the fields named by bucket_hash_field once they have been bucketed"`
+	AddTruncatedTimeFields    []string          `long:"add_truncated_time_field" description:"Add a field containing the event timestamp truncated to a unit, in the form field=unit (eg ts_minute=minute). Units: minute, hour, day. May be specified multiple times"`
+	NormalizeLevelFields      []string          `long:"normalize_level_field" description:"Map the log level in a field to one of trace, debug, info, warn, error, fatal, in the form field=target (eg lvl=level). Understands common spellings and abbreviations, syslog severities (0-7) and bunyan levels (10-60); unknown levels are copied as they are. May be specified multiple times"`
+	StatusClassFields         []string          `long:"status_class_field" description:"Add a field grouping the HTTP status in a field into its class, in the form field=target (eg status=status_class). The class is one of 1xx, 2xx, 3xx, 4xx, 5xx, or other for anything else. May be specified multiple times"`
+	SubtractFields            []string          `long:"subtract_field" description:"Add a field containing the difference between two numeric fields, in the form target=field-field (eg duration_ms=end_ts-start_ts). Skipped, with a warning, when either field is missing or not a number. May be specified multiple times"`
+	ComputeFields             []string          `long:"compute_field" description:"Add a field computed from numeric fields and numbers with +, -, * and /, in the form target=expression (eg error_rate=errors/total*100). The expression is evaluated left to right, without precedence (eg a+b*2 is (a+b)*2), and the result is always a float. Field names can't contain -, and a - that subtracts from or takes away a field needs spaces around it (eg end - start). Skipped, with a warning, when a field is missing or not a number or on division by zero. May be specified multiple times"`
+	BucketFields              []string          `long:"bucket_field" description:"Add a field labelling which range the value of a numeric field falls in, in the form target=field:boundary,boundary:label,label,label (eg latency_bucket=latency_ms:10,100:<10ms,10-100ms,>100ms). Boundaries must increase and there must be one more label than boundaries; a value equal to a boundary goes in the range above it. Skipped, with a warning, when the field is missing or not a number. May be specified multiple times"`
+	UserAgentFields           []string          `long:"user_agent_field" description:"Add field_browser, field_os and field_device (desktop, mobile, tablet or bot) fields describing the User-Agent in this field. Anything that isn't recognized is unknown. May be specified multiple times"`
+	TemplatizePathFields      []string          `long:"templatize_path_field" description:"Add field_template, the URL path in this field with its numeric segments replaced by :id (eg /users/123/orders/456 becomes /users/:id/orders/:id), leaving out any query string. May be specified multiple times"`
+	TemplatizePathHex         bool              `long:"templatize_path_hex" description:"Also replace path segments that are UUIDs or hex IDs of at least 8 characters with a digit in them (eg 5f3a9c1e) with :id"`
+	ExtractPairsFromField     string            `long:"extract_pairs_from_field" description:"Look for key=val pairs in the free text of this field (eg msg=\"processed user=alice in 5ms\") and add them to the event as fields of their own. The field itself is left as it is, and fields already in the event are not overwritten"`
+	ExtractedPairsPrefix      string            `long:"extracted_pairs_prefix" description:"Prepend this to the names of fields found by extract_pairs_from_field (eg msg_ turns user into msg_user)"`
+	TimeFields                map[string]string `long:"time_field_layout" description:"Parse the value of this field as a timestamp using a Go time layout, in the form field:layout (eg created_at:2006-01-02 15:04:05). The value is replaced with the parsed time. May be specified multiple times"`
+	StackDepthFields          map[string]string `long:"stack_depth_field" description:"Add a field counting the frames of the stack trace in a field, in the form field:target (eg stacktrace:stack_depth). Frames are the non-blank parts of the value between stack_frame_delimiter; an empty value has 0. May be specified multiple times"`
+	StackFrameDelimiter       string            `long:"stack_frame_delimiter" description:"Separator between the frames of a stack_depth_field. Takes escapes such as \\n or \\t. Defaults to a newline"`
+	AddFieldCountField        string            `long:"add_field_count_field" description:"Name of a field in which to record the number of fields in the event, not counting itself"`
+	AddParseDurationField     string            `long:"add_parse_duration_field" description:"Name of a field in which to record how long parsing the line took, in microseconds (eg _parse_micros)"`
+	AddEventIDField           string            `long:"add_event_id_field" description:"Name of a field in which to record a random UUID unique to each event, eg to deduplicate events downstream"`
+
+	NumParsers int    `hidden:"true" description:"number of keyval parsers to spin up"`
+	SourceFile string `hidden:"true" description:"the file from which this parser's lines are read"`
+}
+
+func init() {
+	// make the line parser available to other parsers' sub_parse
+	err := parsers.Register("keyval", func() (parsers.LineParser, error) {
+		return &KeyValLineParser{}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
 }
 
 type Parser struct {
-	conf        Options
-	lineParser  parsers.LineParser
+	// EventsSent, if set, counts the events sent towards max_events, so
+	// parsers given the same counter share the limit. A parser without one
+	// gets its own.
+	EventsSent *int64
+	// MaxEventsReached, if set, is called when max_events have been sent, eg
+	// to stop reading the lines of other parsers sharing EventsSent. It may be
+	// called more than once.
+	MaxEventsReached func()
+
+	conf       Options
+	lineParser parsers.LineParser
+	// values coerces the values the transforms split out of fields the same
+	// way lineParser does whole values, whatever the line format
+	values      *KeyValLineParser
 	filterRegex *regexp.Regexp
+	enrichments []fileEnrichment
+	truncTimes  []truncatedTimeField
+	levelFields []levelField
+	statusClass []statusClassField
+	csvFields   []csvField
+	subtracts   []subtractField
+	computes    []computeField
+	buckets     []bucketField
+	valueMaps   []valueMap
+	hashFields  []hashedField
+	hashBuckets []hashBucketField
+	blockWhen   []blockCondition
+	subParsers  parsers.SubParsers
+	minTime     time.Time
+	maxTime     time.Time
+	dateOnlyLoc *time.Location
+	window      *timeOfDayWindow
+	frameDelim  string
+	parseErrors *parsers.RepeatedErrorLog
+	// newEventID makes the IDs for add_event_id_field. Tests may replace it
+	// before calling Init.
+	newEventID func() string
 
 	warnedAboutTime bool
 }
@@ -37,134 +170,1061 @@ func (p *Parser) Init(options interface{}) error {
 	if p.conf.FilterRegex != "" {
 		var err error
 		if p.filterRegex, err = regexp.Compile(p.conf.FilterRegex); err != nil {
+			return fmt.Errorf("invalid filter_regex %q: %s", p.conf.FilterRegex, err)
+		}
+	}
+	if p.conf.MaxEvents < 0 {
+		return fmt.Errorf("max_events must not be negative, got %d", p.conf.MaxEvents)
+	}
+	if p.EventsSent == nil {
+		p.EventsSent = new(int64)
+	}
+	if p.conf.FilterAsTag != "" && p.filterRegex == nil {
+		return fmt.Errorf("filter_as_tag requires filter_regex")
+	}
+
+	switch {
+	case p.conf.NumParsers < 0:
+		return fmt.Errorf("number of keyval parsers must not be negative, got %d", p.conf.NumParsers)
+	case p.conf.NumParsers == 0:
+		// running no parsers would silently drop every line
+		p.conf.NumParsers = 1
+	}
+	if p.conf.PreserveOrder {
+		// several parsers would race each other to send their events
+		p.conf.NumParsers = 1
+	}
+
+	if err := httime.ValidateFormat(p.conf.TimeFieldFormat); err != nil {
+		return fmt.Errorf("invalid format: %s", err)
+	}
+
+	if p.conf.TimeFieldName != "" && len(p.conf.TimeFieldCandidates) > 0 {
+		return fmt.Errorf("timefield and timefield_candidate can't be used together")
+	}
+	if p.conf.StrictTimeFormat && p.conf.TimeFieldName == "" {
+		return fmt.Errorf("strict_time_format requires timefield to be set")
+	}
+
+	for _, bound := range []struct {
+		option string
+		value  string
+		dest   *time.Time
+	}{
+		{"min_time", p.conf.MinTime, &p.minTime},
+		{"max_time", p.conf.MaxTime, &p.maxTime},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %s", bound.option, bound.value, err)
+		}
+		*bound.dest = t
+	}
+
+	if p.conf.TimeOfDayWindow != "" {
+		window, err := parseTimeOfDayWindow(p.conf.TimeOfDayWindow, p.conf.TimeOfDayTimezone)
+		if err != nil {
+			return err
+		}
+		p.window = window
+	}
+
+	switch p.conf.AllEmptyAction {
+	case "", "skip", "emit", "reject":
+	default:
+		return fmt.Errorf("unknown option to --keyval.all_empty_action: %s", p.conf.AllEmptyAction)
+	}
+
+	switch p.conf.LineFormat {
+	case "", "keyval", "header":
+	default:
+		return fmt.Errorf("unknown option to --keyval.line_format: %s", p.conf.LineFormat)
+	}
+	switch p.conf.SplitListMode {
+	case "", "array", "indexed":
+	default:
+		return fmt.Errorf("unknown option to --keyval.split_list_mode: %s", p.conf.SplitListMode)
+	}
+	switch p.conf.UUIDInvalidAction {
+	case "", "mark", "drop":
+	default:
+		return fmt.Errorf("unknown option to --keyval.uuid_invalid_action: %s", p.conf.UUIDInvalidAction)
+	}
+	switch p.conf.JSONArrayMode {
+	case "", "array", "indexed", "joined":
+	default:
+		return fmt.Errorf("unknown option to --keyval.json_array_mode: %s", p.conf.JSONArrayMode)
+	}
+
+	for _, ef := range p.conf.EnrichFromFile {
+		enrichment, err := loadFileEnrichment(ef)
+		if err != nil {
+			return err
+		}
+		p.enrichments = append(p.enrichments, enrichment)
+	}
+
+	for _, vm := range p.conf.ValueMaps {
+		valueMap, err := parseValueMap(vm)
+		if err != nil {
+			return err
+		}
+		p.valueMaps = append(p.valueMaps, valueMap)
+	}
+
+	for _, hf := range p.conf.HashCombineFields {
+		hashField, err := parseHashedField(hf)
+		if err != nil {
+			return err
+		}
+		p.hashFields = append(p.hashFields, hashField)
+	}
+
+	subParsers, err := parsers.NewSubParsers(p.conf.SubParse, "sub_parse")
+	if err != nil {
+		return err
+	}
+	p.subParsers = subParsers
+
+	for _, spec := range p.conf.BlockWhen {
+		bc, err := parseBlockCondition(spec)
+		if err != nil {
+			return err
+		}
+		p.blockWhen = append(p.blockWhen, bc)
+	}
+
+	for _, spec := range p.conf.BucketHashFields {
+		hb, err := parseHashBucketField(spec)
+		if err != nil {
+			return err
+		}
+		p.hashBuckets = append(p.hashBuckets, hb)
+	}
+
+	p.frameDelim = "\n"
+	if p.conf.StackFrameDelimiter != "" {
+		p.frameDelim = p.conf.StackFrameDelimiter
+		if strings.Contains(p.frameDelim, `\`) {
+			delim, err := strconv.Unquote(`"` + p.frameDelim + `"`)
+			if err != nil || delim == "" {
+				return fmt.Errorf("invalid stack_frame_delimiter %q", p.conf.StackFrameDelimiter)
+			}
+			p.frameDelim = delim
+		}
+	}
+
+	p.dateOnlyLoc = time.UTC
+	if p.conf.DateOnlyTimezone != "" {
+		loc, err := time.LoadLocation(p.conf.DateOnlyTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid date_only_timezone %q: %s", p.conf.DateOnlyTimezone, err)
+		}
+		p.dateOnlyLoc = loc
+	}
+
+	if p.conf.AddEventIDField != "" && p.newEventID == nil {
+		p.newEventID = randomUUID
+	}
+
+	if p.conf.RepeatedErrorWindowMs > 0 {
+		p.parseErrors = &parsers.RepeatedErrorLog{
+			Window: time.Duration(p.conf.RepeatedErrorWindowMs) * time.Millisecond,
+		}
+	}
+
+	for _, tf := range p.conf.AddTruncatedTimeFields {
+		truncTime, err := parseTruncatedTimeField(tf)
+		if err != nil {
+			return err
+		}
+		p.truncTimes = append(p.truncTimes, truncTime)
+	}
+
+	for _, lf := range p.conf.NormalizeLevelFields {
+		levelField, err := parseLevelField(lf)
+		if err != nil {
+			return err
+		}
+		p.levelFields = append(p.levelFields, levelField)
+	}
+
+	for _, sc := range p.conf.StatusClassFields {
+		statusClass, err := parseStatusClassField(sc)
+		if err != nil {
 			return err
 		}
+		p.statusClass = append(p.statusClass, statusClass)
 	}
 
-	p.lineParser = &KeyValLineParser{}
+	for field, length := range p.conf.TruncateFields {
+		if length == 0 {
+			return fmt.Errorf("truncate_field %s must keep a non-zero number of characters", field)
+		}
+	}
+
+	for _, spec := range p.conf.SubtractFields {
+		sf, err := parseSubtractField(spec)
+		if err != nil {
+			return err
+		}
+		p.subtracts = append(p.subtracts, sf)
+	}
+
+	for _, spec := range p.conf.ComputeFields {
+		cf, err := parseComputeField(spec)
+		if err != nil {
+			return err
+		}
+		p.computes = append(p.computes, cf)
+	}
+
+	for _, spec := range p.conf.BucketFields {
+		bf, err := parseBucketField(spec)
+		if err != nil {
+			return err
+		}
+		p.buckets = append(p.buckets, bf)
+	}
+
+	for _, spec := range p.conf.CSVFields {
+		cf, err := parseCSVField(spec)
+		if err != nil {
+			return err
+		}
+		p.csvFields = append(p.csvFields, cf)
+	}
+
+	var coerceNumericRegex *regexp.Regexp
+	if p.conf.CoerceNumericRegex != "" {
+		var err error
+		// anchor the expression so it has to match the whole value
+		if coerceNumericRegex, err = regexp.Compile(`^(?:` + p.conf.CoerceNumericRegex + `)$`); err != nil {
+			return fmt.Errorf("invalid coerce_numeric_regex %q: %s", p.conf.CoerceNumericRegex, err)
+		}
+	}
+
+	var boolTokens map[string]bool
+	if p.conf.BoolTokensFile != "" {
+		var err error
+		if boolTokens, err = loadBoolTokens(p.conf.BoolTokensFile); err != nil {
+			return err
+		}
+	}
+
+	p.values = &KeyValLineParser{
+		LastFieldGreedy:    p.conf.LastFieldGreedy,
+		PairSeparator:      p.conf.PairSeparator,
+		DecimalComma:       p.conf.DecimalComma,
+		DecimalCommaFields: p.conf.DecimalCommaFields,
+		CoerceNumericRegex: coerceNumericRegex,
+		BoolTokens:         boolTokens,
+		BareKeyAsTrue:      p.conf.BareKeyAsTrue,
+	}
+	if p.conf.LineFormat == "header" {
+		p.lineParser = &HeaderLineParser{SplitValues: p.conf.HeaderSplitValues}
+		return nil
+	}
+	p.lineParser = p.values
 	return nil
 }
 
 type KeyValLineParser struct {
+	// LastFieldGreedy, if set, names a key whose value absorbs the rest of the
+	// line instead of stopping at the first space
+	LastFieldGreedy string
+	// PairSeparator, if set, separates pairs in addition to whitespace
+	PairSeparator string
+	// DecimalComma, if set, parses numbers such as 1.234,56 that use a comma
+	// as the decimal separator
+	DecimalComma bool
+	// DecimalCommaFields, if set, limits DecimalComma to these keys
+	DecimalCommaFields []string
+	// CoerceNumericRegex, if set, must match a value for it to be turned into
+	// a number
+	CoerceNumericRegex *regexp.Regexp
+	// BoolTokens maps lowercased values to the booleans they become
+	BoolTokens map[string]bool
+	// BareKeyAsTrue, if set, makes keys with no value true
+	BareKeyAsTrue bool
 }
 
+// decimalCommaRegex matches numbers with a decimal comma and optional dot or
+// space thousands separators
+var decimalCommaRegex = regexp.MustCompile(`^-?(\d+|\d{1,3}([.]\d{3})+|\d{1,3}( \d{3})+)(,\d+)?$`)
+
 func (j *KeyValLineParser) ParseLine(line string) (map[string]interface{}, error) {
 	parsed := make(map[string]interface{})
+	if j.PairSeparator != "" {
+		line = replaceUnquoted(line, j.PairSeparator, " ")
+	}
+	var greedyVal string
+	var foundGreedy bool
+	if j.LastFieldGreedy != "" {
+		line, greedyVal, foundGreedy = splitGreedy(line, j.LastFieldGreedy)
+	}
+	line = quoteEmbeddedEquals(line)
 	f := func(key, val []byte) error {
 		keyStr := string(key)
-		valStr := string(val)
-		if b, err := strconv.ParseBool(valStr); err == nil {
-			parsed[keyStr] = b
-			return nil
-		}
-		if i, err := strconv.Atoi(valStr); err == nil {
-			parsed[keyStr] = i
-			return nil
-		}
-		if f, err := strconv.ParseFloat(valStr, 64); err == nil {
-			parsed[keyStr] = f
+		// logfmt gives no value at all for bare keys and keys ending in =,
+		// and an empty one for quoted empty strings
+		if val == nil && j.BareKeyAsTrue {
+			parsed[keyStr] = true
 			return nil
 		}
-		parsed[keyStr] = valStr
+		parsed[keyStr] = j.coerce(keyStr, string(val), true)
 		return nil
 	}
 	err := logfmt.Unmarshal([]byte(line), logfmt.HandlerFunc(f))
+	if foundGreedy {
+		parsed[j.LastFieldGreedy] = greedyVal
+	}
 	return parsed, err
 }
 
+// coerce turns val, the value of key, into a bool or a number if it looks
+// like one: the bool_tokens_file tokens first, then, if parseBool is set,
+// strconv's true and false, then ints and floats, limited by
+// CoerceNumericRegex and read with a decimal comma where DecimalComma says
+// to. Anything else stays a string. Values split out of other fields are
+// coerced without parseBool, so 0 and 1 stay numbers.
+func (j *KeyValLineParser) coerce(key, val string, parseBool bool) interface{} {
+	if b, ok := j.BoolTokens[strings.ToLower(val)]; ok {
+		return b
+	}
+	if parseBool {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	if j.CoerceNumericRegex != nil && !j.CoerceNumericRegex.MatchString(val) {
+		return val
+	}
+	if i, err := strconv.Atoi(val); err == nil {
+		return i
+	}
+	if j.decimalComma(key) {
+		if n, ok := parseDecimalComma(val); ok {
+			return n
+		}
+	}
+	if f, err := strconv.ParseFloat(val, 64); err == nil {
+		return f
+	}
+	return val
+}
+
+func (j *KeyValLineParser) decimalComma(key string) bool {
+	if !j.DecimalComma {
+		return false
+	}
+	if len(j.DecimalCommaFields) == 0 {
+		return true
+	}
+	for _, field := range j.DecimalCommaFields {
+		if field == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDecimalComma parses a number written with a decimal comma. Numbers
+// with no decimal part come back as ints, the others as floats.
+func parseDecimalComma(s string) (interface{}, bool) {
+	if !decimalCommaRegex.MatchString(s) {
+		return nil, false
+	}
+	s = strings.NewReplacer(".", "", " ", "").Replace(s)
+	if !strings.Contains(s, ",") {
+		if i, err := strconv.Atoi(s); err == nil {
+			return i, true
+		}
+	}
+	f, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// replaceUnquoted replaces all occurrences of old in s with new, except for
+// those that are inside double quoted strings
+func replaceUnquoted(s, old, new string) string {
+	if !strings.Contains(s, old) {
+		return s
+	}
+	var buf bytes.Buffer
+	inQuote, escaped := false, false
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case !inQuote && strings.HasPrefix(s[i:], old):
+			buf.WriteString(new)
+			i += len(old)
+			continue
+		}
+		buf.WriteByte(c)
+		i++
+	}
+	return buf.String()
+}
+
+// quoteEmbeddedEquals wraps unquoted values containing an = (eg URLs with
+// query strings, or padded base64) in quotes. logfmt would otherwise end the
+// value at the second =; only the first = in a pair should separate the key
+// from the value.
+func quoteEmbeddedEquals(line string) string {
+	if strings.Count(line, "=") < 2 {
+		return line
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == '"':
+			// copy quoted strings through untouched
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(line) {
+				end++
+			}
+			if end > len(line) {
+				end = len(line)
+			}
+			buf.WriteString(line[i:end])
+			i = end
+		case c == '=' && i+1 < len(line) && line[i+1] > ' ' && line[i+1] != '"':
+			end := i + 1
+			for end < len(line) && line[end] > ' ' {
+				end++
+			}
+			val := line[i+1 : end]
+			if strings.Contains(val, "=") && !strings.ContainsAny(val, "\"\\") {
+				buf.WriteString(`="` + val + `"`)
+			} else {
+				buf.WriteString(line[i:end])
+			}
+			i = end
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	return buf.String()
+}
+
+// splitFirstToken splits the first whitespace-delimited token off line,
+// returning it and the rest of the line. Tokens that are key=val pairs or
+// quoted strings are left in place, returning an empty token.
+func splitFirstToken(line string) (string, string) {
+	trimmed := strings.TrimLeft(line, " \t")
+	end := strings.IndexAny(trimmed, " \t")
+	if end == -1 {
+		end = len(trimmed)
+	}
+	token := trimmed[:end]
+	if strings.ContainsAny(token, `="`) {
+		return "", line
+	}
+	return token, trimmed[end:]
+}
+
+// splitGreedy looks for key= at the start of a token in line. If found and
+// the value is not quoted, it returns the line up to the key and the rest of
+// the line as the key's value. Quoted values are left for logfmt to handle.
+func splitGreedy(line, key string) (string, string, bool) {
+	needle := key + "="
+	for offset := 0; offset < len(line); {
+		idx := strings.Index(line[offset:], needle)
+		if idx == -1 {
+			break
+		}
+		idx += offset
+		if idx == 0 || line[idx-1] == ' ' || line[idx-1] == '\t' {
+			valStart := idx + len(needle)
+			if valStart < len(line) && line[valStart] == '"' {
+				break
+			}
+			return line[:idx], strings.TrimSpace(line[valStart:]), true
+		}
+		offset = idx + len(needle)
+	}
+	return line, "", false
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	// stop is closed once max_events have been sent, to stop all the
+	// goroutines reading lines
+	var stop chan struct{}
+	var stopOnce sync.Once
+	if p.conf.MaxEvents > 0 {
+		stop = make(chan struct{})
+	}
+	// emit sends e unless max_events have already been sent. It returns false
+	// once no more events should be sent.
+	emit := func(e *event.Event) bool {
+		if stop == nil {
+			send <- *e
+			return true
+		}
+		n := atomic.AddInt64(p.EventsSent, 1)
+		if n <= int64(p.conf.MaxEvents) {
+			send <- *e
+		}
+		if n >= int64(p.conf.MaxEvents) {
+			stopOnce.Do(func() {
+				close(stop)
+				if p.MaxEventsReached != nil {
+					p.MaxEventsReached()
+				}
+			})
+			return false
+		}
+		return true
+	}
 	wg := sync.WaitGroup{}
 	for i := 0; i < p.conf.NumParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
-				logrus.WithFields(logrus.Fields{
-					"line": line,
-				}).Debug("Attempting to process keyval log line")
-
-				// if matching regex is set, filter lines here
-				if p.filterRegex != nil {
-					matched := p.filterRegex.MatchString(line)
-					// if both are true or both are false, skip. else continue
-					if matched == p.conf.InvertFilter {
-						logrus.WithFields(logrus.Fields{
-							"line":    line,
-							"matched": matched,
-						}).Debug("skipping line due to FilterMatch.")
-						continue
+			defer wg.Done()
+			// the last event sent when deduping consecutive lines is held here
+			// until a different line arrives
+			var pending *event.Event
+			var pendingLine string
+		ReadLines:
+			for {
+				var rawLine string
+				select {
+				case l, ok := <-lines:
+					if !ok {
+						break ReadLines
 					}
+					rawLine = l
+				case <-stop:
+					return
 				}
-
-				// take care of any headers on the line
-				var prefixFields map[string]string
-				if prefixRegex != nil {
-					var prefix string
-					prefix, prefixFields = prefixRegex.FindStringSubmatchMap(line)
-					line = strings.TrimPrefix(line, prefix)
-				}
-
-				parsedLine, err := p.lineParser.ParseLine(line)
+				line, prefixFields, filtered, err := p.prepareLine(rawLine, prefixRegex)
 				if err != nil {
-					// skip lines that won't parse
-					logrus.WithFields(logrus.Fields{
-						"line":  line,
-						"error": err,
-					}).Debug("skipping line; failed to parse.")
 					continue
 				}
-				if len(parsedLine) == 0 {
-					// skip empty lines, as determined by the parser
-					logrus.WithFields(logrus.Fields{
-						"line":  line,
-						"error": err,
-					}).Debug("skipping line; no key/val pairs found.")
+
+				if pending != nil && line == pendingLine {
+					pending.Data["repeat_count"] = pending.Data["repeat_count"].(int) + 1
 					continue
 				}
-				if allEmpty(parsedLine) {
-					// skip events for which all fields are the empty string, because that's
-					// probably broken
-					logrus.WithFields(logrus.Fields{
-						"line":  line,
-						"error": err,
-					}).Debug("skipping line; all values are the empty string.")
+
+				e, err := p.buildEvent(rawLine, line, prefixFields, filtered)
+				if err != nil {
 					continue
 				}
-				// merge the prefix fields and the parsed line contents
-				for k, v := range prefixFields {
-					parsedLine[k] = v
+				// parse error events have no repeat_count and aren't deduped
+				if _, ok := e.Data["repeat_count"]; ok && p.conf.DedupeConsecutive {
+					if pending != nil && !emit(pending) {
+						return
+					}
+					pending, pendingLine = e, line
+					continue
 				}
-
-				// look for the timestamp in any of the prefix fields or regular content
-				timestamp := httime.GetTimestamp(parsedLine, p.conf.TimeFieldName, p.conf.TimeFieldFormat)
-
 				// send an event to Transmission
-				e := event.Event{
-					Timestamp: timestamp,
-					Data:      parsedLine,
+				if !emit(e) {
+					return
 				}
-				send <- e
 			}
-			wg.Done()
+			if pending != nil {
+				emit(pending)
+			}
 		}()
 	}
 	wg.Wait()
+	if p.parseErrors != nil {
+		p.parseErrors.Flush()
+	}
 	logrus.Debug("lines channel is closed, ending keyval processor")
 }
 
-// allEmpty returns true if all values in the map are the empty string
-// TODO move this into the main honeytail loop instead of the keyval parser
-func allEmpty(pl map[string]interface{}) bool {
-	for _, v := range pl {
-		vStr, ok := v.(string)
-		if !ok {
-			// wouldn't coerce to string, so it must have something that's not an
-			// empty string
-			return false
+// SkipError is returned by ProcessLine for lines that are deliberately
+// dropped, as opposed to those that fail to parse
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return "skipping line; " + e.Reason
+}
+
+// ProcessLine turns a single line into an event without the goroutines and
+// channels of ProcessLines, for embedding honeytail or testing a config. Lines
+// that are deliberately dropped, eg by filter_regex, return a *SkipError;
+// lines that fail to parse return the parse error unless keep_parse_errors is
+// set. Consecutive lines are never seen, so dedupe_consecutive events always
+// have a repeat_count of 1.
+func (p *Parser) ProcessLine(line string, prefixRegex *parsers.ExtRegexp) (*event.Event, error) {
+	stripped, prefixFields, filtered, err := p.prepareLine(line, prefixRegex)
+	if err != nil {
+		return nil, err
+	}
+	return p.buildEvent(line, stripped, prefixFields, filtered)
+}
+
+// prepareLine filters rawLine and strips its prefix, returning the rest of
+// the line and the prefix's fields. With filter_as_tag, lines the filter rules
+// out are returned with filtered set instead of being skipped.
+func (p *Parser) prepareLine(rawLine string, prefixRegex *parsers.ExtRegexp) (string, map[string]string, bool, error) {
+	logrus.WithFields(logrus.Fields{
+		"line": rawLine,
+	}).Debug("Attempting to process keyval log line")
+	// lines from windows hosts end in \r\n; don't let the \r pollute the
+	// last value
+	line := strings.TrimRight(rawLine, "\r\n")
+
+	// if matching regex is set, filter lines here, and take care of any
+	// headers on the line
+	var stripped string
+	var prefixFields map[string]string
+	var filtered bool
+	if err := p.withinTimeout(rawLine, func() {
+		stripped, prefixFields, filtered = p.stripAndFilter(line, prefixRegex)
+	}); err != nil {
+		return "", nil, false, err
+	}
+	if filtered && p.conf.FilterAsTag == "" {
+		return "", nil, false, &SkipError{Reason: "filtered out by filter_regex"}
+	}
+	return stripped, prefixFields, filtered, nil
+}
+
+// buildEvent parses line, the remains of rawLine after prepareLine, and turns
+// it and the prefix fields into an event
+func (p *Parser) buildEvent(rawLine, line string, prefixFields map[string]string, filtered bool) (*event.Event, error) {
+	var firstToken string
+	if p.conf.FirstTokenField != "" {
+		firstToken, line = splitFirstToken(line)
+	}
+	var parsedLine map[string]interface{}
+	var err error
+	parseStart := time.Now()
+	if timeoutErr := p.withinTimeout(rawLine, func() {
+		parsedLine, err = p.lineParser.ParseLine(line)
+	}); timeoutErr != nil {
+		return nil, timeoutErr
+	}
+	parseDuration := time.Since(parseStart)
+	if err != nil {
+		if p.conf.KeepParseErrors {
+			e := parseErrorEvent(rawLine, err)
+			return &e, nil
 		}
-		if vStr != "" {
-			return false
+		// skip lines that won't parse
+		if p.parseErrors != nil {
+			p.parseErrors.ParseError(line, err)
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"line":  line,
+			"error": err,
+		}).Debug("skipping line; failed to parse.")
+		return nil, err
+	}
+	if p.conf.EmitUnparsedAsMessage && parsers.AllEmpty(parsedLine) &&
+		strings.TrimSpace(line) != "" {
+		// free text that didn't contain any pairs; keep it as a message
+		parsedLine = map[string]interface{}{
+			p.messageField(): line,
+		}
+	}
+	if firstToken != "" {
+		parsedLine[p.conf.FirstTokenField] = firstToken
+	}
+	if len(parsedLine) == 0 {
+		// skip empty lines, as determined by the parser
+		logrus.WithFields(logrus.Fields{
+			"line": line,
+		}).Debug("skipping line; no key/val pairs found.")
+		return nil, &SkipError{Reason: "no key/val pairs found"}
+	}
+	if p.conf.MaxFieldsPerKB > 0 {
+		kb := float64(len(line)) / 1024
+		if kb < 1 {
+			kb = 1
+		}
+		if float64(len(parsedLine))/kb > float64(p.conf.MaxFieldsPerKB) {
+			logrus.WithFields(logrus.Fields{
+				"line":   line,
+				"fields": len(parsedLine),
+				"bytes":  len(line),
+			}).Warn("rejecting line; too many fields for its length.")
+			return nil, &SkipError{Reason: "too many fields for its length"}
+		}
+	}
+	// before the all empty check, which presence flags would otherwise fail
+	for _, field := range p.conf.PresenceBoolFields {
+		if _, ok := parsedLine[field]; ok {
+			parsedLine[field] = true
+		} else if p.conf.PresenceBoolAbsentFalse {
+			parsedLine[field] = false
+		}
+	}
+	if parsers.AllEmpty(parsedLine) {
+		// events for which all fields are the empty string are probably
+		// broken; skip them unless asked to do otherwise
+		switch p.conf.AllEmptyAction {
+		case "emit":
+		case "reject":
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Warn("rejecting line; all values are the empty string.")
+			return nil, &SkipError{Reason: "all values are the empty string"}
+		default:
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping line; all values are the empty string.")
+			return nil, &SkipError{Reason: "all values are the empty string"}
+		}
+	}
+	// merge the prefix fields and the parsed line contents
+	for k, v := range prefixFields {
+		parsedLine[p.conf.PrefixFieldNamespace+k] = v
+	}
+	if p.conf.FilterAsTag != "" {
+		parsedLine[p.conf.FilterAsTag] = !filtered
+	}
+
+	for field, cutset := range p.conf.TrimFields {
+		if val, ok := parsedLine[field].(string); ok {
+			parsedLine[field] = strings.Trim(val, cutset)
+		}
+	}
+	for field, length := range p.conf.TruncateFields {
+		truncateField(parsedLine, field, length)
+	}
+	for _, field := range p.conf.CollapseWhitespaceFields {
+		if val, ok := parsedLine[field].(string); ok {
+			parsedLine[field] = strings.Join(strings.Fields(val), " ")
+		}
+	}
+	for _, field := range p.conf.LowercaseValueFields {
+		if val, ok := parsedLine[field].(string); ok {
+			parsedLine[field] = strings.ToLower(val)
+		}
+	}
+	for _, field := range p.conf.UppercaseValueFields {
+		if val, ok := parsedLine[field].(string); ok {
+			parsedLine[field] = strings.ToUpper(val)
+		}
+	}
+	for _, field := range p.conf.Base64DecodeFields {
+		decodeBase64Field(parsedLine, field)
+	}
+	for _, field := range p.conf.URLDecodeFields {
+		decodeURLField(parsedLine, field)
+	}
+	for _, field := range p.conf.SplitListFields {
+		p.splitListField(parsedLine, field)
+	}
+	for _, field := range p.conf.JSONArrayFields {
+		parseJSONArray(parsedLine, field, p.conf.JSONArrayMode)
+	}
+	for _, field := range p.conf.JSONFields {
+		parseJSONObject(parsedLine, field)
+	}
+	p.subParsers.Parse(parsedLine)
+	for _, field := range p.conf.SplitHostPortFields {
+		splitHostPort(parsedLine, field, p.conf.SplitHostPortDropOriginal)
+	}
+	for _, cf := range p.csvFields {
+		cf.split(parsedLine, p.values)
+	}
+	for _, field := range p.conf.CookieFields {
+		splitCookies(parsedLine, field, p.values)
+	}
+	for _, field := range p.conf.IPFields {
+		enrichIP(parsedLine, field)
+	}
+	for _, field := range p.conf.SemverFields {
+		splitSemver(parsedLine, field)
+	}
+	for _, field := range p.conf.DateOnlyFields {
+		parseDateOnly(parsedLine, field, p.dateOnlyLoc)
+	}
+	for _, field := range p.conf.UUIDFields {
+		checkUUID(parsedLine, field, p.conf.UUIDInvalidAction == "drop")
+	}
+	for _, enrichment := range p.enrichments {
+		enrichment.enrich(parsedLine)
+	}
+	for _, valueMap := range p.valueMaps {
+		valueMap.apply(parsedLine)
+	}
+	for _, levelField := range p.levelFields {
+		levelField.normalize(parsedLine)
+	}
+	for _, statusClass := range p.statusClass {
+		statusClass.classify(parsedLine)
+	}
+	for _, sf := range p.subtracts {
+		sf.subtract(parsedLine)
+	}
+	for _, cf := range p.computes {
+		cf.compute(parsedLine)
+	}
+	for _, bf := range p.buckets {
+		bf.bucket(parsedLine)
+	}
+	for _, field := range p.conf.UserAgentFields {
+		splitUserAgent(parsedLine, field)
+	}
+	for _, field := range p.conf.TemplatizePathFields {
+		templatizePath(parsedLine, field, p.conf.TemplatizePathHex)
+	}
+	for field, target := range p.conf.StackDepthFields {
+		countStackFrames(parsedLine, field, target, p.frameDelim)
+	}
+	if p.conf.ExtractPairsFromField != "" {
+		extractPairs(parsedLine, p.conf.ExtractPairsFromField, p.conf.ExtractedPairsPrefix, p.values)
+	}
+	for field, layout := range p.conf.TimeFields {
+		parseTimeField(parsedLine, field, layout)
+	}
+	if p.conf.AddSourceFileField != "" {
+		parsedLine[p.conf.AddSourceFileField] = p.conf.SourceFile
+	}
+	for _, hashField := range p.hashFields {
+		hashField.hash(parsedLine)
+	}
+	for _, hb := range p.hashBuckets {
+		hb.bucket(parsedLine, p.conf.BucketHashDropOriginal)
+	}
+	for _, bc := range p.blockWhen {
+		if bc.matches(parsedLine) {
+			logrus.WithFields(logrus.Fields{
+				"line":       line,
+				"block_when": bc.field + "=" + bc.value,
+			}).Debug("skipping line; matched block_when.")
+			return nil, &SkipError{Reason: "matched block_when"}
+		}
+	}
+
+	// look for the timestamp in any of the prefix fields or regular content
+	timeField := p.conf.TimeFieldName
+	if _, inPrefix := prefixFields[timeField]; inPrefix && p.conf.PrefixFieldNamespace != "" {
+		if _, inBody := parsedLine[timeField]; !inBody {
+			timeField = p.conf.PrefixFieldNamespace + timeField
+		}
+	}
+	var timestamp time.Time
+	var timeErr error
+	switch {
+	case p.conf.StrictTimeFormat:
+		timestamp, timeErr = p.strictTimestamp(parsedLine, timeField)
+	case p.conf.DropOnTimeParseFailure && (timeField != "" || len(p.conf.TimeFieldCandidates) > 0):
+		fields := p.conf.TimeFieldCandidates
+		if timeField != "" {
+			fields = []string{timeField}
+		}
+		var ok bool
+		if timestamp, ok = httime.ParseTimeField(parsedLine, p.conf.TimeFieldFormat, fields...); !ok {
+			timeErr = fmt.Errorf("time field missing or doesn't match format")
+		}
+	case len(p.conf.TimeFieldCandidates) > 0:
+		timestamp = httime.GetTimestampFromCandidates(parsedLine, p.conf.TimeFieldCandidates, p.conf.TimeFieldFormat)
+	default:
+		timestamp = httime.GetTimestamp(parsedLine, timeField, p.conf.TimeFieldFormat)
+	}
+	if timeErr != nil {
+		fields := logrus.Fields{
+			"line":       line,
+			"time_field": timeField,
+			"time_value": parsedLine[timeField],
+			"error":      timeErr,
+		}
+		if p.conf.DropOnTimeParseFailure {
+			logrus.WithFields(fields).Debug("skipping line; failed to parse time field.")
+			return nil, &SkipError{Reason: "failed to parse time field"}
+		}
+		logrus.WithFields(fields).Warn("failed to parse time field strictly; using the current time")
+		timestamp = httime.Now()
+	}
+
+	if (!p.minTime.IsZero() && timestamp.Before(p.minTime)) ||
+		(!p.maxTime.IsZero() && timestamp.After(p.maxTime)) {
+		logrus.WithFields(logrus.Fields{
+			"line":      line,
+			"timestamp": timestamp,
+		}).Debug("skipping line; timestamp outside min_time and max_time.")
+		return nil, &SkipError{Reason: "timestamp outside min_time and max_time"}
+	}
+	if p.window != nil && !p.window.contains(timestamp) {
+		logrus.WithFields(logrus.Fields{
+			"line":      line,
+			"timestamp": timestamp,
+		}).Debug("skipping line; timestamp outside time_of_day_window.")
+		return nil, &SkipError{Reason: "timestamp outside time_of_day_window"}
+	}
+
+	for _, truncTime := range p.truncTimes {
+		parsedLine[truncTime.field] = truncTime.truncate(timestamp)
+	}
+
+	if p.conf.DedupeConsecutive {
+		parsedLine["repeat_count"] = 1
+	}
+	if p.conf.AddParseDurationField != "" {
+		parsedLine[p.conf.AddParseDurationField] = parseDuration.Nanoseconds() / int64(time.Microsecond)
+	}
+	if p.conf.AddEventIDField != "" {
+		parsedLine[p.conf.AddEventIDField] = p.newEventID()
+	}
+	// count fields last so it reflects the final shape of the event
+	if p.conf.AddFieldCountField != "" {
+		parsedLine[p.conf.AddFieldCountField] = len(parsedLine)
+	}
+
+	var dataset string
+	if val, ok := parsedLine[p.conf.DatasetField]; ok && p.conf.DatasetField != "" {
+		dataset = fmt.Sprint(val)
+	}
+
+	return &event.Event{
+		Timestamp: timestamp,
+		Dataset:   dataset,
+		Data:      parsedLine,
+	}, nil
+}
+
+// splitListField splits the value of field according to the split_list
+// options
+func (p *Parser) splitListField(data map[string]interface{}, field string) {
+	sep := p.conf.SplitListSeparator
+	if sep == "" {
+		sep = ","
+	}
+	splitList(data, field, sep, p.conf.SplitListMode == "indexed", p.conf.SplitListDropEmpty)
+}
+
+// stripAndFilter removes the prefix from line, returning the rest of the line
+// and the prefix's fields. filtered is true if filter_regex rules the line out.
+func (p *Parser) stripAndFilter(line string, prefixRegex *parsers.ExtRegexp) (rest string, prefixFields map[string]string, filtered bool) {
+	if !p.conf.FilterAfterPrefix {
+		filtered = p.filteredOut(line)
+		// tagged lines still need their prefix stripped
+		if filtered && p.conf.FilterAsTag == "" {
+			return line, nil, true
+		}
+	}
+	if prefixRegex != nil {
+		var prefix string
+		prefix, prefixFields = prefixRegex.FindStringSubmatchMap(line)
+		line = strings.TrimPrefix(line, prefix)
+	}
+	if p.conf.FilterAfterPrefix {
+		filtered = p.filteredOut(line)
+	}
+	return line, prefixFields, filtered
+}
+
+// parseTimeoutContext sets the deadline for parse_timeout_ms. It's a var so
+// tests can decide when a line has taken too long.
+var parseTimeoutContext = context.WithTimeout
+
+// withinTimeout runs f, giving up on it if it's still running after
+// parse_timeout_ms. It returns an error if f was abandoned, in which case f
+// keeps running in the background and must not touch anything the caller
+// still uses.
+func (p *Parser) withinTimeout(line string, f func()) error {
+	if p.conf.ParseTimeoutMs == 0 {
+		f()
+		return nil
+	}
+	ctx, cancel := parseTimeoutContext(context.Background(),
+		time.Duration(p.conf.ParseTimeoutMs)*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		logrus.WithFields(logrus.Fields{
+			"line":             line,
+			"parse_timeout_ms": p.conf.ParseTimeoutMs,
+		}).Warn("abandoning line; parsing took too long.")
+		return fmt.Errorf("abandoned line after parse_timeout_ms (%dms)", p.conf.ParseTimeoutMs)
+	}
+}
+
+// strictTimestamp parses timeField using exactly the configured format,
+// removing it from the event. Failures leave the field in place.
+func (p *Parser) strictTimestamp(data map[string]interface{}, timeField string) (time.Time, error) {
+	val, ok := data[timeField]
+	if !ok {
+		return time.Time{}, fmt.Errorf("couldn't find time field")
+	}
+	valStr, ok := val.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("time field is not a string")
+	}
+	ts, err := httime.ParseStrict(p.conf.TimeFieldFormat, valStr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	delete(data, timeField)
+	return ts, nil
+}
+
+// messageField returns the field in which to put unparsed lines
+func (p *Parser) messageField() string {
+	if p.conf.MessageField == "" {
+		return "message"
+	}
+	return p.conf.MessageField
+}
+
+// parseErrorEvent builds a minimal event marking a line that failed to parse
+func parseErrorEvent(line string, err error) event.Event {
+	return event.Event{
+		Timestamp: httime.Now(),
+		Data: map[string]interface{}{
+			"_parse_error":         true,
+			"_raw_line":            line,
+			"_parse_error_message": err.Error(),
+		},
+	}
+}
+
+// filteredOut returns true if the filter regex is set and says the line
+// should be skipped
+func (p *Parser) filteredOut(line string) bool {
+	if p.filterRegex == nil {
+		return false
+	}
+	matched := p.filterRegex.MatchString(line)
+	// if both are true or both are false, skip. else continue
+	if matched == p.conf.InvertFilter {
+		if p.conf.FilterAsTag == "" {
+			logrus.WithFields(logrus.Fields{
+				"line":    line,
+				"matched": matched,
+			}).Debug("skipping line due to FilterMatch.")
 		}
+		return true
 	}
-	// we've gone through the entire map and every field value has matched ""
-	return true
+	return false
 }
@@ -1,11 +1,26 @@
 package keyval
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
 
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/httime/httimetest"
+	"github.com/honeycombio/honeytail/parsers"
+	// registers the json line parser for sub_parse
+	_ "github.com/honeycombio/honeytail/parsers/htjson"
 )
 
 type testLineMap struct {
@@ -55,6 +70,256 @@ func TestParseLine(t *testing.T) {
 	}
 }
 
+func TestParseLineEmbeddedEquals(t *testing.T) {
+	jlp := KeyValLineParser{}
+	tsts := []testLineMap{
+		{ // url with a query string
+			input: `url=https://host/path?a=b&c=d status=200`,
+			expected: map[string]interface{}{
+				"url":    "https://host/path?a=b&c=d",
+				"status": 200,
+			},
+		},
+		{ // base64 padding
+			input: `token=YWxpY2U= tok2=YQ== next=val`,
+			expected: map[string]interface{}{
+				"token": "YWxpY2U=",
+				"tok2":  "YQ==",
+				"next":  "val",
+			},
+		},
+		{ // quoted values are left alone
+			input: `q="a=b c=d" url=/p?x=y`,
+			expected: map[string]interface{}{
+				"q":   "a=b c=d",
+				"url": "/p?x=y",
+			},
+		},
+	}
+	for _, tlm := range tsts {
+		resp, err := jlp.ParseLine(tlm.input)
+		if err != nil {
+			t.Error("jlp.ParseLine unexpectedly returned error ", err)
+		}
+		if !reflect.DeepEqual(resp, tlm.expected) {
+			t.Errorf("response %+v didn't match expected %+v", resp, tlm.expected)
+		}
+	}
+	// and with a custom pair separator
+	jlp = KeyValLineParser{PairSeparator: ";"}
+	resp, err := jlp.ParseLine(`url=https://host/?a=b;token=YWxpY2U=`)
+	if err != nil {
+		t.Error("jlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected := map[string]interface{}{
+		"url":   "https://host/?a=b",
+		"token": "YWxpY2U=",
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+}
+
+func TestParseLineDecimalComma(t *testing.T) {
+	line := `amount=1.234,56 small=0,5 count=1.234 ver=1.2.3 plain=2.5 n=7`
+	jlp := KeyValLineParser{DecimalComma: true}
+	resp, err := jlp.ParseLine(line)
+	if err != nil {
+		t.Error("jlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected := map[string]interface{}{
+		"amount": 1234.56,
+		"small":  0.5,
+		"count":  1234,
+		"ver":    "1.2.3",
+		"plain":  2.5,
+		"n":      7,
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+
+	// quoted values may contain space thousands separators, and fields can
+	// be singled out
+	jlp = KeyValLineParser{DecimalComma: true, DecimalCommaFields: []string{"amount"}}
+	resp, err = jlp.ParseLine(`amount="1 234,5" count=1.234`)
+	if err != nil {
+		t.Error("jlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected = map[string]interface{}{
+		"amount": 1234.5,
+		"count":  1.234,
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+
+	// and by default nothing changes
+	jlp = KeyValLineParser{}
+	resp, err = jlp.ParseLine(`amount=1.234,56 count=1.234`)
+	if err != nil {
+		t.Error("jlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected = map[string]interface{}{
+		"amount": "1.234,56",
+		"count":  1.234,
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+}
+
+func TestSplitValuesCoercedLikeLineValues(t *testing.T) {
+	opts := &Options{
+		CoerceNumericRegex:    `-?\d+|-?\d+,\d+`,
+		DecimalComma:          true,
+		CSVFields:             []string{"coords=lat,lon"},
+		CookieFields:          []string{"cookie"},
+		ExtractPairsFromField: "msg",
+	}
+	evs := processLines(t, opts, []string{`coords="12,3e5" cookie="a=7; b=1,5" msg="took n=3,25 v=0x1f"`}, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected one event, got %d", len(evs))
+	}
+	for field, expected := range map[string]interface{}{
+		"lat": 12, "lon": "3e5",
+		"cookie_a": 7, "cookie_b": 1.5,
+		"n": 3.25, "v": "0x1f",
+	} {
+		if evs[0].Data[field] != expected {
+			t.Errorf("%s: expected %#v, got %#v", field, expected, evs[0].Data[field])
+		}
+	}
+}
+
+func TestParseLineCoerceNumericRegex(t *testing.T) {
+	line := `year=2023 neg=-5 ratio=0.25 ver=v2 list=1,2 exp=1e5 nan=NaN ok=true`
+	p := &Parser{}
+	if err := p.Init(&Options{CoerceNumericRegex: `-?\d+|-?\d+\.\d+`}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.lineParser.ParseLine(line)
+	if err != nil {
+		t.Error("jlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected := map[string]interface{}{
+		"year":  2023,
+		"neg":   -5,
+		"ratio": 0.25,
+		"ver":   "v2",
+		"list":  "1,2",
+		"exp":   "1e5",
+		"nan":   "NaN",
+		"ok":    true,
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+
+	// by default anything numeric looking is coerced
+	jlp := KeyValLineParser{}
+	resp, err = jlp.ParseLine(`year=2023 exp=1e5`)
+	if err != nil {
+		t.Error("jlp.ParseLine unexpectedly returned error ", err)
+	}
+	expected = map[string]interface{}{
+		"year": 2023,
+		"exp":  float64(100000),
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("response %+v didn't match expected %+v", resp, expected)
+	}
+}
+
+func TestParseLineGreedy(t *testing.T) {
+	jlp := KeyValLineParser{LastFieldGreedy: "msg"}
+	tsts := []testLineMap{
+		{ // greedy trailing msg
+			input: `level=info count=3 msg=this is a long message`,
+			expected: map[string]interface{}{
+				"level": "info",
+				"count": 3,
+				"msg":   "this is a long message",
+			},
+		},
+		{ // quoted msg is left to logfmt
+			input: `level=info msg="quoted message" count=3`,
+			expected: map[string]interface{}{
+				"level": "info",
+				"msg":   "quoted message",
+				"count": 3,
+			},
+		},
+		{ // key only matches at the start of a token
+			input: `level=warn errmsg=oops`,
+			expected: map[string]interface{}{
+				"level":  "warn",
+				"errmsg": "oops",
+			},
+		},
+		{ // greedy key absent
+			input: `level=info count=3`,
+			expected: map[string]interface{}{
+				"level": "info",
+				"count": 3,
+			},
+		},
+	}
+	for _, tlm := range tsts {
+		resp, err := jlp.ParseLine(tlm.input)
+		if err != nil {
+			t.Error("jlp.ParseLine unexpectedly returned error ", err)
+		}
+		if !reflect.DeepEqual(resp, tlm.expected) {
+			t.Errorf("response %+v didn't match expected %+v", resp, tlm.expected)
+		}
+	}
+}
+
+func TestParseLinePairSeparator(t *testing.T) {
+	jlp := KeyValLineParser{PairSeparator: ";"}
+	tsts := []testLineMap{
+		{
+			input: `EventID=4624;Account=alice;Message="logon; success"`,
+			expected: map[string]interface{}{
+				"EventID": 4624,
+				"Account": "alice",
+				"Message": "logon; success",
+			},
+		},
+		{ // whitespace still separates pairs
+			input: `a=x; b=y`,
+			expected: map[string]interface{}{
+				"a": "x",
+				"b": "y",
+			},
+		},
+	}
+	for _, tlm := range tsts {
+		resp, err := jlp.ParseLine(tlm.input)
+		if err != nil {
+			t.Error("jlp.ParseLine unexpectedly returned error ", err)
+		}
+		if !reflect.DeepEqual(resp, tlm.expected) {
+			t.Errorf("response %+v didn't match expected %+v", resp, tlm.expected)
+		}
+	}
+}
+
+func TestWindowsLines(t *testing.T) {
+	lines := []string{"EventID=4624;Account=alice\r\n", "EventID=4625;Account=bob\r"}
+	evs := processLines(t, &Options{PairSeparator: ";"}, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	for _, ev := range evs {
+		account := ev.Data["Account"].(string)
+		if account != "alice" && account != "bob" {
+			t.Errorf("expected the last field to be free of \\r, got %q", account)
+		}
+	}
+}
+
 func TestBrokenFilterRegex(t *testing.T) {
 	// test filter that doesn't compile
 	broken := &Parser{}
@@ -149,6 +414,1193 @@ func TestFilterRegex(t *testing.T) {
 	}
 }
 
+func TestFilterAfterPrefix(t *testing.T) {
+	prefixRegex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^\w+ `)}
+	lines := []string{
+		"aoeu key=val",
+		"host key=aoeu",
+		"host key=val",
+	}
+	// by default the filter sees the prefix
+	evs := processLines(t, &Options{FilterRegex: "aoeu"}, lines, prefixRegex)
+	if len(evs) != 2 {
+		t.Errorf("expected 2 events with the filter applied to the full line, got %d", len(evs))
+	}
+	// after the prefix is stripped only the body can match
+	evs = processLines(t, &Options{FilterRegex: "aoeu", FilterAfterPrefix: true}, lines, prefixRegex)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event with the filter applied after the prefix, got %d", len(evs))
+	}
+	if evs[0].Data["key"] != "aoeu" {
+		t.Errorf("expected the event with key=aoeu, got %+v", evs[0].Data)
+	}
+}
+
+func TestAddSourceFileField(t *testing.T) {
+	// each file gets its own parser, so simulate two sources
+	for _, source := range []string{"/var/log/first.log", "/var/log/second.log"} {
+		opts := &Options{
+			AddSourceFileField: "source_file",
+			SourceFile:         source,
+		}
+		evs := processLines(t, opts, []string{"key=val", "key=val2"}, nil)
+		if len(evs) != 2 {
+			t.Fatalf("expected 2 events, got %d", len(evs))
+		}
+		for _, ev := range evs {
+			if ev.Data["source_file"] != source {
+				t.Errorf("expected source_file %s, got %v", source, ev.Data["source_file"])
+			}
+		}
+	}
+	// without the option no field is added
+	evs := processLines(t, &Options{SourceFile: "/var/log/first.log"}, []string{"key=val"}, nil)
+	if _, ok := evs[0].Data["source_file"]; ok {
+		t.Errorf("expected no source_file field, got %+v", evs[0].Data)
+	}
+}
+
+func TestKeepParseErrors(t *testing.T) {
+	lines := []string{`key="unterminated`, "key=val"}
+	evs := processLines(t, &Options{}, lines, nil)
+	if len(evs) != 1 {
+		t.Errorf("expected the malformed line to be dropped, got %d events", len(evs))
+	}
+	evs = processLines(t, &Options{KeepParseErrors: true}, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events with keep_parse_errors, got %d", len(evs))
+	}
+	var errEv *event.Event
+	for i := range evs {
+		if _, ok := evs[i].Data["_parse_error"]; ok {
+			errEv = &evs[i]
+		}
+	}
+	if errEv == nil {
+		t.Fatal("expected an error-marked event")
+	}
+	expected := map[string]interface{}{
+		"_parse_error":         true,
+		"_raw_line":            `key="unterminated`,
+		"_parse_error_message": "logfmt: unterminated string",
+	}
+	if !reflect.DeepEqual(errEv.Data, expected) {
+		t.Errorf("got %+v, expected %+v", errEv.Data, expected)
+	}
+}
+
+func TestEmitUnparsedAsMessage(t *testing.T) {
+	tsts := []struct {
+		line     string
+		expected []map[string]interface{}
+	}{
+		{ // free text
+			"the server is on fire",
+			[]map[string]interface{}{{"message": "the server is on fire"}},
+		},
+		{ // blank
+			"   ",
+			nil,
+		},
+		{ // valid keyval
+			"key=val",
+			[]map[string]interface{}{{"key": "val"}},
+		},
+	}
+	for _, tst := range tsts {
+		evs := processLines(t, &Options{EmitUnparsedAsMessage: true}, []string{tst.line}, nil)
+		var data []map[string]interface{}
+		for _, ev := range evs {
+			data = append(data, ev.Data)
+		}
+		if !reflect.DeepEqual(data, tst.expected) {
+			t.Errorf("line %q: got %+v, expected %+v", tst.line, data, tst.expected)
+		}
+	}
+	// the message field is configurable
+	evs := processLines(t, &Options{EmitUnparsedAsMessage: true, MessageField: "msg"}, []string{"free text"}, nil)
+	if len(evs) != 1 || evs[0].Data["msg"] != "free text" {
+		t.Errorf("expected free text in the msg field, got %+v", evs)
+	}
+}
+
+func TestDedupeConsecutive(t *testing.T) {
+	prefixRegex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^\d+ `)}
+	lines := []string{
+		"1 key=val",
+		"2 key=val",
+		"3 key=val",
+		"4 key=other",
+		"5 key=val",
+	}
+	evs := processLines(t, &Options{DedupeConsecutive: true, NumParsers: 1}, lines, prefixRegex)
+	expected := []map[string]interface{}{
+		{"key": "val", "repeat_count": 3},
+		{"key": "other", "repeat_count": 1},
+		{"key": "val", "repeat_count": 1},
+	}
+	if len(evs) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(evs))
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("event %d: got %+v, expected %+v", i, ev.Data, expected[i])
+		}
+	}
+}
+
+func TestAddFieldCountField(t *testing.T) {
+	opts := &Options{
+		AddFieldCountField: "_field_count",
+		AddSourceFileField: "source_file",
+		TimeFieldName:      "time",
+	}
+	lines := []string{`time="2014-03-10 19:57:38.123456789 -0800 PST" a=5 b=2 c=three`}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	// the time field is removed and the source file field is added
+	expected := map[string]interface{}{
+		"a":            5,
+		"b":            2,
+		"c":            "three",
+		"source_file":  "",
+		"_field_count": 4,
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("got %+v, expected %+v", evs[0].Data, expected)
+	}
+}
+
+func TestAddTruncatedTimeFields(t *testing.T) {
+	opts := &Options{
+		TimeFieldName:          "time",
+		AddTruncatedTimeFields: []string{"ts_minute=minute", "ts_day=day"},
+	}
+	evs := processLines(t, opts, []string{`time="2014-03-10T19:57:38.123Z" key=val`}, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expectedMinute := time.Date(2014, 3, 10, 19, 57, 0, 0, time.UTC)
+	if ts, ok := evs[0].Data["ts_minute"].(time.Time); !ok || !ts.Equal(expectedMinute) {
+		t.Errorf("expected ts_minute %v, got %v", expectedMinute, evs[0].Data["ts_minute"])
+	}
+	expectedDay := time.Date(2014, 3, 10, 0, 0, 0, 0, time.UTC)
+	if ts, ok := evs[0].Data["ts_day"].(time.Time); !ok || !ts.Equal(expectedDay) {
+		t.Errorf("expected ts_day %v, got %v", expectedDay, evs[0].Data["ts_day"])
+	}
+	p := &Parser{}
+	if err := p.Init(&Options{AddTruncatedTimeFields: []string{"ts=fortnight"}}); err == nil {
+		t.Error("expected error from an unknown truncation unit, got nil")
+	}
+}
+
+func TestBase64DecodeFields(t *testing.T) {
+	opts := &Options{
+		Base64DecodeFields: []string{"user"},
+	}
+	evs := processLines(t, opts, []string{`user=YWxpY2U= token=YWxpY2U=`}, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"user":  "alice",
+		"token": "YWxpY2U=",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestSplitListFields(t *testing.T) {
+	opts := &Options{
+		SplitListFields:    []string{"tags"},
+		SplitListMode:      "indexed",
+		SplitListSeparator: "|",
+	}
+	evs := processLines(t, opts, []string{`tags=a|b other=c,d`}, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"tags_0": "a",
+		"tags_1": "b",
+		"other":  "c,d",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+	p := &Parser{}
+	if err := p.Init(&Options{SplitListMode: "hash"}); err == nil {
+		t.Error("expected error from an unknown split_list_mode, got nil")
+	}
+}
+
+// stuckLineParser never finishes parsing the line stuck. It runs expire,
+// the deadline of the parse it's in, before waiting for release.
+type stuckLineParser struct {
+	parsers.LineParser
+	stuck   string
+	expire  func()
+	release chan struct{}
+}
+
+func (s stuckLineParser) ParseLine(line string) (map[string]interface{}, error) {
+	if line == s.stuck {
+		s.expire()
+		<-s.release
+	}
+	return s.LineParser.ParseLine(line)
+}
+
+func TestParseTimeout(t *testing.T) {
+	// lines are parsed one at a time, so the latest deadline is the one
+	// for the line being parsed
+	var mu sync.Mutex
+	var latest context.CancelFunc
+	defer func(f func(context.Context, time.Duration) (context.Context, context.CancelFunc)) {
+		parseTimeoutContext = f
+	}(parseTimeoutContext)
+	parseTimeoutContext = func(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(parent)
+		mu.Lock()
+		latest = cancel
+		mu.Unlock()
+		return ctx, cancel
+	}
+	// don't fill the test output with the abandoned line
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	p := &Parser{}
+	if err := p.Init(&Options{ParseTimeoutMs: 20, NumParsers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	p.lineParser = stuckLineParser{
+		LineParser: p.lineParser,
+		stuck:      "key=stuck",
+		expire: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			latest()
+		},
+		release: release,
+	}
+	evs := runParser(p, []string{"key=stuck", "key=val"}, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{"key": "val"}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestInitErrorsNameTheOption(t *testing.T) {
+	tsts := []struct {
+		opts   *Options
+		option string
+	}{
+		{&Options{FilterRegex: "a(b"}, "filter_regex"},
+		{&Options{TimeFieldFormat: "yyyy-mm-dd"}, "format"},
+		{&Options{AllEmptyAction: "explode"}, "all_empty_action"},
+		{&Options{LineFormat: "yaml"}, "line_format"},
+		{&Options{DateOnlyTimezone: "Mars/Olympus_Mons"}, "date_only_timezone"},
+		{&Options{StackFrameDelimiter: `\q`}, "stack_frame_delimiter"},
+		{&Options{SubParse: map[string]string{"payload": "yaml"}}, "sub_parse"},
+		{&Options{BlockWhen: []string{"healthz"}}, "block_when"},
+		{&Options{TimeOfDayWindow: "9-17"}, "time_of_day_window"},
+		{&Options{TimeOfDayWindow: "09:00-17:00", TimeOfDayTimezone: "Mars/Olympus_Mons"}, "time_of_day_timezone"},
+		{&Options{CoerceNumericRegex: "(\\d+"}, "coerce_numeric_regex"},
+		{&Options{SplitListMode: "hash"}, "split_list_mode"},
+		{&Options{JSONArrayMode: "hash"}, "json_array_mode"},
+		{&Options{UUIDInvalidAction: "explode"}, "uuid_invalid_action"},
+		{&Options{EnrichFromFile: []string{"host"}}, "enrich_from_file"},
+		{&Options{EnrichFromFile: []string{"host=/does/not/exist.tsv"}}, "enrich_from_file"},
+		{&Options{BoolTokensFile: "/does/not/exist.tsv"}, "bool_tokens_file"},
+		{&Options{FilterAsTag: "matched"}, "filter_as_tag"},
+		{&Options{MaxEvents: -1}, "max_events"},
+		{&Options{TimeFieldName: "ts", TimeFieldCandidates: []string{"time"}}, "timefield_candidate"},
+		{&Options{AddTruncatedTimeFields: []string{"ts=fortnight"}}, "add_truncated_time_field"},
+		{&Options{CSVFields: []string{"coords"}}, "csv_field"},
+		{&Options{TruncateFields: map[string]int{"sha": 0}}, "truncate_field"},
+		{&Options{SubtractFields: []string{"duration=end+start"}}, "subtract_field"},
+		{&Options{ComputeFields: []string{"rate=errors/"}}, "compute_field"},
+	}
+	for _, tst := range tsts {
+		p := &Parser{}
+		err := p.Init(tst.opts)
+		if err == nil {
+			t.Errorf("%+v: expected an error, got nil", tst.opts)
+			continue
+		}
+		if !strings.Contains(err.Error(), tst.option) {
+			t.Errorf("expected error %q to name %s", err, tst.option)
+		}
+	}
+}
+
+func TestStrictTimeFormat(t *testing.T) {
+	opts := &Options{
+		TimeFieldName:    "time",
+		StrictTimeFormat: true,
+	}
+	lines := []string{
+		`time=2017-11-23T19:57:38.123456789Z key=val`,
+		// httime's guessing accepts this one
+		`time="2017-11-23 19:57:38.123456789 +0000 UTC" key=val`,
+	}
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := time.Date(2017, 11, 23, 19, 57, 38, 123456789, time.UTC)
+	if !evs[0].Timestamp.Equal(expected) {
+		t.Errorf("expected timestamp %v, got %v", expected, evs[0].Timestamp)
+	}
+	if _, ok := evs[0].Data["time"]; ok {
+		t.Errorf("expected the time field to be removed, got %+v", evs[0].Data)
+	}
+	if evs[1].Timestamp.Equal(expected) {
+		t.Error("expected the near miss not to be parsed")
+	}
+	if evs[1].Data["time"] != "2017-11-23 19:57:38.123456789 +0000 UTC" {
+		t.Errorf("expected the unparsed time field to be kept, got %+v", evs[1].Data)
+	}
+
+	p := &Parser{}
+	if err := p.Init(&Options{StrictTimeFormat: true}); err == nil {
+		t.Error("expected error from strict_time_format without timefield, got nil")
+	}
+}
+
+func TestNumParsers(t *testing.T) {
+	tsts := []struct {
+		numParsers int
+		expected   int
+		expectErr  bool
+	}{
+		{-1, 0, true},
+		{0, 1, false},
+		{4, 4, false},
+	}
+	for _, tst := range tsts {
+		p := &Parser{}
+		err := p.Init(&Options{NumParsers: tst.numParsers})
+		if tst.expectErr {
+			if err == nil {
+				t.Errorf("NumParsers %d: expected an error, got nil", tst.numParsers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NumParsers %d: unexpected error %s", tst.numParsers, err)
+		}
+		if p.conf.NumParsers != tst.expected {
+			t.Errorf("NumParsers %d: expected %d parsers, got %d", tst.numParsers, tst.expected, p.conf.NumParsers)
+		}
+	}
+}
+
+func TestProcessLine(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{FilterRegex: "keep"}); err != nil {
+		t.Fatal(err)
+	}
+	prefixRegex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^(?P<host>\S+) `)}
+
+	// success
+	ev, err := p.ProcessLine(`web1 keep=yes time="2017-11-23T19:57:38Z"`, prefixRegex)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := map[string]interface{}{"keep": "yes", "host": "web1"}
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Errorf("got %+v, expected %+v", ev.Data, expected)
+	}
+	if expectedTime := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC); !ev.Timestamp.Equal(expectedTime) {
+		t.Errorf("got timestamp %v, expected %v", ev.Timestamp, expectedTime)
+	}
+
+	// skip
+	for _, line := range []string{"web1 drop=yes", "web1 keep= "} {
+		ev, err = p.ProcessLine(line, prefixRegex)
+		if _, ok := err.(*SkipError); !ok || ev != nil {
+			t.Errorf("%q: expected a skip, got %+v, %v", line, ev, err)
+		}
+	}
+
+	// error
+	ev, err = p.ProcessLine(`web1 keep="unterminated`, prefixRegex)
+	if _, ok := err.(*SkipError); ok || err == nil || ev != nil {
+		t.Errorf("expected a parse error, got %+v, %v", ev, err)
+	}
+	p.conf.KeepParseErrors = true
+	ev, err = p.ProcessLine(`web1 keep="unterminated`, prefixRegex)
+	if err != nil || ev == nil || ev.Data["_parse_error"] != true {
+		t.Errorf("expected a parse error event, got %+v, %v", ev, err)
+	}
+}
+
+func TestPrefixFieldNamespace(t *testing.T) {
+	prefixRegex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^(?P<time>\S+) (?P<host>\S+) `)}
+	line := `2017-11-23T19:57:38Z web1 host=db1 key=val`
+	expectedTime := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC)
+	expected := map[string]interface{}{
+		"prefix_host": "web1",
+		"host":        "db1",
+		"key":         "val",
+	}
+	for _, timeField := range []string{"time", "prefix_time"} {
+		opts := &Options{
+			PrefixFieldNamespace: "prefix_",
+			TimeFieldName:        timeField,
+			TimeFieldFormat:      time.RFC3339,
+		}
+		evs := processLines(t, opts, []string{line}, prefixRegex)
+		if len(evs) != 1 {
+			t.Fatalf("expected 1 event, got %d", len(evs))
+		}
+		if !reflect.DeepEqual(evs[0].Data, expected) {
+			t.Errorf("timefield %s: got %+v, expected %+v", timeField, evs[0].Data, expected)
+		}
+		if !evs[0].Timestamp.Equal(expectedTime) {
+			t.Errorf("timefield %s: got timestamp %v, expected %v", timeField, evs[0].Timestamp, expectedTime)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	opts := &Options{
+		TimeFieldName: "time",
+		MinTime:       "2017-11-23T00:00:00Z",
+		MaxTime:       "2017-11-24T00:00:00Z",
+	}
+	lines := []string{
+		`time=2017-11-23T19:57:38Z key=in`,
+		`time=2017-11-22T23:59:59Z key=old`,
+		`time=2017-11-24T00:00:01Z key=new`,
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	if evs[0].Data["key"] != "in" {
+		t.Errorf("expected the in-window event, got %+v", evs[0].Data)
+	}
+
+	p := &Parser{}
+	err := p.Init(&Options{MaxTime: "yesterday"})
+	if err == nil || !strings.Contains(err.Error(), "max_time") {
+		t.Errorf("expected an error naming max_time, got %v", err)
+	}
+}
+
+func TestFallbackTimestamps(t *testing.T) {
+	fakeNow := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC)
+	defer func(nower httime.Nower) { httime.DefaultNower = nower }(httime.DefaultNower)
+	httime.DefaultNower = &httimetest.FakeNower{FakeNow: fakeNow}
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+
+	tsts := []struct {
+		opts *Options
+		line string
+	}{
+		{&Options{}, `key=val`},
+		{&Options{TimeFieldName: "time"}, `time=whenever key=val`},
+		{&Options{TimeFieldName: "time", StrictTimeFormat: true}, `time=whenever key=val`},
+		{&Options{KeepParseErrors: true}, `key="unterminated`},
+	}
+	for _, tst := range tsts {
+		evs := processLines(t, tst.opts, []string{tst.line}, nil)
+		if len(evs) != 1 {
+			t.Fatalf("%q: expected 1 event, got %d", tst.line, len(evs))
+		}
+		if !evs[0].Timestamp.Equal(fakeNow) {
+			t.Errorf("%q: expected timestamp %v, got %v", tst.line, fakeNow, evs[0].Timestamp)
+		}
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	var lines []string
+	// start at 2, as 0 and 1 become bools
+	for i := 2; i < 502; i++ {
+		lines = append(lines, fmt.Sprintf("seq=%d", i))
+	}
+	opts := &Options{
+		NumParsers:    8,
+		PreserveOrder: true,
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != len(lines) {
+		t.Fatalf("expected %d events, got %d", len(lines), len(evs))
+	}
+	for i, ev := range evs {
+		if ev.Data["seq"] != i+2 {
+			t.Fatalf("expected event %d to have seq %d, got %+v", i, i+2, ev.Data)
+		}
+	}
+}
+
+func TestAddParseDurationField(t *testing.T) {
+	opts := &Options{
+		AddParseDurationField: "_parse_micros",
+	}
+	evs := processLines(t, opts, []string{`key=val other="a quoted value"`}, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	micros, ok := evs[0].Data["_parse_micros"].(int64)
+	if !ok || micros < 0 {
+		t.Errorf("expected a non-negative _parse_micros, got %+v", evs[0].Data)
+	}
+}
+
+func TestFirstTokenField(t *testing.T) {
+	opts := &Options{
+		FirstTokenField: "level",
+	}
+	lines := []string{
+		`ERROR user=alice msg="it broke"`,
+		`user=bob msg="all good"`,
+		`WARN`,
+	}
+	expected := []map[string]interface{}{
+		{"level": "ERROR", "user": "alice", "msg": "it broke"},
+		{"user": "bob", "msg": "all good"},
+		{"level": "WARN"},
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(evs))
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("event %d: got %+v, expected %+v", i, ev.Data, expected[i])
+		}
+	}
+}
+
+func TestBoolTokensFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "keyval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	tokensFile := filepath.Join(tmpdir, "bools.tsv")
+	contents := "sí\ttrue\nno\tfalse\nja\ttrue\nnein\tfalse\n"
+	if err := ioutil.WriteFile(tokensFile, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{BoolTokensFile: tokensFile}
+	lines := []string{`a=Sí b=no c=JA d=nein e=true f=oui`}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"a": true, "b": false, "c": true, "d": false,
+		"e": true, "f": "oui",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+
+	if err := ioutil.WriteFile(tokensFile, []byte("oui\tperhaps\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Parser{}).Init(opts); err == nil {
+		t.Error("expected an error for a token mapped to something other than a bool")
+	}
+}
+
+func TestFilterAsTag(t *testing.T) {
+	prefixRegex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^(?P<host>\S+) `)}
+	lines := []string{
+		"web1 status=500 path=/a",
+		"web2 status=200 path=/b",
+	}
+	for _, tst := range []struct {
+		opts     *Options
+		expected map[string]bool
+	}{
+		{&Options{FilterRegex: "status=5", FilterAsTag: "is_error"},
+			map[string]bool{"web1": true, "web2": false}},
+		{&Options{FilterRegex: "status=5", FilterAsTag: "is_error", InvertFilter: true},
+			map[string]bool{"web1": false, "web2": true}},
+		// the prefix is stripped before the filter sees the line
+		{&Options{FilterRegex: "^status=5", FilterAsTag: "is_error", FilterAfterPrefix: true},
+			map[string]bool{"web1": true, "web2": false}},
+	} {
+		evs := processLines(t, tst.opts, lines, prefixRegex)
+		if len(evs) != 2 {
+			t.Fatalf("%+v: expected both lines to be kept, got %d events", tst.opts, len(evs))
+		}
+		for _, ev := range evs {
+			host := ev.Data["host"].(string)
+			if ev.Data[tst.opts.FilterAsTag] != tst.expected[host] {
+				t.Errorf("%+v: expected %s to be tagged %v, got %+v", tst.opts, host, tst.expected[host], ev.Data)
+			}
+		}
+	}
+}
+
+func TestMaxEvents(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{MaxEvents: 10, NumParsers: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// lines is never closed; ProcessLines has to return on its own
+	lines := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		lines <- fmt.Sprintf("n=%d", i)
+	}
+	send := make(chan event.Event, 100)
+	done := make(chan struct{})
+	go func() {
+		p.ProcessLines(lines, send, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessLines didn't return after max_events")
+	}
+	if len(send) != 10 {
+		t.Errorf("expected 10 events, got %d", len(send))
+	}
+	// the goroutines stop reading lines soon after the limit, dropping at most
+	// the one each was working on
+	if read := 100 - len(lines); read < 10 || read > 10+4 {
+		t.Errorf("expected 10 to 14 lines to be read, got %d", read)
+	}
+}
+
+func TestMaxEventsSharedAcrossInputs(t *testing.T) {
+	// leash gives the parser for each file the same counter
+	sent := new(int64)
+	send := make(chan event.Event, 200)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		p := &Parser{EventsSent: sent}
+		if err := p.Init(&Options{MaxEvents: 10, NumParsers: 2}); err != nil {
+			t.Fatal(err)
+		}
+		lines := make(chan string, 100)
+		for j := 0; j < 100; j++ {
+			lines <- fmt.Sprintf("file=%d n=%d", i, j)
+		}
+		wg.Add(1)
+		go func() {
+			p.ProcessLines(lines, send, nil)
+			wg.Done()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessLines didn't return after max_events")
+	}
+	if len(send) != 10 {
+		t.Errorf("expected 10 events from the two inputs together, got %d", len(send))
+	}
+}
+
+func TestDatasetField(t *testing.T) {
+	lines := []string{
+		"type=access path=/a",
+		"type=error msg=oops",
+		"path=/untyped",
+	}
+	evs := processLines(t, &Options{DatasetField: "type"}, lines, nil)
+	if len(evs) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(evs))
+	}
+	for _, ev := range evs {
+		expected, _ := ev.Data["type"].(string)
+		if ev.Dataset != expected {
+			t.Errorf("expected %+v to go to dataset %q, got %q", ev.Data, expected, ev.Dataset)
+		}
+	}
+}
+
+func TestTimeFieldCandidates(t *testing.T) {
+	opts := &Options{
+		TimeFieldCandidates: []string{"request_time", "ts"},
+		TimeFieldFormat:     time.RFC3339,
+	}
+	lines := []string{
+		`type=access request_time=2017-11-23T19:57:38Z`,
+		`type=error ts=2017-11-23T20:00:00Z`,
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := map[string]time.Time{
+		"access": time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC),
+		"error":  time.Date(2017, 11, 23, 20, 0, 0, 0, time.UTC),
+	}
+	for _, ev := range evs {
+		typ := ev.Data["type"].(string)
+		if !ev.Timestamp.Equal(expected[typ]) {
+			t.Errorf("expected the %s event to have time %s, got %s", typ, expected[typ], ev.Timestamp)
+		}
+		if len(ev.Data) != 1 {
+			t.Errorf("expected the time field to be removed, got %+v", ev.Data)
+		}
+	}
+}
+
+func TestDropOnTimeParseFailure(t *testing.T) {
+	lines := []string{
+		`time=2017-11-23T19:57:38Z n=2`,
+		`time=yesterday n=3`,
+		`n=4`,
+	}
+	evs := processLines(t, &Options{TimeFieldName: "time", DropOnTimeParseFailure: true}, lines, nil)
+	if len(evs) != 1 || evs[0].Data["n"] != 2 {
+		t.Fatalf("expected only the line with a parseable time, got %+v", evs)
+	}
+	if expected := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC); !evs[0].Timestamp.Equal(expected) {
+		t.Errorf("expected time %s, got %s", expected, evs[0].Timestamp)
+	}
+
+	// strict parsing and time field candidates drop lines the same way
+	evs = processLines(t, &Options{TimeFieldName: "time", StrictTimeFormat: true, DropOnTimeParseFailure: true}, lines, nil)
+	if len(evs) != 1 || evs[0].Data["n"] != 2 {
+		t.Errorf("expected only the line with a parseable time, got %+v", evs)
+	}
+	evs = processLines(t, &Options{TimeFieldCandidates: []string{"ts", "time"}, DropOnTimeParseFailure: true}, lines, nil)
+	if len(evs) != 1 || evs[0].Data["n"] != 2 {
+		t.Errorf("expected only the line with a parseable time, got %+v", evs)
+	}
+
+	// with no timefield there's nothing to fail to parse
+	evs = processLines(t, &Options{DropOnTimeParseFailure: true}, lines, nil)
+	if len(evs) != 3 {
+		t.Errorf("expected all 3 lines to be kept without a timefield, got %d", len(evs))
+	}
+}
+
+func TestTrimFields(t *testing.T) {
+	opts := &Options{TrimFields: map[string]string{"rid": "[]", "msg": ":;"}}
+	lines := []string{`rid=[abc123] msg=done:; other=[x]: empty=[]`}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"rid":   "abc123",
+		"msg":   "done",
+		"other": "[x]:",
+		"empty": "[]",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestCollapseWhitespaceFields(t *testing.T) {
+	opts := &Options{CollapseWhitespaceFields: []string{"msg", "edges", "tabs", "blank"}}
+	lines := []string{"msg=\"a    b  c\" edges=\"  padded  \" tabs=\"x \t\t y\t\" blank=\"   \" other=\"left   alone\""}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"msg":   "a b c",
+		"edges": "padded",
+		"tabs":  "x y",
+		"blank": "",
+		"other": "left   alone",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestChangeValueCase(t *testing.T) {
+	opts := &Options{
+		LowercaseValueFields: []string{"method", "status"},
+		UppercaseValueFields: []string{"country", "size"},
+	}
+	lines := []string{`method=GET country=us status=200 size=1.5 path=/Index`}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"method":  "get",
+		"country": "US",
+		"status":  200,
+		"size":    1.5,
+		"path":    "/Index",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestJSONArrayFields(t *testing.T) {
+	opts := &Options{JSONArrayFields: []string{"ids"}, JSONArrayMode: "joined"}
+	lines := []string{`ids=[1,2,3] tags="[\"a\",\"b\"]"`}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{"ids": "1,2,3", "tags": `["a","b"]`}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestJSONFields(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	opts := &Options{JSONFields: []string{"payload", "twice", "msg", "list"}}
+	lines := []string{`payload="{\"a\":1,\"b\":{\"c\":\"d\"}}" ` +
+		`twice="\"{\\\"a\\\":\\\"x y\\\"}\"" msg="not json" list="[1,2]"`}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{
+		"payload": map[string]interface{}{"a": float64(1), "b": map[string]interface{}{"c": "d"}},
+		"twice":   map[string]interface{}{"a": "x y"},
+		"msg":     "not json",
+		"list":    "[1,2]",
+	}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+}
+
+func TestHeaderLineFormat(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	lines := []string{
+		"Content-Type: text/html; charset=utf-8",
+		"X-Forwarded-For:  10.0.0.1, 10.0.0.2,10.0.0.3 ",
+		"not a header",
+	}
+	evs := processLines(t, &Options{LineFormat: "header"}, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := []map[string]interface{}{
+		{"Content-Type": "text/html; charset=utf-8"},
+		{"X-Forwarded-For": "10.0.0.1, 10.0.0.2,10.0.0.3"},
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+	}
+
+	evs = processLines(t, &Options{LineFormat: "header", HeaderSplitValues: true}, lines[1:2], nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	split := map[string]interface{}{"X-Forwarded-For": []interface{}{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}
+	if !reflect.DeepEqual(evs[0].Data, split) {
+		t.Errorf("expected %+v, got %+v", split, evs[0].Data)
+	}
+}
+
+func TestDateOnlyFields(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	lines := []string{"due=2023-01-02 when=2023-02-30 n=5"}
+	opts := &Options{DateOnlyFields: []string{"due", "when", "n"}}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	expected := map[string]interface{}{"due": "2023-01-02T00:00:00Z", "when": "2023-02-30", "n": 5}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+
+	opts.DateOnlyTimezone = "America/Los_Angeles"
+	evs = processLines(t, opts, lines, nil)
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evs))
+	}
+	if due := evs[0].Data["due"]; due != "2023-01-02T00:00:00-08:00" {
+		t.Errorf("expected midnight in Los Angeles, got %v", due)
+	}
+}
+
+func TestSemverFields(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	opts := &Options{SemverFields: []string{"version"}}
+	lines := []string{
+		"version=1.4.2",
+		"version=2.0.0-rc1",
+		"version=v3.1.0-beta.2+build.5",
+		"version=latest",
+		"version=1.04.2",
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != len(lines) {
+		t.Fatalf("expected %d events, got %d", len(lines), len(evs))
+	}
+	expected := []map[string]interface{}{
+		{"version": "1.4.2", "version_major": 1, "version_minor": 4, "version_patch": 2},
+		{"version": "2.0.0-rc1", "version_major": 2, "version_minor": 0, "version_patch": 0, "version_prerelease": "rc1"},
+		{"version": "v3.1.0-beta.2+build.5", "version_major": 3, "version_minor": 1, "version_patch": 0,
+			"version_prerelease": "beta.2", "version_build": "build.5"},
+		{"version": "latest"},
+		{"version": "1.04.2"},
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+	}
+}
+
+func TestStackDepthFields(t *testing.T) {
+	opts := &Options{StackDepthFields: map[string]string{"stacktrace": "stack_depth"}}
+	lines := []string{
+		`stacktrace="Error: boom\n    at handler (app.js:10)\n    at next (router.js:42)\n" status=500`,
+		`stacktrace="" status=500`,
+		`status=200`,
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != len(lines) {
+		t.Fatalf("expected %d events, got %d", len(lines), len(evs))
+	}
+	for i, expected := range []interface{}{3, 0, nil} {
+		if depth := evs[i].Data["stack_depth"]; depth != expected {
+			t.Errorf("line %d: expected stack_depth %v, got %+v", i, expected, evs[i].Data)
+		}
+	}
+
+	opts = &Options{StackDepthFields: map[string]string{"trace": "depth"}, StackFrameDelimiter: `\t`}
+	evs = processLines(t, opts, []string{`trace="main\tserve\thandle"`}, nil)
+	if len(evs) != 1 || evs[0].Data["depth"] != 3 {
+		t.Errorf("expected 3 tab separated frames, got %+v", evs)
+	}
+}
+
+func TestSubParse(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	opts := &Options{SubParse: map[string]string{"payload": "json"}}
+	lines := []string{
+		`status=200 payload="{\"user\":\"alice\",\"items\":[1,2]}"`,
+		`status=500 payload="not json"`,
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := []map[string]interface{}{
+		{"status": 200, "payload": map[string]interface{}{"user": "alice", "items": []interface{}{float64(1), float64(2)}}},
+		{"status": 500, "payload": "not json"},
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+	}
+}
+
+func TestBlockWhen(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{BlockWhen: []string{"path=/healthz", "status=204", "ratio=0.5"}}); err != nil {
+		t.Fatal(err)
+	}
+	tsts := []struct {
+		line    string
+		blocked bool
+	}{
+		{"path=/healthz status=200", true},
+		{"path=/api/users status=200", false},
+		{"path=/api/users status=204", true},
+		{"path=/api/users status=2040", false},
+		{"path=/api/users ratio=0.50", true},
+		{"path=/healthz/deep status=200", false},
+	}
+	for _, tst := range tsts {
+		ev, err := p.ProcessLine(tst.line, nil)
+		if _, skipped := err.(*SkipError); skipped != tst.blocked {
+			t.Errorf("%q: expected blocked %v, got event %+v and error %v", tst.line, tst.blocked, ev, err)
+		}
+	}
+}
+
+func TestTimeOfDayWindow(t *testing.T) {
+	tsts := []struct {
+		window, zone, time string
+		kept               bool
+	}{
+		{"09:00-17:00", "", "2017-11-23T12:30:00Z", true},
+		{"09:00-17:00", "", "2017-11-23T09:00:00Z", true},
+		{"09:00-17:00", "", "2017-11-23T17:00:00Z", false},
+		{"09:00-17:00", "", "2017-11-23T03:15:00Z", false},
+		// 12:30 UTC is 04:30 in Los Angeles
+		{"09:00-17:00", "America/Los_Angeles", "2017-11-23T12:30:00Z", false},
+		{"09:00-17:00", "America/Los_Angeles", "2017-11-23T20:00:00Z", true},
+		// a night shift running past midnight
+		{"22:00-06:00", "", "2017-11-23T23:59:00Z", true},
+		{"22:00-06:00", "", "2017-11-23T02:00:00Z", true},
+		{"22:00-06:00", "", "2017-11-23T06:00:00Z", false},
+		{"22:00-06:00", "", "2017-11-23T12:00:00Z", false},
+	}
+	for _, tst := range tsts {
+		p := &Parser{}
+		opts := &Options{TimeFieldName: "ts", TimeOfDayWindow: tst.window, TimeOfDayTimezone: tst.zone}
+		if err := p.Init(opts); err != nil {
+			t.Fatal(err)
+		}
+		ev, err := p.ProcessLine("ts="+tst.time+" n=5", nil)
+		if kept := err == nil && ev != nil; kept != tst.kept {
+			t.Errorf("%s in %s %q: expected kept %v, got event %+v and error %v", tst.time, tst.window, tst.zone, tst.kept, ev, err)
+		}
+	}
+}
+
+func TestBareKeyAsTrue(t *testing.T) {
+	opts := &Options{BareKeyAsTrue: true}
+	lines := []string{
+		"verbose dry_run",
+		`retry status=500 cached= note=""`,
+	}
+	evs := processLines(t, opts, lines, nil)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := []map[string]interface{}{
+		{"verbose": true, "dry_run": true},
+		{"retry": true, "status": 500, "cached": true, "note": ""},
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+	}
+
+	// without the option the line of bare keys is all empty, so skipped
+	if evs := processLines(t, &Options{}, lines[:1], nil); len(evs) != 0 {
+		t.Errorf("expected the line of bare keys to be skipped, got %+v", evs)
+	}
+}
+
+func TestMaxFieldsPerKB(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	p := &Parser{}
+	if err := p.Init(&Options{MaxFieldsPerKB: 100}); err != nil {
+		t.Fatal(err)
+	}
+	normal := `status=200 method=GET path="/api/users?page=` + strings.Repeat("2", 2000) + `" dur=5`
+	if _, err := p.ProcessLine(normal, nil); err != nil {
+		t.Errorf("expected a normal line to be kept, got %s", err)
+	}
+	// short lines count as a whole kilobyte, so aren't rejected for being short
+	if _, err := p.ProcessLine("a=1 b=2 c=3", nil); err != nil {
+		t.Errorf("expected a short line to be kept, got %s", err)
+	}
+	var dense []string
+	for i := 0; i < 1000; i++ {
+		dense = append(dense, fmt.Sprintf("k%d=1", i))
+	}
+	_, err := p.ProcessLine(strings.Join(dense, " "), nil)
+	if _, ok := err.(*SkipError); !ok {
+		t.Errorf("expected a SkipError for a line dense with fields, got %v", err)
+	}
+}
+
+func TestPresenceBoolFields(t *testing.T) {
+	lines := []string{
+		`cached= miss=`,
+		`cached=yes path=/a`,
+		`path=/b`,
+	}
+	tsts := []struct {
+		absentFalse bool
+		expected    []map[string]interface{}
+	}{
+		{false, []map[string]interface{}{
+			{"cached": true, "miss": ""},
+			{"cached": true, "path": "/a"},
+			{"path": "/b"},
+		}},
+		{true, []map[string]interface{}{
+			{"cached": true, "miss": ""},
+			{"cached": true, "path": "/a"},
+			{"cached": false, "path": "/b"},
+		}},
+	}
+	for _, tst := range tsts {
+		opts := &Options{PresenceBoolFields: []string{"cached"}, PresenceBoolAbsentFalse: tst.absentFalse, PreserveOrder: true}
+		evs := processLines(t, opts, lines, nil)
+		if len(evs) != len(tst.expected) {
+			t.Fatalf("expected %d events, got %+v", len(tst.expected), evs)
+		}
+		for i, ev := range evs {
+			if !reflect.DeepEqual(ev.Data, tst.expected[i]) {
+				t.Errorf("absent false %v: expected %+v, got %+v", tst.absentFalse, tst.expected[i], ev.Data)
+			}
+		}
+	}
+}
+
+func TestAddEventIDField(t *testing.T) {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = "same=line"
+	}
+	evs := processLines(t, &Options{AddEventIDField: "event_id"}, lines, nil)
+	seen := make(map[interface{}]bool)
+	for _, ev := range evs {
+		id := ev.Data["event_id"]
+		if !uuidRegex.MatchString(id.(string)) {
+			t.Errorf("expected a UUID, got %v", id)
+		}
+		if seen[id] {
+			t.Errorf("event ID %v was used twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(lines) {
+		t.Errorf("expected %d unique IDs, got %d", len(lines), len(seen))
+	}
+
+	n := 0
+	p := &Parser{newEventID: func() string {
+		n++
+		return fmt.Sprintf("id-%d", n)
+	}}
+	if err := p.Init(&Options{AddEventIDField: "event_id"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"id-1", "id-2"} {
+		ev, err := p.ProcessLine("a=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Data["event_id"] != expected {
+			t.Errorf("expected event_id %s, got %v", expected, ev.Data["event_id"])
+		}
+	}
+}
+
 func TestDontReturnEmptyEvents(t *testing.T) {
 	p := &Parser{}
 	p.Init(&Options{})
@@ -211,53 +1663,63 @@ func TestDontReturnUselessEvents(t *testing.T) {
 	wg.Wait()
 }
 
-func TestAllEmpty(t *testing.T) {
+func TestAllEmptyAction(t *testing.T) {
+	lines := []string{"key= key2=", "key=val"}
 	tsts := []struct {
-		incoming map[string]interface{}
-		empty    bool
+		action         string
+		expectedEvents int
 	}{
-		{
-			map[string]interface{}{
-				"k1": "v1",
-			},
-			false,
-		},
-		{
-			map[string]interface{}{
-				"k1": 3,
-			},
-			false,
-		},
-		{
-			map[string]interface{}{
-				"k1": []string{"foo", "bar"},
-			},
-			false,
-		},
-		{
-			map[string]interface{}{},
-			true,
-		},
-		{
-			map[string]interface{}{
-				"k1": "",
-			},
-			true,
-		},
-		{
-			map[string]interface{}{
-				"k1": "",
-				"k2": "",
-				"k3": "",
-			},
-			true,
-		},
+		{"", 1},
+		{"skip", 1},
+		{"emit", 2},
+		{"reject", 1},
 	}
 	for _, tst := range tsts {
-		res := allEmpty(tst.incoming)
-		if res != tst.empty {
-			t.Errorf("expected %v's empty val would be %v, got %v",
-				tst.incoming, tst.empty, res)
+		evs := processLines(t, &Options{AllEmptyAction: tst.action}, lines, nil)
+		if len(evs) != tst.expectedEvents {
+			t.Errorf("all_empty_action %q: expected %d events, got %d", tst.action, tst.expectedEvents, len(evs))
 		}
 	}
+	p := &Parser{}
+	if err := p.Init(&Options{AllEmptyAction: "explode"}); err == nil {
+		t.Error("expected error from unknown all_empty_action, got nil")
+	}
+}
+
+// processLines runs lines through a Parser initialized with opts and returns
+// all the events it sent. NumParsers defaults to 1 if unset.
+func processLines(t *testing.T, opts *Options, lines []string, prefixRegex *parsers.ExtRegexp) []event.Event {
+	if opts.NumParsers == 0 {
+		opts.NumParsers = 1
+	}
+	p := &Parser{}
+	if err := p.Init(opts); err != nil {
+		t.Fatal(err)
+	}
+	return runParser(p, lines, prefixRegex)
+}
+
+// runParser feeds lines through an initialized parser and returns the
+// events it sends
+func runParser(p *Parser, lines []string, prefixRegex *parsers.ExtRegexp) []event.Event {
+	linesCh := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range lines {
+			linesCh <- line
+		}
+		close(linesCh)
+	}()
+	var evs []event.Event
+	done := make(chan struct{})
+	go func() {
+		for ev := range send {
+			evs = append(evs, ev)
+		}
+		close(done)
+	}()
+	p.ProcessLines(linesCh, send, prefixRegex)
+	close(send)
+	<-done
+	return evs
 }
@@ -0,0 +1,1292 @@
+package keyval
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/httime"
+)
+
+// privateNetworks are the RFC 1918 IPv4 and RFC 4193 IPv6 private address
+// ranges
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isPrivateIP reports whether ip is in one of the privateNetworks
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// enrichIP parses the value of field as an IP address and adds fields
+// describing it. Values that don't parse as an IP are left alone.
+func enrichIP(data map[string]interface{}, field string) {
+	val, ok := data[field]
+	if !ok {
+		return
+	}
+	valStr, ok := val.(string)
+	ip := net.ParseIP(valStr)
+	if !ok || ip == nil {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+		}).Warn("failed to parse field as an IP address")
+		return
+	}
+	ip4 := ip.To4()
+	data[field+"_is_ipv6"] = ip4 == nil
+	data[field+"_is_private"] = isPrivateIP(ip) || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+	if ip4 != nil {
+		data[field+"_network_class"] = networkClass(ip4)
+	}
+}
+
+// uuidRegex matches the text form of an RFC 4122 UUID: a version from 1 to
+// 5 and the RFC 4122 variant
+var uuidRegex = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[1-5][0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+const nilUUID = "00000000-0000-0000-0000-000000000000"
+
+// checkUUID adds a field_valid field saying whether the value of field is an
+// RFC 4122 UUID or, if drop is set, removes the field if it isn't one
+func checkUUID(data map[string]interface{}, field string, drop bool) {
+	val, ok := data[field]
+	if !ok {
+		return
+	}
+	valStr, _ := val.(string)
+	valid := valStr == nilUUID || uuidRegex.MatchString(valStr)
+	if !drop {
+		data[field+"_valid"] = valid
+	} else if !valid {
+		delete(data, field)
+	}
+}
+
+// randomUUID returns a random (version 4) UUID
+func randomUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand only fails if the OS can't provide randomness at all
+		panic(fmt.Sprintf("failed to read random bytes for a UUID: %s", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// networkClass returns the classful network (A through E) of an IPv4 address
+func networkClass(ip net.IP) string {
+	switch first := ip[0]; {
+	case first < 128:
+		return "A"
+	case first < 192:
+		return "B"
+	case first < 224:
+		return "C"
+	case first < 240:
+		return "D"
+	default:
+		return "E"
+	}
+}
+
+// fileEnrichment holds a lookup table loaded from a TSV file, mapping values
+// of field to a set of fields to add to the event
+type fileEnrichment struct {
+	field   string
+	entries map[string]map[string]string
+}
+
+// splitSpec splits an option's key=value spec at the first =, checking both
+// sides are there. form describes the spec for the error, eg field=target.
+func splitSpec(option, spec, form string) (string, string, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", specFormError(option, spec, form)
+	}
+	return parts[0], parts[1], nil
+}
+
+// specFormError is the error for an option's spec that isn't of the form it
+// should be
+func specFormError(option, spec, form string) error {
+	return fmt.Errorf("%s %q must be of the form %s", option, spec, form)
+}
+
+// loadFileEnrichment parses a field=/path/to/file.tsv spec and reads the
+// lookup table from the file. The header row of the file names the key
+// column followed by the names of the fields to add.
+func loadFileEnrichment(spec string) (fileEnrichment, error) {
+	fe := fileEnrichment{entries: make(map[string]map[string]string)}
+	field, path, err := splitSpec("enrich_from_file", spec, "field=/path/to/file.tsv")
+	if err != nil {
+		return fe, err
+	}
+	fe.field = field
+	fh, err := os.Open(path)
+	if err != nil {
+		return fe, fmt.Errorf("enrich_from_file %q: %s", spec, err)
+	}
+	defer fh.Close()
+	var header []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		columns := strings.Split(line, "\t")
+		if header == nil {
+			if len(columns) < 2 {
+				return fe, fmt.Errorf("enrich_from_file %s: header must name the key column and at least one field to add", path)
+			}
+			header = columns
+			continue
+		}
+		added := make(map[string]string, len(header)-1)
+		for i := 1; i < len(header) && i < len(columns); i++ {
+			added[header[i]] = columns[i]
+		}
+		fe.entries[columns[0]] = added
+	}
+	return fe, scanner.Err()
+}
+
+// enrich adds the fields mapped to the value of fe.field, if there are any
+func (fe fileEnrichment) enrich(data map[string]interface{}) {
+	val, ok := data[fe.field]
+	if !ok {
+		return
+	}
+	added, ok := fe.entries[fmt.Sprintf("%v", val)]
+	if !ok {
+		return
+	}
+	for k, v := range added {
+		data[k] = v
+	}
+}
+
+// loadBoolTokens reads a file of token<tab>bool lines into a map from the
+// lowercased token to its boolean
+func loadBoolTokens(path string) (map[string]bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("bool_tokens_file %q: %s", path, err)
+	}
+	defer fh.Close()
+	tokens := make(map[string]bool)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		columns := strings.Split(line, "\t")
+		if len(columns) != 2 {
+			return nil, fmt.Errorf("bool_tokens_file %s: line %q must be a token and true or false separated by a tab", path, line)
+		}
+		b, err := strconv.ParseBool(columns[1])
+		if err != nil {
+			return nil, fmt.Errorf("bool_tokens_file %s: line %q must be a token and true or false separated by a tab", path, line)
+		}
+		tokens[strings.ToLower(columns[0])] = b
+	}
+	return tokens, scanner.Err()
+}
+
+// valueMap maps the values of field to new values, stored in target
+type valueMap struct {
+	field  string
+	target string
+	values map[string]string
+}
+
+// parseValueMap parses a field[:target]=value:mapped,value:mapped spec
+func parseValueMap(spec string) (valueMap, error) {
+	fields, mapping, err := splitSpec("value_map", spec, "field=value:mapped,value:mapped")
+	if err != nil {
+		return valueMap{}, err
+	}
+	vm := valueMap{values: make(map[string]string)}
+	vm.field, vm.target = fields, fields
+	if fields := strings.SplitN(fields, ":", 2); len(fields) == 2 {
+		vm.field, vm.target = fields[0], fields[1]
+	}
+	if vm.field == "" || vm.target == "" {
+		return valueMap{}, fmt.Errorf("value_map %q: field and target must not be empty", spec)
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		splitPair := strings.SplitN(pair, ":", 2)
+		if len(splitPair) != 2 {
+			return valueMap{}, fmt.Errorf("value_map %q: %q must be of the form value:mapped", spec, pair)
+		}
+		vm.values[splitPair[0]] = splitPair[1]
+	}
+	return vm, nil
+}
+
+// apply sets target to the mapped value of field, if it has one
+func (vm valueMap) apply(data map[string]interface{}) {
+	val, ok := data[vm.field]
+	if !ok {
+		return
+	}
+	if mapped, ok := vm.values[fmt.Sprint(val)]; ok {
+		data[vm.target] = mapped
+	}
+}
+
+// hashedField is a field to add containing a hash of the values of fields
+type hashedField struct {
+	target    string
+	algorithm string
+	fields    []string
+}
+
+// parseHashedField parses a target=algorithm:field,field spec
+func parseHashedField(spec string) (hashedField, error) {
+	const form = "target=algorithm:field,field"
+	target, hashSpec, err := splitSpec("hash_combine_field", spec, form)
+	if err != nil {
+		return hashedField{}, err
+	}
+	splitHash := strings.SplitN(hashSpec, ":", 2)
+	if len(splitHash) != 2 || splitHash[1] == "" {
+		return hashedField{}, specFormError("hash_combine_field", spec, form)
+	}
+	switch splitHash[0] {
+	case "fnv", "sha256":
+	default:
+		return hashedField{}, fmt.Errorf("hash_combine_field %q: unknown algorithm %q; must be one of fnv, sha256", spec, splitHash[0])
+	}
+	return hashedField{
+		target:    target,
+		algorithm: splitHash[0],
+		fields:    strings.Split(splitHash[1], ","),
+	}, nil
+}
+
+// hash sets the target field to the hex encoded hash of the fields' values
+func (hf hashedField) hash(data map[string]interface{}) {
+	var h hash.Hash
+	if hf.algorithm == "sha256" {
+		h = sha256.New()
+	} else {
+		h = fnv.New64a()
+	}
+	for i, field := range hf.fields {
+		if i > 0 {
+			// separate the values so that a=ab,b=c and a=a,b=bc differ
+			h.Write([]byte{0})
+		}
+		val, ok := data[field]
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"field":  field,
+				"target": hf.target,
+			}).Warn("field to hash is missing; hashing it as empty")
+			continue
+		}
+		fmt.Fprint(h, val)
+	}
+	data[hf.target] = hex.EncodeToString(h.Sum(nil))
+}
+
+// timeOfDayWindow is a range of times of day in a time zone, as offsets from
+// midnight. If end is before start the window runs past midnight.
+type timeOfDayWindow struct {
+	start time.Duration
+	end   time.Duration
+	loc   *time.Location
+}
+
+// parseTimeOfDayWindow parses an HH:MM-HH:MM time_of_day_window in the time
+// zone named by zone, UTC if it's empty
+func parseTimeOfDayWindow(spec, zone string) (*timeOfDayWindow, error) {
+	formErr := fmt.Errorf("time_of_day_window %q must be of the form HH:MM-HH:MM", spec)
+	bounds := strings.Split(spec, "-")
+	if len(bounds) != 2 {
+		return nil, formErr
+	}
+	w := &timeOfDayWindow{loc: time.UTC}
+	for i, dest := range []*time.Duration{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(bounds[i]))
+		if err != nil {
+			return nil, formErr
+		}
+		*dest = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("time_of_day_window %q must not start and end at the same time", spec)
+	}
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time_of_day_timezone %q: %s", zone, err)
+		}
+		w.loc = loc
+	}
+	return w, nil
+}
+
+// contains reports whether t's time of day is in the window
+func (w *timeOfDayWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	if w.start < w.end {
+		return sinceMidnight >= w.start && sinceMidnight < w.end
+	}
+	return sinceMidnight >= w.start || sinceMidnight < w.end
+}
+
+// blockCondition is a field=value condition for block_when
+type blockCondition struct {
+	field string
+	value string
+}
+
+// parseBlockCondition parses a field=value spec
+func parseBlockCondition(spec string) (blockCondition, error) {
+	field, value, err := splitSpec("block_when", spec, "field=value")
+	if err != nil {
+		return blockCondition{}, err
+	}
+	return blockCondition{field: field, value: value}, nil
+}
+
+// matches reports whether field has the condition's value, compared as text
+// so that eg status=200 matches however the value was parsed
+func (bc blockCondition) matches(data map[string]interface{}) bool {
+	val, ok := data[bc.field]
+	return ok && fmt.Sprint(val) == bc.value
+}
+
+// hashBucketField is a target field set to which of buckets the value of
+// field hashes to
+type hashBucketField struct {
+	field   string
+	target  string
+	buckets uint64
+}
+
+// parseHashBucketField parses a field=buckets or field:target=buckets spec
+func parseHashBucketField(spec string) (hashBucketField, error) {
+	fields, bucketsSpec, err := splitSpec("bucket_hash_field", spec, "field=buckets")
+	if err != nil {
+		return hashBucketField{}, err
+	}
+	hb := hashBucketField{field: fields, target: fields + "_bucket"}
+	if fields := strings.SplitN(fields, ":", 2); len(fields) == 2 {
+		hb.field, hb.target = fields[0], fields[1]
+	}
+	if hb.field == "" || hb.target == "" {
+		return hashBucketField{}, fmt.Errorf("bucket_hash_field %q: field and target must not be empty", spec)
+	}
+	buckets, err := strconv.ParseUint(bucketsSpec, 10, 64)
+	if err != nil || buckets == 0 {
+		return hashBucketField{}, fmt.Errorf("bucket_hash_field %q: the number of buckets must be a positive integer", spec)
+	}
+	hb.buckets = buckets
+	return hb, nil
+}
+
+// bucket sets the target field to the bucket of field's value, if it has one
+func (hb hashBucketField) bucket(data map[string]interface{}, dropOriginal bool) {
+	val, ok := data[hb.field]
+	if !ok {
+		return
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, val)
+	data[hb.target] = int(h.Sum64() % hb.buckets)
+	if dropOriginal && hb.target != hb.field {
+		delete(data, hb.field)
+	}
+}
+
+// truncatedTimeField is a field to add containing the event timestamp
+// truncated to a unit
+type truncatedTimeField struct {
+	field string
+	unit  string
+}
+
+// parseTruncatedTimeField parses a field=unit spec
+func parseTruncatedTimeField(spec string) (truncatedTimeField, error) {
+	field, unit, err := splitSpec("add_truncated_time_field", spec, "field=unit")
+	if err != nil {
+		return truncatedTimeField{}, err
+	}
+	switch unit {
+	case "minute", "hour", "day":
+	default:
+		return truncatedTimeField{}, fmt.Errorf("add_truncated_time_field %q: unknown unit %q; must be one of minute, hour, day", spec, unit)
+	}
+	return truncatedTimeField{field: field, unit: unit}, nil
+}
+
+// truncate returns ts truncated to the field's unit
+func (tf truncatedTimeField) truncate(ts time.Time) time.Time {
+	switch tf.unit {
+	case "minute":
+		return ts.Truncate(time.Minute)
+	case "hour":
+		return ts.Truncate(time.Hour)
+	default:
+		// days aren't always 24 hours long, so truncate by hand
+		return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, ts.Location())
+	}
+}
+
+// levelField is a field whose log level is normalized into target
+type levelField struct {
+	field  string
+	target string
+}
+
+// normalizedLevels maps the level spellings and numbers seen in the wild to
+// the level they mean
+var normalizedLevels = map[string]string{
+	"trace": "trace", "trc": "trace", "finest": "trace", "verbose": "trace",
+	"debug": "debug", "dbg": "debug", "fine": "debug", "d": "debug",
+	"info": "info", "inf": "info", "information": "info", "informational": "info",
+	"notice": "info", "i": "info",
+	"warn": "warn", "warning": "warn", "wrn": "warn", "w": "warn",
+	"error": "error", "err": "error", "eror": "error", "e": "error",
+	"fatal": "fatal", "critical": "fatal", "crit": "fatal", "alert": "fatal",
+	"emerg": "fatal", "emergency": "fatal", "panic": "fatal", "f": "fatal",
+	// syslog severities
+	"0": "fatal", "1": "fatal", "2": "fatal", "3": "error",
+	"4": "warn", "5": "info", "6": "info", "7": "debug",
+	// bunyan and pino levels
+	"10": "trace", "20": "debug", "30": "info", "40": "warn", "50": "error", "60": "fatal",
+}
+
+// parseLevelField parses a field=target spec
+func parseLevelField(spec string) (levelField, error) {
+	field, target, err := splitSpec("normalize_level_field", spec, "field=target")
+	if err != nil {
+		return levelField{}, err
+	}
+	return levelField{field: field, target: target}, nil
+}
+
+// normalize sets the target field to the normalized level found in the
+// field. Unknown levels are copied over unchanged.
+func (lf levelField) normalize(data map[string]interface{}) {
+	val, ok := data[lf.field]
+	if !ok {
+		return
+	}
+	if _, isBool := val.(bool); isBool {
+		// values of 0, 1 and f are coerced to bools, and all mean fatal
+		data[lf.target] = "fatal"
+		return
+	}
+	level, ok := normalizedLevels[strings.ToLower(fmt.Sprint(val))]
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"field": lf.field,
+			"value": val,
+		}).Warn("unknown log level; copying it as it is")
+		data[lf.target] = val
+		return
+	}
+	data[lf.target] = level
+}
+
+// statusClassField is a field whose HTTP status is grouped into a class in
+// target
+type statusClassField struct {
+	field  string
+	target string
+}
+
+// parseStatusClassField parses a field=target spec
+func parseStatusClassField(spec string) (statusClassField, error) {
+	field, target, err := splitSpec("status_class_field", spec, "field=target")
+	if err != nil {
+		return statusClassField{}, err
+	}
+	return statusClassField{field: field, target: target}, nil
+}
+
+// classify sets the target field to the class of the status found in the
+// field, eg 4xx for 404. Statuses that aren't a number from 100 to 599 are
+// classed as other.
+func (sc statusClassField) classify(data map[string]interface{}) {
+	val, ok := data[sc.field]
+	if !ok {
+		return
+	}
+	var status int64
+	switch v := val.(type) {
+	case int:
+		status = int64(v)
+	case int64:
+		status = v
+	case string:
+		status, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	}
+	if status < 100 || status > 599 {
+		data[sc.target] = "other"
+		return
+	}
+	data[sc.target] = fmt.Sprintf("%dxx", status/100)
+}
+
+// embeddedPair matches a key=val pair in free text. Values may be quoted to
+// include spaces.
+var embeddedPair = regexp.MustCompile(`(?:^|\s)([A-Za-z_][\w.-]*)=("(?:[^"\\]|\\.)*"|\S+)`)
+
+// extractPairs adds the key=val pairs found in the string value of field as
+// fields named prefix+key. Unquoted values are coerced by values. Fields
+// already in data are left alone.
+func extractPairs(data map[string]interface{}, field, prefix string, values *KeyValLineParser) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	for _, match := range embeddedPair.FindAllStringSubmatch(val, -1) {
+		key := prefix + match[1]
+		if _, exists := data[key]; exists {
+			continue
+		}
+		pairVal := match[2]
+		if unquoted, err := strconv.Unquote(pairVal); err == nil && strings.HasPrefix(pairVal, `"`) {
+			data[key] = unquoted
+			continue
+		}
+		data[key] = values.coerce(key, pairVal, false)
+	}
+}
+
+// uaToken is a substring of a lowercased User-Agent and what it identifies
+type uaToken struct {
+	token string
+	name  string
+}
+
+// uaBrowsers are checked in order, as most browsers claim to be several
+// others too (eg Chrome's User-Agent mentions Safari, and Edge's Chrome)
+var uaBrowsers = []uaToken{
+	{"edg/", "Edge"}, {"edge/", "Edge"}, {"opr/", "Opera"}, {"opera", "Opera"},
+	{"samsungbrowser/", "Samsung Internet"}, {"firefox/", "Firefox"}, {"fxios/", "Firefox"},
+	{"chromium/", "Chromium"}, {"crios/", "Chrome"}, {"chrome/", "Chrome"},
+	{"msie ", "Internet Explorer"}, {"trident/", "Internet Explorer"}, {"safari/", "Safari"},
+	{"curl/", "curl"}, {"wget/", "Wget"}, {"python-requests/", "python-requests"},
+	{"go-http-client/", "Go-http-client"},
+}
+
+// uaOSes are checked in order, as eg Android User-Agents mention Linux too
+var uaOSes = []uaToken{
+	{"windows phone", "Windows Phone"}, {"windows", "Windows"},
+	{"iphone", "iOS"}, {"ipad", "iOS"}, {"ipod", "iOS"}, {"android", "Android"},
+	{"cros", "Chrome OS"}, {"mac os x", "macOS"}, {"macintosh", "macOS"}, {"linux", "Linux"},
+}
+
+var uaBotWords = []string{"bot", "crawler", "spider", "slurp"}
+
+// parseUserAgent makes a best guess at the browser, operating system and kind
+// of device a User-Agent describes. Whatever can't be made out is unknown.
+func parseUserAgent(ua string) (browser, osName, device string) {
+	browser, osName, device = "unknown", "unknown", "unknown"
+	lower := strings.ToLower(ua)
+	for _, b := range uaBrowsers {
+		if strings.Contains(lower, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range uaOSes {
+		if strings.Contains(lower, o.token) {
+			osName = o.name
+			break
+		}
+	}
+	// bots name themselves in a product token like Googlebot/2.1
+	for _, word := range strings.FieldsFunc(ua, func(r rune) bool {
+		return r == ' ' || r == ';' || r == '(' || r == ')'
+	}) {
+		lowerWord := strings.ToLower(word)
+		for _, botWord := range uaBotWords {
+			if strings.Contains(lowerWord, botWord) && !strings.Contains(lowerWord, "://") {
+				return strings.SplitN(word, "/", 2)[0], osName, "bot"
+			}
+		}
+	}
+	switch {
+	case strings.Contains(lower, "ipad") || strings.Contains(lower, "tablet"):
+		device = "tablet"
+	case strings.Contains(lower, "android") && !strings.Contains(lower, "mobile"):
+		device = "tablet"
+	case strings.Contains(lower, "mobi") || strings.Contains(lower, "iphone") ||
+		strings.Contains(lower, "ipod") || osName == "Windows Phone":
+		device = "mobile"
+	case osName == "Windows" || osName == "macOS" || osName == "Linux" || osName == "Chrome OS":
+		device = "desktop"
+	}
+	return browser, osName, device
+}
+
+// splitUserAgent adds field_browser, field_os and field_device fields
+// describing the User-Agent in field
+func splitUserAgent(data map[string]interface{}, field string) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	browser, osName, device := parseUserAgent(val)
+	data[field+"_browser"] = browser
+	data[field+"_os"] = osName
+	data[field+"_device"] = device
+}
+
+// intValue returns val as an int64 if it is an integer
+func intValue(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// floatValue returns val as a float64 if it is a number
+func floatValue(val interface{}) (float64, bool) {
+	if i, ok := intValue(val); ok {
+		return float64(i), true
+	}
+	f, ok := val.(float64)
+	return f, ok
+}
+
+// subtractField is a target field set to the difference of two fields
+type subtractField struct {
+	target     string
+	minuend    string
+	subtrahend string
+}
+
+// parseSubtractField parses a target=field-field spec
+func parseSubtractField(spec string) (subtractField, error) {
+	const form = "target=field-field"
+	target, difference, err := splitSpec("subtract_field", spec, form)
+	if err != nil {
+		return subtractField{}, err
+	}
+	operands := strings.Split(difference, "-")
+	if len(operands) != 2 || operands[0] == "" || operands[1] == "" {
+		return subtractField{}, specFormError("subtract_field", spec, form)
+	}
+	return subtractField{target: target, minuend: operands[0], subtrahend: operands[1]}, nil
+}
+
+// subtract sets the target field to the minuend minus the subtrahend. The
+// difference of two integers is an integer, so eg nanosecond timestamps
+// don't lose precision.
+func (sf subtractField) subtract(data map[string]interface{}) {
+	aInt, aIsInt := intValue(data[sf.minuend])
+	bInt, bIsInt := intValue(data[sf.subtrahend])
+	if aIsInt && bIsInt {
+		data[sf.target] = int(aInt - bInt)
+		return
+	}
+	a, aOk := floatValue(data[sf.minuend])
+	b, bOk := floatValue(data[sf.subtrahend])
+	if !aOk || !bOk {
+		logrus.WithFields(logrus.Fields{
+			"field":       sf.target,
+			sf.minuend:    data[sf.minuend],
+			sf.subtrahend: data[sf.subtrahend],
+		}).Warn("fields to subtract are missing or not numbers; skipping")
+		return
+	}
+	data[sf.target] = a - b
+}
+
+// bucketField is a target field set to the label of the range the value of
+// field falls in. There's one more label than boundaries: labels[0] is for
+// values below boundaries[0], and labels[i] for values from boundaries[i-1] up
+// to boundaries[i].
+type bucketField struct {
+	target     string
+	field      string
+	boundaries []float64
+	labels     []string
+}
+
+// parseBucketField parses a bucket_field of the form
+// target=field:boundary,boundary:label,label,label
+func parseBucketField(spec string) (bucketField, error) {
+	const form = "target=field:boundary,boundary:label,label,label"
+	target, buckets, err := splitSpec("bucket_field", spec, form)
+	if err != nil {
+		return bucketField{}, err
+	}
+	parts := strings.SplitN(buckets, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return bucketField{}, specFormError("bucket_field", spec, form)
+	}
+	bf := bucketField{target: target, field: parts[0], labels: strings.Split(parts[2], ",")}
+	for _, b := range strings.Split(parts[1], ",") {
+		boundary, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return bucketField{}, fmt.Errorf("bucket_field %q has a boundary that isn't a number: %q", spec, b)
+		}
+		if n := len(bf.boundaries); n > 0 && boundary <= bf.boundaries[n-1] {
+			return bucketField{}, fmt.Errorf("bucket_field %q must have increasing boundaries", spec)
+		}
+		bf.boundaries = append(bf.boundaries, boundary)
+	}
+	if len(bf.labels) != len(bf.boundaries)+1 {
+		return bucketField{}, fmt.Errorf("bucket_field %q must have one more label than boundaries", spec)
+	}
+	return bf, nil
+}
+
+// bucket sets the target field to the label of the range field's value is in
+func (bf bucketField) bucket(data map[string]interface{}) {
+	val, ok := floatValue(data[bf.field])
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"field":  bf.target,
+			bf.field: data[bf.field],
+		}).Warn("field to bucket is missing or not a number; skipping")
+		return
+	}
+	i := 0
+	for i < len(bf.boundaries) && val >= bf.boundaries[i] {
+		i++
+	}
+	data[bf.target] = bf.labels[i]
+}
+
+// computeOperand is either a field or a number in a computeField expression
+type computeOperand struct {
+	field string
+	value float64
+}
+
+// computeField is a target field set to the result of an expression
+type computeField struct {
+	spec     string
+	target   string
+	operands []computeOperand
+	// ops[i] combines the result so far with operands[i+1]
+	ops []rune
+}
+
+// parseComputeField parses a target=expression spec, where the expression is
+// fields or numbers separated by +, -, * or /, evaluated left to right. As -
+// is an operator, field names can't contain one; a - with a field name
+// directly on either side (eg req-count) is rejected rather than taken as a
+// subtraction the user may not have meant.
+func parseComputeField(spec string) (computeField, error) {
+	target, expression, err := splitSpec("compute_field", spec, "target=expression")
+	if err != nil {
+		return computeField{}, err
+	}
+	cf := computeField{spec: spec, target: target}
+	var terms []string
+	start := 0
+	for i, r := range expression {
+		if strings.ContainsRune("+-*/", r) {
+			terms = append(terms, expression[start:i])
+			cf.ops = append(cf.ops, r)
+			start = i + 1
+		}
+	}
+	terms = append(terms, expression[start:])
+	if len(cf.ops) == 0 {
+		return computeField{}, fmt.Errorf("compute_field %q has no operator; use +, -, * or /", spec)
+	}
+	for i, op := range cf.ops {
+		before, after := terms[i], terms[i+1]
+		if op != '-' || before == "" || after == "" ||
+			strings.HasSuffix(before, " ") || strings.HasPrefix(after, " ") {
+			continue
+		}
+		_, beforeErr := strconv.ParseFloat(strings.TrimSpace(before), 64)
+		_, afterErr := strconv.ParseFloat(strings.TrimSpace(after), 64)
+		if beforeErr != nil || afterErr != nil {
+			return computeField{}, fmt.Errorf("compute_field %q: field names can't contain -; put spaces around a - that subtracts (eg %s - %s)",
+				spec, strings.TrimSpace(before), strings.TrimSpace(after))
+		}
+	}
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return computeField{}, fmt.Errorf("compute_field %q is missing an operand", spec)
+		}
+		if num, err := strconv.ParseFloat(term, 64); err == nil {
+			cf.operands = append(cf.operands, computeOperand{value: num})
+		} else {
+			cf.operands = append(cf.operands, computeOperand{field: term})
+		}
+	}
+	return cf, nil
+}
+
+// compute sets the target field to the result of the expression
+func (cf computeField) compute(data map[string]interface{}) {
+	values := make([]float64, len(cf.operands))
+	for i, operand := range cf.operands {
+		if operand.field == "" {
+			values[i] = operand.value
+			continue
+		}
+		val, ok := floatValue(data[operand.field])
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"compute_field": cf.spec,
+				"field":         operand.field,
+				"value":         data[operand.field],
+			}).Warn("field to compute with is missing or not a number; skipping")
+			return
+		}
+		values[i] = val
+	}
+	result := values[0]
+	for i, op := range cf.ops {
+		switch op {
+		case '+':
+			result += values[i+1]
+		case '-':
+			result -= values[i+1]
+		case '*':
+			result *= values[i+1]
+		case '/':
+			if values[i+1] == 0 {
+				logrus.WithField("compute_field", cf.spec).Warn("division by zero; skipping")
+				return
+			}
+			result /= values[i+1]
+		}
+	}
+	data[cf.target] = result
+}
+
+// parseTimeField replaces the value of field with the time it contains,
+// parsed using layout. Values that fail to parse are left alone.
+func parseTimeField(data map[string]interface{}, field, layout string) {
+	val, ok := data[field]
+	if !ok {
+		return
+	}
+	valStr, ok := val.(string)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+		}).Warn("time field is not a string; leaving it alone")
+		return
+	}
+	ts, err := httime.Parse(layout, valStr)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"field":  field,
+			"value":  val,
+			"layout": layout,
+			"error":  err,
+		}).Warn("failed to parse time field; leaving it alone")
+		return
+	}
+	data[field] = ts
+}
+
+// truncateField keeps the first length characters of the string value of
+// field or, if length is negative, the last -length characters. Characters
+// are runes, so multi-byte characters aren't split.
+func truncateField(data map[string]interface{}, field string, length int) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	runes := []rune(val)
+	switch {
+	case length > 0 && len(runes) > length:
+		data[field] = string(runes[:length])
+	case length < 0 && len(runes) > -length:
+		data[field] = string(runes[len(runes)+length:])
+	}
+}
+
+// decodeBase64Field replaces the value of field with the text it decodes to.
+// Both the standard and URL-safe alphabets are accepted, padded or not.
+// Values that aren't base64 or don't decode to valid UTF-8 are left alone.
+func decodeBase64Field(data map[string]interface{}, field string) {
+	val, ok := data[field]
+	if !ok {
+		return
+	}
+	valStr, ok := val.(string)
+	if !ok {
+		return
+	}
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.URLEncoding,
+		base64.RawStdEncoding, base64.RawURLEncoding,
+	} {
+		decoded, err := enc.DecodeString(valStr)
+		if err != nil {
+			continue
+		}
+		if !utf8.Valid(decoded) {
+			break
+		}
+		data[field] = string(decoded)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"field": field,
+		"value": val,
+	}).Warn("failed to decode base64 field; leaving it alone")
+}
+
+// decodeURLField replaces the percent-encoded value of field with the text it
+// decodes to. A + is left as is, as it is in paths. Values with invalid
+// escapes are left alone.
+func decodeURLField(data map[string]interface{}, field string) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	decoded, err := url.PathUnescape(val)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+			"error": err,
+		}).Warn("failed to url decode field; leaving it alone")
+		return
+	}
+	data[field] = decoded
+}
+
+// parseJSONArray replaces the JSON array in the value of field with its
+// elements: as a list, as fields named field_0, field_1 etc in indexed mode,
+// or separated by commas in joined mode. Values that aren't a JSON array are
+// left alone.
+func parseJSONArray(data map[string]interface{}, field, mode string) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	var elems []interface{}
+	if err := json.Unmarshal([]byte(val), &elems); err != nil || elems == nil {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+		}).Warn("failed to parse field as a JSON array; leaving it alone")
+		return
+	}
+	switch mode {
+	case "indexed":
+		delete(data, field)
+		for i, elem := range elems {
+			data[fmt.Sprintf("%s_%d", field, i)] = elem
+		}
+	case "joined":
+		joined := make([]string, len(elems))
+		for i, elem := range elems {
+			if s, ok := elem.(string); ok {
+				joined[i] = s
+				continue
+			}
+			// re-encode numbers, bools, nulls and anything nested as they were
+			encoded, _ := json.Marshal(elem)
+			joined[i] = string(encoded)
+		}
+		data[field] = strings.Join(joined, ",")
+	default:
+		data[field] = elems
+	}
+}
+
+// hexIDRegex matches path segments that look like UUIDs or hex IDs
+var hexIDRegex = regexp.MustCompile(`^(?i)(?:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|[0-9a-f]{8,})$`)
+
+// templatizePath sets field_template to the path in field with the segments
+// that are IDs replaced by :id. Numeric segments are always IDs; with hex set
+// so are UUIDs and hex strings containing a digit.
+func templatizePath(data map[string]interface{}, field string, hex bool) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	if query := strings.IndexAny(val, "?#"); query != -1 {
+		val = val[:query]
+	}
+	segments := strings.Split(val, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		if strings.Trim(segment, "0123456789") == "" ||
+			(hex && hexIDRegex.MatchString(segment) && strings.ContainsAny(segment, "0123456789")) {
+			segments[i] = ":id"
+		}
+	}
+	data[field+"_template"] = strings.Join(segments, "/")
+}
+
+// countStackFrames sets target to the number of frames in the stack trace in
+// field: the parts of it between delim that aren't blank
+func countStackFrames(data map[string]interface{}, field, target, delim string) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	frames := 0
+	for _, frame := range strings.Split(val, delim) {
+		if strings.TrimSpace(frame) != "" {
+			frames++
+		}
+	}
+	data[target] = frames
+}
+
+// semverRegex matches a semantic version as described at https://semver.org,
+// with an optional leading v
+var semverRegex = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+// splitSemver adds field_major, field_minor and field_patch, and
+// field_prerelease and field_build if they're present, from the semantic
+// version in field
+func splitSemver(data map[string]interface{}, field string) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	match := semverRegex.FindStringSubmatch(val)
+	if match == nil {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+		}).Warn("failed to parse field as a semantic version; leaving it alone")
+		return
+	}
+	for i, part := range []string{"major", "minor", "patch"} {
+		n, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			// too big for an int; keep it as it was written
+			data[field+"_"+part] = match[i+1]
+			continue
+		}
+		data[field+"_"+part] = n
+	}
+	if match[4] != "" {
+		data[field+"_prerelease"] = match[4]
+	}
+	if match[5] != "" {
+		data[field+"_build"] = match[5]
+	}
+}
+
+// parseDateOnly replaces a YYYY-MM-DD date in field with the RFC3339
+// timestamp of midnight at the start of that day in loc
+func parseDateOnly(data map[string]interface{}, field string, loc *time.Location) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	date, err := time.ParseInLocation("2006-01-02", val, loc)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+		}).Warn("failed to parse field as a YYYY-MM-DD date; leaving it alone")
+		return
+	}
+	data[field] = date.Format(time.RFC3339)
+}
+
+// parseJSONObject replaces the value of field with the JSON object it holds.
+// If the value is a JSON string, as happens when the object was escaped twice
+// before being quoted, the object inside that string is used instead.
+func parseJSONObject(data map[string]interface{}, field string) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(val), &decoded); err == nil {
+		if inner, ok := decoded.(string); ok {
+			decoded = nil
+			json.Unmarshal([]byte(inner), &decoded)
+		}
+	}
+	obj, ok := decoded.(map[string]interface{})
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"field": field,
+			"value": val,
+		}).Warn("failed to parse field as a JSON object; leaving it alone")
+		return
+	}
+	data[field] = obj
+}
+
+// splitHostPort splits the host:port value of field into field_ip and
+// field_port, the port as an int if it is numeric. IPv6 addresses must be
+// bracketed when there's a port. A bare IP with no port only adds field_ip;
+// anything else that won't split is left alone.
+func splitHostPort(data map[string]interface{}, field string, dropOriginal bool) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	host, port, err := net.SplitHostPort(val)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
+		if net.ParseIP(host) == nil {
+			return
+		}
+		port = ""
+	}
+	data[field+"_ip"] = host
+	if port != "" {
+		if portNum, err := strconv.Atoi(port); err == nil {
+			data[field+"_port"] = portNum
+		} else {
+			data[field+"_port"] = port
+		}
+	}
+	if dropOriginal {
+		delete(data, field)
+	}
+}
+
+// csvField is a field whose comma separated value is split into the named
+// fields
+type csvField struct {
+	field string
+	names []string
+}
+
+// parseCSVField parses a field=name,name spec
+func parseCSVField(spec string) (csvField, error) {
+	field, namesSpec, err := splitSpec("csv_field", spec, "field=name,name")
+	if err != nil {
+		return csvField{}, err
+	}
+	names := strings.Split(namesSpec, ",")
+	for _, name := range names {
+		if name == "" {
+			return csvField{}, fmt.Errorf("csv_field %q has an empty field name", spec)
+		}
+	}
+	return csvField{field: field, names: names}, nil
+}
+
+// split sets each of the named fields to the matching part of the value of
+// the field, coerced by values. Values that don't have one part per name are
+// left alone.
+func (cf csvField) split(data map[string]interface{}, values *KeyValLineParser) {
+	val, ok := data[cf.field].(string)
+	if !ok {
+		return
+	}
+	r := csv.NewReader(strings.NewReader(val))
+	r.TrimLeadingSpace = true
+	parts, err := r.Read()
+	if err != nil || len(parts) != len(cf.names) {
+		logrus.WithFields(logrus.Fields{
+			"field":    cf.field,
+			"value":    val,
+			"expected": len(cf.names),
+			"got":      len(parts),
+		}).Warn("csv field doesn't have one part per name; leaving it alone")
+		return
+	}
+	for i, part := range parts {
+		data[cf.names[i]] = values.coerce(cf.names[i], part, false)
+	}
+}
+
+// splitCookies adds a field named field_name for each name=value cookie in
+// the value of field, coerced by values. Space around the cookies and
+// the = is ignored, as are the quotes around a quoted value.
+func splitCookies(data map[string]interface{}, field string, values *KeyValLineParser) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	for _, cookie := range strings.Split(val, ";") {
+		splitCookie := strings.SplitN(cookie, "=", 2)
+		name := strings.TrimSpace(splitCookie[0])
+		if len(splitCookie) != 2 || name == "" {
+			continue
+		}
+		cookieVal := strings.TrimSpace(splitCookie[1])
+		if len(cookieVal) >= 2 && strings.HasPrefix(cookieVal, `"`) && strings.HasSuffix(cookieVal, `"`) {
+			cookieVal = cookieVal[1 : len(cookieVal)-1]
+		}
+		key := field + "_" + name
+		data[key] = values.coerce(key, cookieVal, false)
+	}
+}
+
+// splitList splits the string value of field on sep. The value is replaced
+// with a list of the elements or, if indexed is set, with one field per
+// element named field_0, field_1, etc.
+func splitList(data map[string]interface{}, field, sep string, indexed, dropEmpty bool) {
+	val, ok := data[field].(string)
+	if !ok {
+		return
+	}
+	elems := []string{}
+	for _, elem := range strings.Split(val, sep) {
+		if dropEmpty && elem == "" {
+			continue
+		}
+		elems = append(elems, elem)
+	}
+	if !indexed {
+		data[field] = elems
+		return
+	}
+	delete(data, field)
+	for i, elem := range elems {
+		data[fmt.Sprintf("%s_%d", field, i)] = elem
+	}
+}
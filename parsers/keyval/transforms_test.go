@@ -0,0 +1,941 @@
+package keyval
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestEnrichIP(t *testing.T) {
+	tsts := []struct {
+		value    interface{}
+		expected map[string]interface{}
+	}{
+		{ // RFC1918
+			"192.168.1.5",
+			map[string]interface{}{
+				"client":               "192.168.1.5",
+				"client_is_ipv6":       false,
+				"client_is_private":    true,
+				"client_network_class": "C",
+			},
+		},
+		{ // public
+			"8.8.8.8",
+			map[string]interface{}{
+				"client":               "8.8.8.8",
+				"client_is_ipv6":       false,
+				"client_is_private":    false,
+				"client_network_class": "A",
+			},
+		},
+		{ // IPv6
+			"2001:4860:4860::8888",
+			map[string]interface{}{
+				"client":            "2001:4860:4860::8888",
+				"client_is_ipv6":    true,
+				"client_is_private": false,
+			},
+		},
+		{ // RFC1918, at the edge of 172.16.0.0/12
+			"172.31.255.255",
+			map[string]interface{}{
+				"client":               "172.31.255.255",
+				"client_is_ipv6":       false,
+				"client_is_private":    true,
+				"client_network_class": "B",
+			},
+		},
+		{ // just past it
+			"172.32.0.1",
+			map[string]interface{}{
+				"client":               "172.32.0.1",
+				"client_is_ipv6":       false,
+				"client_is_private":    false,
+				"client_network_class": "B",
+			},
+		},
+		{ // IPv6 unique local
+			"fd12:3456::1",
+			map[string]interface{}{
+				"client":            "fd12:3456::1",
+				"client_is_ipv6":    true,
+				"client_is_private": true,
+			},
+		},
+		{ // not an IP at all
+			"not-an-ip",
+			map[string]interface{}{
+				"client": "not-an-ip",
+			},
+		},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"client": tst.value}
+		enrichIP(data, "client")
+		if !reflect.DeepEqual(data, tst.expected) {
+			t.Errorf("enrichIP(%v): got %+v, expected %+v", tst.value, data, tst.expected)
+		}
+	}
+}
+
+func TestFileEnrichment(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "keyval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	mapFile := filepath.Join(tmpdir, "asn.tsv")
+	contents := "asn\tasn_org\tasn_country\n15169\tGoogle\tUS\n13335\tCloudflare\tUS\n"
+	if err := ioutil.WriteFile(mapFile, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fe, err := loadFileEnrichment("asn=" + mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hit; numeric values match their string form in the file
+	data := map[string]interface{}{"asn": 15169}
+	fe.enrich(data)
+	expected := map[string]interface{}{
+		"asn":         15169,
+		"asn_org":     "Google",
+		"asn_country": "US",
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("got %+v, expected %+v", data, expected)
+	}
+
+	// miss
+	data = map[string]interface{}{"asn": 64512}
+	fe.enrich(data)
+	expected = map[string]interface{}{"asn": 64512}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("got %+v, expected %+v", data, expected)
+	}
+
+	// broken specs fail to load
+	if _, err := loadFileEnrichment(mapFile); err == nil {
+		t.Error("expected error for a spec with no field name")
+	}
+	if _, err := loadFileEnrichment("asn=" + filepath.Join(tmpdir, "missing.tsv")); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
+
+func TestValueMap(t *testing.T) {
+	inPlace, err := parseValueMap("status=404:Not Found,500:Server Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := parseValueMap("country_code:country=US:United States,CA:Canada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsts := []struct {
+		data     map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"status": 404, "country_code": "US"},
+			map[string]interface{}{"status": "Not Found", "country_code": "US", "country": "United States"},
+		},
+		{ // unmapped values are left alone
+			map[string]interface{}{"status": 200, "country_code": "FR"},
+			map[string]interface{}{"status": 200, "country_code": "FR"},
+		},
+		{
+			map[string]interface{}{"other": "x"},
+			map[string]interface{}{"other": "x"},
+		},
+	}
+	for _, tst := range tsts {
+		inPlace.apply(tst.data)
+		derived.apply(tst.data)
+		if !reflect.DeepEqual(tst.data, tst.expected) {
+			t.Errorf("got %+v, expected %+v", tst.data, tst.expected)
+		}
+	}
+	for _, spec := range []string{"status", "status=", "=404:x", "status=404", ":country=US:x"} {
+		if _, err := parseValueMap(spec); err == nil {
+			t.Errorf("expected error parsing %q, got nil", spec)
+		}
+	}
+}
+
+func TestHashedField(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	base := map[string]interface{}{"user_id": 42, "path": "/about", "method": "GET"}
+	for _, algorithm := range []string{"fnv", "sha256"} {
+		hf, err := parseHashedField("dedupe_key=" + algorithm + ":user_id,path,method")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashOf := func(data map[string]interface{}) interface{} {
+			copied := make(map[string]interface{})
+			for k, v := range data {
+				copied[k] = v
+			}
+			hf.hash(copied)
+			return copied["dedupe_key"]
+		}
+		key := hashOf(base)
+		if key == nil || key == "" {
+			t.Fatalf("%s: expected a dedupe_key, got %v", algorithm, key)
+		}
+		// stable
+		if again := hashOf(base); again != key {
+			t.Errorf("%s: expected the same hash twice, got %v and %v", algorithm, key, again)
+		}
+		// and sensitive to each input, including missing ones
+		for _, field := range hf.fields {
+			changed := map[string]interface{}{}
+			for k, v := range base {
+				changed[k] = v
+			}
+			changed[field] = "something else"
+			if hashOf(changed) == key {
+				t.Errorf("%s: expected changing %s to change the hash", algorithm, field)
+			}
+			delete(changed, field)
+			if hashOf(changed) == key {
+				t.Errorf("%s: expected removing %s to change the hash", algorithm, field)
+			}
+		}
+	}
+	// values moving between fields change the hash
+	hf, _ := parseHashedField("k=fnv:a,b")
+	first := map[string]interface{}{"a": "ab", "b": "c"}
+	second := map[string]interface{}{"a": "a", "b": "bc"}
+	hf.hash(first)
+	hf.hash(second)
+	if first["k"] == second["k"] {
+		t.Error("expected values split differently across fields to hash differently")
+	}
+	for _, spec := range []string{"k", "k=fnv", "k=fnv:", "k=md5:a", "=fnv:a"} {
+		if _, err := parseHashedField(spec); err == nil {
+			t.Errorf("expected error parsing %q, got nil", spec)
+		}
+	}
+}
+
+func TestTruncatedTimeField(t *testing.T) {
+	ts := time.Date(2017, 11, 10, 19, 57, 38, 123456789, time.UTC)
+	tsts := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"ts_minute=minute", time.Date(2017, 11, 10, 19, 57, 0, 0, time.UTC)},
+		{"ts_hour=hour", time.Date(2017, 11, 10, 19, 0, 0, 0, time.UTC)},
+		{"ts_day=day", time.Date(2017, 11, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tst := range tsts {
+		tf, err := parseTruncatedTimeField(tst.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tf.truncate(ts); !got.Equal(tst.expected) {
+			t.Errorf("%s: got %v, expected %v", tst.spec, got, tst.expected)
+		}
+	}
+	for _, spec := range []string{"ts_week=week", "minute", "=minute"} {
+		if _, err := parseTruncatedTimeField(spec); err == nil {
+			t.Errorf("expected error parsing %q, got nil", spec)
+		}
+	}
+}
+
+func TestNormalizeLevelField(t *testing.T) {
+	tsts := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{"WARNING", "warn"},
+		{"Information", "info"},
+		{"trace", "trace"},
+		{"dbg", "debug"},
+		{"ERR", "error"},
+		{"crit", "fatal"},
+		{4, "warn"},
+		{"3", "error"},
+		{50, "error"},
+		{true, "fatal"},
+		{"chatty", "chatty"},
+	}
+	lf, err := parseLevelField("lvl=level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"lvl": tst.value}
+		lf.normalize(data)
+		expected := map[string]interface{}{"lvl": tst.value, "level": tst.expected}
+		if !reflect.DeepEqual(data, expected) {
+			t.Errorf("level %v: got %+v, expected %+v", tst.value, data, expected)
+		}
+	}
+	data := map[string]interface{}{"other": "x"}
+	lf.normalize(data)
+	if _, ok := data["level"]; ok {
+		t.Errorf("expected no level without a lvl field, got %+v", data)
+	}
+	for _, spec := range []string{"lvl", "=level", "lvl="} {
+		if _, err := parseLevelField(spec); err == nil {
+			t.Errorf("expected error parsing %q, got nil", spec)
+		}
+	}
+}
+
+func TestStatusClassField(t *testing.T) {
+	tsts := []struct {
+		value    interface{}
+		expected string
+	}{
+		{200, "2xx"},
+		{"404", "4xx"},
+		{int64(503), "5xx"},
+		{304, "3xx"},
+		{"-", "other"},
+		{42, "other"},
+		{2.5, "other"},
+	}
+	sc, err := parseStatusClassField("status=status_class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"status": tst.value}
+		sc.classify(data)
+		expected := map[string]interface{}{"status": tst.value, "status_class": tst.expected}
+		if !reflect.DeepEqual(data, expected) {
+			t.Errorf("status %v: got %+v, expected %+v", tst.value, data, expected)
+		}
+	}
+	data := map[string]interface{}{"other": "x"}
+	sc.classify(data)
+	if _, ok := data["status_class"]; ok {
+		t.Errorf("expected no status_class without a status field, got %+v", data)
+	}
+	for _, spec := range []string{"status", "=class", "status="} {
+		if _, err := parseStatusClassField(spec); err == nil {
+			t.Errorf("expected error parsing %q, got nil", spec)
+		}
+	}
+}
+
+func TestParseTimeField(t *testing.T) {
+	data := map[string]interface{}{
+		"created_at": "2017-11-10 19:57:38",
+		"updated_at": "10/Nov/2017:20:01:02 -0800",
+		"deleted_at": "yesterday",
+		"count":      3,
+	}
+	parseTimeField(data, "created_at", "2006-01-02 15:04:05")
+	parseTimeField(data, "updated_at", "02/Jan/2006:15:04:05 -0700")
+	parseTimeField(data, "deleted_at", "2006-01-02 15:04:05")
+	parseTimeField(data, "count", "2006-01-02 15:04:05")
+	parseTimeField(data, "missing", "2006-01-02 15:04:05")
+
+	expectedCreated := time.Date(2017, 11, 10, 19, 57, 38, 0, time.UTC)
+	if ts, ok := data["created_at"].(time.Time); !ok || !ts.Equal(expectedCreated) {
+		t.Errorf("expected created_at %v, got %v", expectedCreated, data["created_at"])
+	}
+	expectedUpdated := time.Date(2017, 11, 11, 4, 1, 2, 0, time.UTC)
+	if ts, ok := data["updated_at"].(time.Time); !ok || !ts.Equal(expectedUpdated) {
+		t.Errorf("expected updated_at %v, got %v", expectedUpdated, data["updated_at"])
+	}
+	// failures keep the original
+	if data["deleted_at"] != "yesterday" {
+		t.Errorf("expected deleted_at to be left alone, got %v", data["deleted_at"])
+	}
+	if data["count"] != 3 {
+		t.Errorf("expected count to be left alone, got %v", data["count"])
+	}
+	if _, ok := data["missing"]; ok {
+		t.Error("expected no missing field to be added")
+	}
+}
+
+func TestDecodeBase64Field(t *testing.T) {
+	data := map[string]interface{}{
+		"padded":   "YWxpY2U=",
+		"urlsafe":  "Pz8_",
+		"unpadded": "YWxpY2U",
+		"binary":   "/w==",
+		"garbage":  "not base64!",
+		"count":    3,
+	}
+	for _, field := range []string{"padded", "urlsafe", "unpadded", "binary", "garbage", "count", "missing"} {
+		decodeBase64Field(data, field)
+	}
+	expected := map[string]interface{}{
+		"padded":   "alice",
+		"urlsafe":  "???",
+		"unpadded": "alice",
+		"binary":   "/w==",
+		"garbage":  "not base64!",
+		"count":    3,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestDecodeURLField(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	data := map[string]interface{}{
+		"space":   "/a%20b",
+		"slash":   "%2Fapi%2Fusers",
+		"plus":    "a+b",
+		"invalid": "/a%zz",
+		"count":   3,
+	}
+	for _, field := range []string{"space", "slash", "plus", "invalid", "count", "missing"} {
+		decodeURLField(data, field)
+	}
+	expected := map[string]interface{}{
+		"space":   "/a b",
+		"slash":   "/api/users",
+		"plus":    "a+b",
+		"invalid": "/a%zz",
+		"count":   3,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tsts := []struct {
+		val       interface{}
+		indexed   bool
+		dropEmpty bool
+		expected  map[string]interface{}
+	}{
+		{"a,b,c", false, false, map[string]interface{}{"tags": []string{"a", "b", "c"}}},
+		{"a,,c", false, false, map[string]interface{}{"tags": []string{"a", "", "c"}}},
+		{"a,,c", false, true, map[string]interface{}{"tags": []string{"a", "c"}}},
+		{"a,b,c", true, false, map[string]interface{}{"tags_0": "a", "tags_1": "b", "tags_2": "c"}},
+		{"a,,c", true, true, map[string]interface{}{"tags_0": "a", "tags_1": "c"}},
+		{3, true, false, map[string]interface{}{"tags": 3}},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"tags": tst.val}
+		splitList(data, "tags", ",", tst.indexed, tst.dropEmpty)
+		if !reflect.DeepEqual(data, tst.expected) {
+			t.Errorf("splitting %v: expected %+v, got %+v", tst.val, tst.expected, data)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	data := map[string]interface{}{
+		"v4":       "10.0.0.1:54321",
+		"v6":       "[2001:db8::1]:8080",
+		"noport":   "10.0.0.2",
+		"v6noport": "[::1]",
+		"named":    "localhost:http",
+		"garbage":  "not an address",
+		"count":    3,
+	}
+	for _, field := range []string{"v4", "v6", "noport", "v6noport", "named", "garbage", "count", "missing"} {
+		splitHostPort(data, field, false)
+	}
+	expected := map[string]interface{}{
+		"v4":          "10.0.0.1:54321",
+		"v4_ip":       "10.0.0.1",
+		"v4_port":     54321,
+		"v6":          "[2001:db8::1]:8080",
+		"v6_ip":       "2001:db8::1",
+		"v6_port":     8080,
+		"noport":      "10.0.0.2",
+		"noport_ip":   "10.0.0.2",
+		"v6noport":    "[::1]",
+		"v6noport_ip": "::1",
+		"named":       "localhost:http",
+		"named_ip":    "localhost",
+		"named_port":  "http",
+		"garbage":     "not an address",
+		"count":       3,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+
+	data = map[string]interface{}{"client": "10.0.0.1:54321", "garbage": "nope"}
+	splitHostPort(data, "client", true)
+	splitHostPort(data, "garbage", true)
+	expected = map[string]interface{}{"client_ip": "10.0.0.1", "client_port": 54321, "garbage": "nope"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	tsts := []struct {
+		ua                  string
+		browser, os, device string
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36",
+			"Chrome", "Windows", "desktop",
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 12_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.0 Mobile/15E148 Safari/604.1",
+			"Safari", "iOS", "mobile",
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			"Googlebot", "unknown", "bot",
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 8.0.0; SM-T820) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.80 Safari/537.36",
+			"Chrome", "Android", "tablet",
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.14; rv:63.0) Gecko/20100101 Firefox/63.0",
+			"Firefox", "macOS", "desktop",
+		},
+		{"curl/7.54.0", "curl", "unknown", "unknown"},
+		{"", "unknown", "unknown", "unknown"},
+		{"-", "unknown", "unknown", "unknown"},
+	}
+	for _, tst := range tsts {
+		browser, osName, device := parseUserAgent(tst.ua)
+		if browser != tst.browser || osName != tst.os || device != tst.device {
+			t.Errorf("parsing %q: expected %s/%s/%s, got %s/%s/%s",
+				tst.ua, tst.browser, tst.os, tst.device, browser, osName, device)
+		}
+	}
+}
+
+func TestSplitUserAgent(t *testing.T) {
+	data := map[string]interface{}{"ua": "curl/7.54.0", "count": 3}
+	splitUserAgent(data, "ua")
+	splitUserAgent(data, "count")
+	splitUserAgent(data, "missing")
+	expected := map[string]interface{}{
+		"ua":         "curl/7.54.0",
+		"ua_browser": "curl",
+		"ua_os":      "unknown",
+		"ua_device":  "unknown",
+		"count":      3,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestCSVField(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	cf, err := parseCSVField("coords=lat,lon,label")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{"coords": `12.3, -45,"north, mostly"`}
+	cf.split(data, &KeyValLineParser{})
+	expected := map[string]interface{}{
+		"coords": `12.3, -45,"north, mostly"`,
+		"lat":    12.3,
+		"lon":    -45,
+		"label":  "north, mostly",
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+
+	for _, val := range []interface{}{"12.3,45.6", "1,2,3,4", `"unterminated`, 12} {
+		data := map[string]interface{}{"coords": val}
+		cf.split(data, &KeyValLineParser{})
+		if !reflect.DeepEqual(data, map[string]interface{}{"coords": val}) {
+			t.Errorf("expected %v to be left alone, got %+v", val, data)
+		}
+	}
+
+	for _, spec := range []string{"coords", "=lat,lon", "coords=", "coords=lat,,lon"} {
+		if _, err := parseCSVField(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestParseJSONArray(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	tsts := []struct {
+		val      interface{}
+		mode     string
+		expected map[string]interface{}
+	}{
+		{`[1,2,3]`, "array", map[string]interface{}{"ids": []interface{}{1.0, 2.0, 3.0}}},
+		{`["a", {"b": true}]`, "", map[string]interface{}{"ids": []interface{}{"a", map[string]interface{}{"b": true}}}},
+		{`[1,"two",null]`, "indexed", map[string]interface{}{"ids_0": 1.0, "ids_1": "two", "ids_2": nil}},
+		{`[]`, "indexed", map[string]interface{}{}},
+		{`[1,"two",[3]]`, "joined", map[string]interface{}{"ids": `1,two,[3]`}},
+		{`[1,2`, "array", map[string]interface{}{"ids": `[1,2`}},
+		{`{"a":1}`, "joined", map[string]interface{}{"ids": `{"a":1}`}},
+		{`null`, "indexed", map[string]interface{}{"ids": `null`}},
+		{3, "array", map[string]interface{}{"ids": 3}},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"ids": tst.val}
+		parseJSONArray(data, "ids", tst.mode)
+		if !reflect.DeepEqual(data, tst.expected) {
+			t.Errorf("parsing %v in %q mode: expected %+v, got %+v", tst.val, tst.mode, tst.expected, data)
+		}
+	}
+}
+
+func TestSubtractField(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	sf, err := parseSubtractField("duration_ms=end_ts-start_ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsts := []struct {
+		end, start interface{}
+		expected   interface{}
+	}{
+		{1500, 1200, 300},
+		{int64(10), 25, -15},
+		{2.5, 1, 1.5},
+		{int64(1541796000123456789), int64(1541796000000000000), 123456789},
+		{nil, 1200, nil},
+		{1500, "1200", nil},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"end_ts": tst.end, "start_ts": tst.start}
+		if tst.end == nil {
+			delete(data, "end_ts")
+		}
+		sf.subtract(data)
+		if data["duration_ms"] != tst.expected {
+			t.Errorf("%v - %v: expected %v, got %+v", tst.end, tst.start, tst.expected, data)
+		}
+	}
+	for _, spec := range []string{"duration", "=a-b", "d=a", "d=a-", "d=a-b-c"} {
+		if _, err := parseSubtractField(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestComputeField(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	tsts := []struct {
+		spec     string
+		data     map[string]interface{}
+		expected interface{}
+	}{
+		{"error_rate=errors/total*100", map[string]interface{}{"errors": 5, "total": 200}, 2.5},
+		{"area=width*height", map[string]interface{}{"width": 1.5, "height": int64(4)}, 6.0},
+		{"total=a + b - 1", map[string]interface{}{"a": 2, "b": 3}, 4.0},
+		{"left_to_right=a+b*2", map[string]interface{}{"a": 1, "b": 2}, 6.0},
+		{"ms=seconds*1000-5", map[string]interface{}{"seconds": 2}, 1995.0},
+		{"kb=bytes/1024", map[string]interface{}{"bytes": 2048}, 2.0},
+		{"error_rate=errors/total*100", map[string]interface{}{"errors": 5, "total": 0}, nil},
+		{"error_rate=errors/total", map[string]interface{}{"errors": 5}, nil},
+		{"error_rate=errors/total", map[string]interface{}{"errors": 5, "total": "many"}, nil},
+	}
+	for _, tst := range tsts {
+		cf, err := parseComputeField(tst.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf.compute(tst.data)
+		if tst.data[cf.target] != tst.expected {
+			t.Errorf("%s: expected %v, got %+v", tst.spec, tst.expected, tst.data)
+		}
+	}
+	for _, spec := range []string{"rate", "=a/b", "rate=a", "rate=a/", "rate=*b", "rate=a//b", "rate=req-count/total"} {
+		if _, err := parseComputeField(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+	expected := `compute_field "rate=req-count/total": field names can't contain -; put spaces around a - that subtracts (eg req - count)`
+	if _, err := parseComputeField("rate=req-count/total"); err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestTruncateField(t *testing.T) {
+	tsts := []struct {
+		val      interface{}
+		length   int
+		expected interface{}
+	}{
+		{"e3b0c44298fc1c14", 8, "e3b0c442"},
+		{"4111111111111111", -4, "1111"},
+		{"short", 8, "short"},
+		{"short", -8, "short"},
+		{"héllo wörld", 4, "héll"},
+		{"日本語のテキスト", -3, "キスト"},
+		{12345678, 4, 12345678},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"f": tst.val}
+		truncateField(data, "f", tst.length)
+		if data["f"] != tst.expected {
+			t.Errorf("truncating %v to %d: expected %v, got %v", tst.val, tst.length, tst.expected, data["f"])
+		}
+	}
+}
+
+func TestExtractPairs(t *testing.T) {
+	data := map[string]interface{}{
+		"msg":  `processed user=alice in 5ms took=5.2 status=200 query="a b" trailing= bad=="x" user_id=7`,
+		"took": "already here",
+	}
+	extractPairs(data, "msg", "", &KeyValLineParser{})
+	expected := map[string]interface{}{
+		"msg":     data["msg"],
+		"took":    "already here",
+		"user":    "alice",
+		"status":  200,
+		"query":   "a b",
+		"bad":     `="x"`,
+		"user_id": 7,
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+
+	data = map[string]interface{}{"msg": "nothing to see here = really", "n": 3}
+	extractPairs(data, "msg", "msg_", &KeyValLineParser{})
+	extractPairs(data, "n", "msg_", &KeyValLineParser{})
+	expected = map[string]interface{}{"msg": "nothing to see here = really", "n": 3}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+
+	data = map[string]interface{}{"msg": "done user=bob"}
+	extractPairs(data, "msg", "msg_", &KeyValLineParser{})
+	expected = map[string]interface{}{"msg": "done user=bob", "msg_user": "bob"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestCheckUUID(t *testing.T) {
+	data := map[string]interface{}{
+		"valid":    "123e4567-e89b-42d3-a456-426655440000",
+		"upper":    "123E4567-E89B-12D3-A456-426655440000",
+		"nil":      "00000000-0000-0000-0000-000000000000",
+		"short":    "123e4567-e89b-42d3-a456-42665544000",
+		"version":  "123e4567-e89b-72d3-a456-426655440000",
+		"variant":  "123e4567-e89b-42d3-c456-426655440000",
+		"nodashes": "123e4567e89b42d3a456426655440000",
+		"number":   42,
+	}
+	fields := []string{"valid", "upper", "nil", "short", "version", "variant", "nodashes", "number", "missing"}
+	for _, field := range fields {
+		checkUUID(data, field, false)
+	}
+	for field, valid := range map[string]bool{
+		"valid": true, "upper": true, "nil": true,
+		"short": false, "version": false, "variant": false, "nodashes": false, "number": false,
+	} {
+		if data[field+"_valid"] != valid {
+			t.Errorf("expected %s_valid to be %v, got %v", field, valid, data[field+"_valid"])
+		}
+	}
+	if _, ok := data["missing_valid"]; ok {
+		t.Error("expected no missing_valid field for a missing field")
+	}
+
+	data = map[string]interface{}{"good": "123e4567-e89b-42d3-a456-426655440000", "bad": "req-1234"}
+	checkUUID(data, "good", true)
+	checkUUID(data, "bad", true)
+	checkUUID(data, "missing", true)
+	expected := map[string]interface{}{"good": "123e4567-e89b-42d3-a456-426655440000"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestBucketField(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	bf, err := parseBucketField("latency_bucket=latency_ms:10,100:<10ms,10-100ms,>100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsts := []struct {
+		latency  interface{}
+		expected interface{}
+	}{
+		{3, "<10ms"},
+		{-5, "<10ms"},
+		{10, "10-100ms"},
+		{int64(99), "10-100ms"},
+		{99.9, "10-100ms"},
+		{100, ">100ms"},
+		{123456, ">100ms"},
+		{"slow", nil},
+		{nil, nil},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"latency_ms": tst.latency}
+		if tst.latency == nil {
+			delete(data, "latency_ms")
+		}
+		bf.bucket(data)
+		if data["latency_bucket"] != tst.expected {
+			t.Errorf("%v: expected %v, got %+v", tst.latency, tst.expected, data)
+		}
+	}
+	for _, spec := range []string{"bucket", "=a:1:x,y", "b=a:1", "b=a:x:y,z", "b=a:10,1:x,y,z", "b=a:1,2:x,y", ":1:x,y"} {
+		if _, err := parseBucketField(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestHashBucketField(t *testing.T) {
+	hb, err := parseHashBucketField("url=16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		url := fmt.Sprintf("/api/users/%d", i)
+		data := map[string]interface{}{"url": url}
+		hb.bucket(data, false)
+		bucket, ok := data["url_bucket"].(int)
+		if !ok || bucket < 0 || bucket >= 16 {
+			t.Fatalf("%s: expected a bucket from 0 to 15, got %+v", url, data)
+		}
+		if data["url"] != url {
+			t.Errorf("expected the original to be kept, got %+v", data)
+		}
+		// the same value lands in the same bucket every time
+		again := map[string]interface{}{"url": url}
+		hb.bucket(again, true)
+		if again["url_bucket"] != bucket {
+			t.Errorf("%s: landed in bucket %d then %v", url, bucket, again["url_bucket"])
+		}
+		if _, ok := again["url"]; ok {
+			t.Errorf("expected the original to be dropped, got %+v", again)
+		}
+		seen[bucket] = true
+	}
+	if len(seen) != 16 {
+		t.Errorf("expected 1000 urls to use all 16 buckets, used %d", len(seen))
+	}
+
+	hb, err = parseHashBucketField("user_id:user_shard=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{"user_id": 42}
+	hb.bucket(data, false)
+	if _, ok := data["user_shard"].(int); !ok {
+		t.Errorf("expected user_shard to be added, got %+v", data)
+	}
+	for _, spec := range []string{"url", "url=0", "url=-1", "url=many", "=4", ":shard=4", "url:=4"} {
+		if _, err := parseHashBucketField(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestTemplatizePath(t *testing.T) {
+	tsts := []struct {
+		path     string
+		hex      bool
+		expected string
+	}{
+		{"/users/123/orders/456", false, "/users/:id/orders/:id"},
+		{"/users/123/orders/456?page=2", false, "/users/:id/orders/:id"},
+		{"/v2/items/42/", false, "/v2/items/:id/"},
+		{"/api/users/me", false, "/api/users/me"},
+		{"/", false, "/"},
+		{"/sessions/123e4567-e89b-42d3-a456-426655440000", false, "/sessions/123e4567-e89b-42d3-a456-426655440000"},
+		{"/sessions/123E4567-E89B-42D3-A456-426655440000/events", true, "/sessions/:id/events"},
+		{"/commits/5f3a9c1e/files/7", true, "/commits/:id/files/:id"},
+		// hex looking words and short hex stay
+		{"/feeds/deadbeef/cafe12", true, "/feeds/deadbeef/cafe12"},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"path": tst.path}
+		templatizePath(data, "path", tst.hex)
+		if data["path_template"] != tst.expected || data["path"] != tst.path {
+			t.Errorf("%s: expected template %s, got %+v", tst.path, tst.expected, data)
+		}
+	}
+	data := map[string]interface{}{"path": 5}
+	templatizePath(data, "path", false)
+	if _, ok := data["path_template"]; ok {
+		t.Errorf("expected a non-string path to be left alone, got %+v", data)
+	}
+}
+
+func TestSplitCookies(t *testing.T) {
+	tsts := []struct {
+		value    string
+		expected map[string]interface{}
+	}{
+		{"a=1; b=2; session=abc123", map[string]interface{}{"cookie_a": 1, "cookie_b": 2, "cookie_session": "abc123"}},
+		{"a=1;b=2.5", map[string]interface{}{"cookie_a": 1, "cookie_b": 2.5}},
+		{"  a = 1 ;  b=two  ; ", map[string]interface{}{"cookie_a": 1, "cookie_b": "two"}},
+		{`theme="dark"; token=x=y`, map[string]interface{}{"cookie_theme": "dark", "cookie_token": "x=y"}},
+		{"empty=; a=1", map[string]interface{}{"cookie_empty": "", "cookie_a": 1}},
+		// pieces that aren't name=value are left out
+		{"flag; =orphan; a=1", map[string]interface{}{"cookie_a": 1}},
+		{"", map[string]interface{}{}},
+	}
+	for _, tst := range tsts {
+		data := map[string]interface{}{"cookie": tst.value}
+		splitCookies(data, "cookie", &KeyValLineParser{})
+		tst.expected["cookie"] = tst.value
+		if !reflect.DeepEqual(data, tst.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tst.value, tst.expected, data)
+		}
+	}
+	data := map[string]interface{}{"cookie": 5}
+	splitCookies(data, "cookie", &KeyValLineParser{})
+	if len(data) != 1 {
+		t.Errorf("expected a non-string cookie to be left alone, got %+v", data)
+	}
+}
+
+func TestSpecFormErrors(t *testing.T) {
+	tsts := []struct {
+		spec     string
+		parse    func(string) error
+		expected string
+	}{
+		{"level", func(s string) error { _, err := parseLevelField(s); return err },
+			`normalize_level_field "level" must be of the form field=target`},
+		{"=status_class", func(s string) error { _, err := parseStatusClassField(s); return err },
+			`status_class_field "=status_class" must be of the form field=target`},
+		{"path=", func(s string) error { _, err := parseBlockCondition(s); return err },
+			`block_when "path=" must be of the form field=value`},
+		{"ts=", func(s string) error { _, err := parseTruncatedTimeField(s); return err },
+			`add_truncated_time_field "ts=" must be of the form field=unit`},
+		{"user=", func(s string) error { _, err := parseHashBucketField(s); return err },
+			`bucket_hash_field "user=" must be of the form field=buckets`},
+		{"elapsed=end", func(s string) error { _, err := parseSubtractField(s); return err },
+			`subtract_field "elapsed=end" must be of the form target=field-field`},
+		{"id=sha256", func(s string) error { _, err := parseHashedField(s); return err },
+			`hash_combine_field "id=sha256" must be of the form target=algorithm:field,field`},
+	}
+	for _, tst := range tsts {
+		err := tst.parse(tst.spec)
+		if err == nil || err.Error() != tst.expected {
+			t.Errorf("%q: expected error %q, got %v", tst.spec, tst.expected, err)
+		}
+	}
+}
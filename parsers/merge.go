@@ -0,0 +1,34 @@
+package parsers
+
+import (
+	"github.com/honeycombio/honeytail/event"
+)
+
+// MergeByTime reads events from each of ins and sends them to out in
+// timestamp order, closing out once all of ins are closed. Each in must
+// already be in timestamp order; MergeByTime only interleaves them. It waits
+// for every open in to have an event before sending the earliest, so an in
+// with nothing to send holds up the others. Buffering ins lets each one run
+// ahead of the merge by that many events.
+func MergeByTime(out chan<- event.Event, ins ...<-chan event.Event) {
+	defer close(out)
+	// the next event from each in, and whether the in is still open
+	heads := make([]event.Event, len(ins))
+	open := make([]bool, len(ins))
+	for i, in := range ins {
+		heads[i], open[i] = <-in
+	}
+	for {
+		earliest := -1
+		for i := range ins {
+			if open[i] && (earliest == -1 || heads[i].Timestamp.Before(heads[earliest].Timestamp)) {
+				earliest = i
+			}
+		}
+		if earliest == -1 {
+			return
+		}
+		out <- heads[earliest]
+		heads[earliest], open[earliest] = <-ins[earliest]
+	}
+}
@@ -0,0 +1,47 @@
+package parsers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestMergeByTime(t *testing.T) {
+	start := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC)
+	// two files whose lines interleave in time, and an empty one
+	offsets := [][]int{
+		{0, 3, 4, 8, 9},
+		{1, 2, 5, 6, 7, 10},
+		{},
+	}
+	var ins []<-chan event.Event
+	for file, fileOffsets := range offsets {
+		in := make(chan event.Event)
+		go func(file int, fileOffsets []int) {
+			for _, offset := range fileOffsets {
+				in <- event.Event{
+					Timestamp: start.Add(time.Duration(offset) * time.Second),
+					Data:      map[string]interface{}{"file": file},
+				}
+			}
+			close(in)
+		}(file, fileOffsets)
+		ins = append(ins, in)
+	}
+	out := make(chan event.Event)
+	go MergeByTime(out, ins...)
+
+	var merged []event.Event
+	for ev := range out {
+		merged = append(merged, ev)
+	}
+	if len(merged) != 11 {
+		t.Fatalf("expected 11 events, got %d", len(merged))
+	}
+	for i, ev := range merged {
+		if expected := start.Add(time.Duration(i) * time.Second); !ev.Timestamp.Equal(expected) {
+			t.Errorf("event %d: expected timestamp %v, got %v", i, expected, ev.Timestamp)
+		}
+	}
+}
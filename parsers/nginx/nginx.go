@@ -2,6 +2,7 @@
 package nginx
 
 import (
+	"errors"
 	"os"
 	"strconv"
 	"strings"
@@ -24,6 +25,7 @@ const (
 type Options struct {
 	ConfigFile      string `long:"conf" description:"Path to Nginx config file"`
 	LogFormatName   string `long:"format" description:"Log format name to look for in the Nginx config file"`
+	LogFormat       string `long:"log_format" description:"Log format to parse with, written as in an Nginx log_format directive (eg '$remote_addr - $remote_user [$time_local] \"$request\" $status'). Use instead of conf and format"`
 	TimeFieldName   string `long:"timefield" description:"Name of the field that contains a timestamp"`
 	TimeFieldFormat string `long:"time_format" description:"Timestamp format to use (strftime and Golang time.Parse supported)"`
 
@@ -38,6 +40,16 @@ type Parser struct {
 func (n *Parser) Init(options interface{}) error {
 	n.conf = *options.(*Options)
 
+	if n.conf.LogFormat != "" {
+		if n.conf.ConfigFile != "" {
+			return errors.New("log_format and conf can't be used together")
+		}
+		n.lineParser = &GonxLineParser{
+			parser: gonx.NewParser(n.conf.LogFormat),
+		}
+		return nil
+	}
+
 	// Verify we've got our config, find our format
 	nginxConfig, err := os.Open(string(n.conf.ConfigFile))
 	if err != nil {
@@ -100,6 +112,12 @@ func (n *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 				for k, v := range prefixFields {
 					parsedLine[k] = v
 				}
+				if parsers.AllEmpty(parsedLine) {
+					logrus.WithFields(logrus.Fields{
+						"line": line,
+					}).Debug("skipping line; no non-empty fields found.")
+					continue
+				}
 				timestamp := n.getTimestamp(parsedLine)
 
 				e := event.Event{
@@ -118,6 +118,67 @@ func TestProcessLinesNoPreReg(t *testing.T) {
 	}
 }
 
+func TestInitLogFormat(t *testing.T) {
+	t1, _ := time.ParseInLocation(commonLogFormatTimeLayout, "08/Oct/2015:00:26:26 +0000", time.UTC)
+	tsts := []struct {
+		format string
+		line   string
+		ev     event.Event
+	}{
+		{
+			format: `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+			line:   `10.252.4.24 - alice [08/Oct/2015:00:26:26 +0000] "GET /index.html HTTP/1.1" 200 174 "-" "curl/7.43.0"`,
+			ev: event.Event{
+				Timestamp: t1,
+				Data: map[string]interface{}{
+					"remote_addr":     "10.252.4.24",
+					"remote_user":     "alice",
+					"request":         "GET /index.html HTTP/1.1",
+					"status":          int64(200),
+					"body_bytes_sent": int64(174),
+					"http_user_agent": "curl/7.43.0",
+				},
+			},
+		},
+		{
+			format: `$remote_addr [$time_local] "$request" $status $request_time $upstream_addr cache=$upstream_cache_status`,
+			line:   `10.252.4.24 [08/Oct/2015:00:26:26 +0000] "POST /api HTTP/2.0" 502 1.250 10.0.0.7:8080 cache=MISS`,
+			ev: event.Event{
+				Timestamp: t1,
+				Data: map[string]interface{}{
+					"remote_addr":           "10.252.4.24",
+					"request":               "POST /api HTTP/2.0",
+					"status":                int64(502),
+					"request_time":          1.25,
+					"upstream_addr":         "10.0.0.7:8080",
+					"upstream_cache_status": "MISS",
+				},
+			},
+		},
+	}
+	for _, tst := range tsts {
+		p := &Parser{}
+		if err := p.Init(&Options{LogFormat: tst.format, NumParsers: 1}); err != nil {
+			t.Fatal(err)
+		}
+		lines := make(chan string, 1)
+		send := make(chan event.Event, 1)
+		lines <- tst.line
+		close(lines)
+		p.ProcessLines(lines, send, nil)
+		resp := <-send
+		if !reflect.DeepEqual(resp, tst.ev) {
+			t.Errorf("line resp didn't match up for %s. Expected: %v, actual: %v",
+				tst.line, tst.ev, resp)
+		}
+	}
+
+	p := &Parser{}
+	if err := p.Init(&Options{LogFormat: "$status", ConfigFile: "nginx.conf"}); err == nil {
+		t.Error("expected an error using log_format with conf")
+	}
+}
+
 type typeifyTestCase struct {
 	untyped map[string]string
 	typed   map[string]interface{}
@@ -18,3 +18,22 @@ type Parser interface {
 type LineParser interface {
 	ParseLine(line string) (map[string]interface{}, error)
 }
+
+// AllEmpty returns true if all values in the map are the empty string. An
+// empty map is also considered all empty. Parsers use this to avoid sending
+// events that carry no content, which usually indicates a broken line.
+func AllEmpty(pl map[string]interface{}) bool {
+	for _, v := range pl {
+		vStr, ok := v.(string)
+		if !ok {
+			// wouldn't coerce to string, so it must have something that's not an
+			// empty string
+			return false
+		}
+		if vStr != "" {
+			return false
+		}
+	}
+	// we've gone through the entire map and every field value has matched ""
+	return true
+}
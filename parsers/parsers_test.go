@@ -0,0 +1,72 @@
+package parsers
+
+import "testing"
+
+func TestAllEmpty(t *testing.T) {
+	tsts := []struct {
+		incoming map[string]interface{}
+		empty    bool
+	}{
+		{
+			map[string]interface{}{
+				"k1": "v1",
+			},
+			false,
+		},
+		{
+			map[string]interface{}{
+				"k1": 3,
+			},
+			false,
+		},
+		{
+			map[string]interface{}{
+				"k1": []string{"foo", "bar"},
+			},
+			false,
+		},
+		{
+			map[string]interface{}{
+				"k1": "",
+				"k2": "v2",
+			},
+			false,
+		},
+		{
+			map[string]interface{}{
+				"k1": "",
+				"k2": false,
+			},
+			false,
+		},
+		{
+			map[string]interface{}{},
+			true,
+		},
+		{
+			nil,
+			true,
+		},
+		{
+			map[string]interface{}{
+				"k1": "",
+			},
+			true,
+		},
+		{
+			map[string]interface{}{
+				"k1": "",
+				"k2": "",
+				"k3": "",
+			},
+			true,
+		},
+	}
+	for _, tst := range tsts {
+		res := AllEmpty(tst.incoming)
+		if res != tst.empty {
+			t.Errorf("expected %v's empty val would be %v, got %v",
+				tst.incoming, tst.empty, res)
+		}
+	}
+}
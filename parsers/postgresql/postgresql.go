@@ -71,7 +71,7 @@ const (
 	slowQueryHeader = `\s*(?P<level>[A-Z0-9]+):\s+duration: (?P<duration>[0-9\.]+) ms\s+statement: `
 )
 
-var slowQueryHeaderRegex = &parsers.ExtRegexp{regexp.MustCompile(slowQueryHeader)}
+var slowQueryHeaderRegex = parsers.NewExtRegexp(regexp.MustCompile(slowQueryHeader))
 
 // prefixField represents a specific format specifier in the log_line_prefix string
 // (see module comment for details).
@@ -290,5 +290,5 @@ func buildPrefixRegexp(prefixFormat string) (*parsers.ExtRegexp, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &parsers.ExtRegexp{re}, nil
+	return parsers.NewExtRegexp(re), nil
 }
@@ -0,0 +1,59 @@
+// Package preset registers parsers for common log formats that otherwise
+// need a hand written regex, so they can be picked by name with --parser
+package preset
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+func init() {
+	register("python_logging", pythonLogging)
+	register("go_log", goLog)
+}
+
+// pythonLogging is the format of Python's logging module with the format
+// from its documentation, '%(asctime)s - %(name)s - %(levelname)s - %(message)s'
+// (eg 2023-01-02 15:04:05,123 - app.db - WARNING - slow query). The message
+// may itself contain " - ".
+var pythonLogging = regexp.MustCompile(`^(?P<time>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) - (?P<logger>.+?) - (?P<level>[A-Z]+|Level \d+) - (?P<message>.*)$`)
+
+// goLog is the format of Go's standard log package, a date and time with
+// optional microseconds (log.Lmicroseconds), then an optional file:line
+// (log.Lshortfile or log.Llongfile), then the message (eg 2009/01/23
+// 01:23:23 main.go:42: started)
+var goLog = regexp.MustCompile(`^(?P<time>\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d{6})?) (?:(?P<file>\S+\.go):(?P<line>\d+): )?(?P<message>.*)$`)
+
+// register makes a parser that uses re's named groups as the fields of each
+// event available as name
+func register(name string, re *regexp.Regexp) {
+	lineParser := &regexLineParser{&parsers.ExtRegexp{Regexp: re}}
+	err := parsers.Register(name, func() (parsers.LineParser, error) {
+		return lineParser, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// regexLineParser parses lines into the named groups of a regex, leaving
+// out optional groups that don't match anything
+type regexLineParser struct {
+	re *parsers.ExtRegexp
+}
+
+func (r *regexLineParser) ParseLine(line string) (map[string]interface{}, error) {
+	match, captures := r.re.FindStringSubmatchMap(line)
+	if match == "" {
+		return nil, errors.New("line doesn't match the format")
+	}
+	parsed := make(map[string]interface{}, len(captures))
+	for k, v := range captures {
+		if v != "" {
+			parsed[k] = v
+		}
+	}
+	return parsed, nil
+}
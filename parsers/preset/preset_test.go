@@ -0,0 +1,82 @@
+package preset
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// parse runs lines through the parser registered as name
+func parse(t *testing.T, name string, lines ...string) []event.Event {
+	p := &parsers.RegisteredParser{Name: name}
+	if err := p.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan string)
+	out := make(chan event.Event, len(lines))
+	go func() {
+		for _, line := range lines {
+			in <- line
+		}
+		close(in)
+	}()
+	p.ProcessLines(in, out, nil)
+	close(out)
+	var evs []event.Event
+	for ev := range out {
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+func TestPythonLogging(t *testing.T) {
+	httime.Location = time.UTC
+	evs := parse(t, "python_logging",
+		"2023-01-02 15:04:05,123 - app.db - WARNING - slow query - took 5s to fetch users",
+		"2023-01-02 15:04:06,000 - root - INFO - started",
+		"started without a timestamp",
+	)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := []map[string]interface{}{
+		{"logger": "app.db", "level": "WARNING", "message": "slow query - took 5s to fetch users"},
+		{"logger": "root", "level": "INFO", "message": "started"},
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+	}
+	if ts := time.Date(2023, 1, 2, 15, 4, 5, 123000000, time.UTC); !evs[0].Timestamp.Equal(ts) {
+		t.Errorf("expected timestamp %v, got %v", ts, evs[0].Timestamp)
+	}
+}
+
+func TestGoLog(t *testing.T) {
+	httime.Location = time.UTC
+	evs := parse(t, "go_log",
+		"2009/01/23 01:23:23 started serving on :8080",
+		"2009/01/23 01:23:23.123456 /src/app/main.go:42: request failed: EOF",
+		"01:23:23 no date",
+	)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	expected := []map[string]interface{}{
+		{"message": "started serving on :8080"},
+		{"file": "/src/app/main.go", "line": "42", "message": "request failed: EOF"},
+	}
+	for i, ev := range evs {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+	}
+	if ts := time.Date(2009, 1, 23, 1, 23, 23, 123456000, time.UTC); !evs[1].Timestamp.Equal(ts) {
+		t.Errorf("expected timestamp %v, got %v", ts, evs[1].Timestamp)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package parsers
+
+// raceEnabled is set when testing with the race detector, which allocates in
+// ways that throw off allocation counts
+const raceEnabled = true
@@ -171,10 +171,10 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 					parsedLine[k] = v
 				}
 
-				if len(parsedLine) == 0 {
+				if parsers.AllEmpty(parsedLine) {
 					logrus.WithFields(logrus.Fields{
 						"line": line,
-					}).Debug("Skipping line; no capture groups found")
+					}).Debug("Skipping line; no non-empty capture groups found")
 					continue
 				}
 
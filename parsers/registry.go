@@ -0,0 +1,135 @@
+package parsers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+)
+
+// LineParserFactory makes a new LineParser. It is called once for each source
+// of lines, and a LineParser it makes is used from several goroutines at once.
+type LineParserFactory func() (LineParser, error)
+
+var registry = struct {
+	sync.Mutex
+	factories map[string]LineParserFactory
+}{factories: make(map[string]LineParserFactory)}
+
+// Register makes the LineParsers made by factory available under name, so
+// they can be picked with --parser like the built in parsers, eg from the
+// init function of a package compiled in to honeytail. Built in parsers take
+// precedence over registered ones with the same name. Registering a name twice
+// is an error.
+func Register(name string, factory LineParserFactory) error {
+	registry.Lock()
+	defer registry.Unlock()
+	if name == "" || factory == nil {
+		return fmt.Errorf("registering a parser needs a name and a factory")
+	}
+	if _, ok := registry.factories[name]; ok {
+		return fmt.Errorf("a parser named %s is already registered", name)
+	}
+	registry.factories[name] = factory
+	return nil
+}
+
+// Lookup returns the factory registered under name, if there is one
+func Lookup(name string) (LineParserFactory, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	factory, ok := registry.factories[name]
+	return factory, ok
+}
+
+// Registered returns the names of the registered parsers, sorted
+func Registered() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RegisteredParser is a Parser that parses lines with a LineParser from the
+// registry. The event's timestamp is taken from whichever of the usual time
+// fields the LineParser returns, if any.
+type RegisteredParser struct {
+	// Name is the name the LineParser was registered under
+	Name string
+	// NumParsers is how many goroutines parse lines; at least one is used
+	NumParsers int
+
+	lineParser LineParser
+}
+
+// Init makes the LineParser. Registered parsers have no options of their own,
+// so options is ignored.
+func (p *RegisteredParser) Init(options interface{}) error {
+	factory, ok := Lookup(p.Name)
+	if !ok {
+		return fmt.Errorf("no parser named %s is registered", p.Name)
+	}
+	lineParser, err := factory()
+	if err != nil {
+		return fmt.Errorf("making the %s parser: %s", p.Name, err)
+	}
+	p.lineParser = lineParser
+	return nil
+}
+
+func (p *RegisteredParser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *ExtRegexp) {
+	numParsers := p.NumParsers
+	if numParsers < 1 {
+		numParsers = 1
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < numParsers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lines {
+				// take care of any headers on the line
+				var prefixFields map[string]string
+				if prefixRegex != nil {
+					var prefix string
+					prefix, prefixFields = prefixRegex.FindStringSubmatchMap(line)
+					line = strings.TrimPrefix(line, prefix)
+				}
+				parsedLine, err := p.lineParser.ParseLine(line)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"line":   line,
+						"parser": p.Name,
+						"error":  err,
+					}).Debug("skipping line; failed to parse.")
+					continue
+				}
+				if AllEmpty(parsedLine) {
+					logrus.WithFields(logrus.Fields{
+						"line": line,
+					}).Debug("skipping line; no non-empty values found.")
+					continue
+				}
+				timestamp := httime.GetTimestamp(parsedLine, "", "")
+				for k, v := range prefixFields {
+					parsedLine[k] = v
+				}
+				send <- event.Event{
+					Timestamp: timestamp,
+					Data:      parsedLine,
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	logrus.WithField("parser", p.Name).Debug("lines channel is closed, ending registered parser")
+}
@@ -0,0 +1,81 @@
+package parsers
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// pipeParser parses lines like key|val|key|val
+type pipeParser struct{}
+
+func (pipeParser) ParseLine(line string) (map[string]interface{}, error) {
+	parts := strings.Split(line, "|")
+	if len(parts)%2 != 0 {
+		return nil, errors.New("odd number of parts")
+	}
+	parsed := make(map[string]interface{})
+	for i := 0; i < len(parts); i += 2 {
+		parsed[parts[i]] = parts[i+1]
+	}
+	return parsed, nil
+}
+
+func TestRegisteredParser(t *testing.T) {
+	if err := Register("pipe", func() (LineParser, error) { return pipeParser{}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("pipe", func() (LineParser, error) { return pipeParser{}, nil }); err == nil {
+		t.Error("expected an error registering pipe twice")
+	}
+	if err := Register("failing", func() (LineParser, error) { return nil, errors.New("no config") }); err != nil {
+		t.Fatal(err)
+	}
+	names := Registered()
+	if !sort.StringsAreSorted(names) || len(names) < 2 {
+		t.Errorf("expected the registered names sorted, got %q", names)
+	}
+
+	p := &RegisteredParser{Name: "pipe", NumParsers: 2}
+	if err := p.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	send := make(chan event.Event, 10)
+	go func() {
+		lines <- "web-1 time|2017-11-10T19:57:38Z|user|alice"
+		lines <- "odd|parts|here"
+		lines <- "a|"
+		close(lines)
+	}()
+	p.ProcessLines(lines, send, &ExtRegexp{Regexp: regexp.MustCompile(`^(?P<host>\S+) `)})
+	close(send)
+	var evs []event.Event
+	for ev := range send {
+		evs = append(evs, ev)
+	}
+	if len(evs) != 1 {
+		t.Fatalf("expected 1 event, got %+v", evs)
+	}
+	// the time field becomes the timestamp
+	expected := map[string]interface{}{"host": "web-1", "user": "alice"}
+	if !reflect.DeepEqual(evs[0].Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, evs[0].Data)
+	}
+	if ts := time.Date(2017, 11, 10, 19, 57, 38, 0, time.UTC); !evs[0].Timestamp.Equal(ts) {
+		t.Errorf("expected timestamp %s, got %s", ts, evs[0].Timestamp)
+	}
+
+	if err := (&RegisteredParser{Name: "failing"}).Init(nil); err == nil {
+		t.Error("expected an error when the factory fails")
+	}
+	if err := (&RegisteredParser{Name: "missing"}).Init(nil); err == nil {
+		t.Error("expected an error initializing an unregistered parser")
+	}
+}
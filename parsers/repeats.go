@@ -0,0 +1,68 @@
+package parsers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/httime"
+)
+
+// RepeatedErrorLog logs lines that failed to parse, collapsing runs of the
+// same error so a broken upstream doesn't flood the log. The first error of a
+// run is logged as usual; identical errors after it are only counted, and
+// logged as a "(repeated N times)" summary at most once per Window, when a
+// different error arrives, or on Flush. It is safe for concurrent use.
+type RepeatedErrorLog struct {
+	Window time.Duration
+
+	lock sync.Mutex
+	last string
+	// repeats is how many times last has been seen since it was last logged
+	repeats int
+	since   time.Time
+}
+
+// ParseError logs that line failed to parse with err
+func (r *RepeatedErrorLog) ParseError(line string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := httime.Now()
+	if err.Error() == r.last {
+		r.repeats++
+		if now.Sub(r.since) >= r.Window {
+			r.summarize(now)
+		}
+		return
+	}
+	r.summarize(now)
+	logrus.WithFields(logrus.Fields{
+		"line":  line,
+		"error": err,
+	}).Debug("skipping line; failed to parse.")
+	r.last = err.Error()
+	r.since = now
+}
+
+// Flush logs the summary of any repeats not yet reported, eg once there are
+// no more lines to parse
+func (r *RepeatedErrorLog) Flush() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.summarize(httime.Now())
+}
+
+// summarize needs the lock held
+func (r *RepeatedErrorLog) summarize(now time.Time) {
+	if r.repeats == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"error":   r.last,
+		"repeats": r.repeats,
+	}).Debug(fmt.Sprintf("skipping line; failed to parse. (repeated %d times)", r.repeats))
+	r.repeats = 0
+	r.since = now
+}
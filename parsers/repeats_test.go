@@ -0,0 +1,61 @@
+package parsers
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/httime/httimetest"
+)
+
+func TestRepeatedErrorLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logrus.SetOutput(buf)
+	logrus.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetLevel(logrus.InfoLevel)
+	}()
+	nower := &httimetest.FakeNower{}
+	start := nower.Now()
+	httime.DefaultNower = nower
+	defer func() { httime.DefaultNower = &httime.RealNower{} }()
+
+	r := &RepeatedErrorLog{Window: time.Second}
+	broken := errors.New("unterminated quote")
+	for i := 0; i < 1000; i++ {
+		r.ParseError("line", broken)
+	}
+	// the next window's repeats are summarized when they start
+	nower.FakeNow = start.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		r.ParseError("line", broken)
+	}
+	r.ParseError("other line", errors.New("something else"))
+	r.ParseError("other line", errors.New("something else"))
+	r.Flush()
+	r.Flush()
+
+	var msgs []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		msg := l[strings.Index(l, `msg="`)+len(`msg="`):]
+		msgs = append(msgs, msg[:strings.Index(msg, `"`)])
+	}
+	expected := []string{
+		"skipping line; failed to parse.",
+		"skipping line; failed to parse. (repeated 1000 times)",
+		"skipping line; failed to parse. (repeated 9 times)",
+		"skipping line; failed to parse.",
+		"skipping line; failed to parse. (repeated 1 times)",
+	}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("got messages %q, expected %q", msgs, expected)
+	}
+}
@@ -0,0 +1,52 @@
+package parsers
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// SubParsers parses the values of fields with LineParsers from the registry,
+// by the field they're for
+type SubParsers map[string]LineParser
+
+// NewSubParsers makes the LineParsers for a sub_parse option, a map of field
+// names to the names they're registered under. option names the option in
+// errors.
+func NewSubParsers(fields map[string]string, option string) (SubParsers, error) {
+	subParsers := make(SubParsers, len(fields))
+	for field, name := range fields {
+		factory, ok := Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("%s %s: no parser named %s is registered", option, field, name)
+		}
+		lineParser, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: making the %s parser: %s", option, field, name, err)
+		}
+		subParsers[field] = lineParser
+	}
+	return subParsers, nil
+}
+
+// Parse replaces the value of each field that has a LineParser with what the
+// LineParser makes of it, nested under the field. Values that aren't strings
+// or won't parse are left alone.
+func (s SubParsers) Parse(data map[string]interface{}) {
+	for field, lineParser := range s {
+		val, ok := data[field].(string)
+		if !ok {
+			continue
+		}
+		parsed, err := lineParser.ParseLine(val)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"field": field,
+				"value": val,
+				"error": err,
+			}).Warn("failed to sub-parse field; leaving it alone")
+			continue
+		}
+		data[field] = parsed
+	}
+}
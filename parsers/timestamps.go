@@ -0,0 +1,32 @@
+package parsers
+
+import (
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// timestampNudge is how far apart DistinctTimestamps spaces events that
+// arrived with the same timestamp
+const timestampNudge = time.Microsecond
+
+// DistinctTimestamps sends the events it reads from in to out, closing out
+// once in is closed. An event whose timestamp isn't after the one the event
+// before it was sent with, but isn't before that event's own timestamp either,
+// is moved timestampNudge after the one sent. So events that arrive in order
+// go out with strictly increasing timestamps, even when nudging a run of
+// identical timestamps catches up with the next one. Events that arrive out of
+// order are sent as they are.
+func DistinctTimestamps(in <-chan event.Event, out chan<- event.Event) {
+	defer close(out)
+	var prev, sent time.Time
+	for ev := range in {
+		ts := ev.Timestamp
+		if !ts.IsZero() && !ts.Before(prev) && !ts.After(sent) {
+			ev.Timestamp = sent.Add(timestampNudge)
+		}
+		prev = ts
+		sent = ev.Timestamp
+		out <- ev
+	}
+}
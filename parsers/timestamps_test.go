@@ -0,0 +1,53 @@
+package parsers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestDistinctTimestamps(t *testing.T) {
+	start := time.Date(2017, 11, 23, 19, 57, 38, 0, time.UTC)
+	in := make(chan event.Event)
+	out := make(chan event.Event)
+	go DistinctTimestamps(in, out)
+	go func() {
+		// a run of identical seconds, then a new second, then a run that the
+		// nudging catches up with
+		offsets := []time.Duration{0, 0, 0, 0, time.Second, time.Second, 2 * time.Second, 2 * time.Second, 2*time.Second + timestampNudge}
+		for _, offset := range offsets {
+			in <- event.Event{Timestamp: start.Add(offset)}
+		}
+		// an event from the past is left alone
+		in <- event.Event{Timestamp: start}
+		close(in)
+	}()
+	expected := []time.Time{
+		start,
+		start.Add(timestampNudge),
+		start.Add(2 * timestampNudge),
+		start.Add(3 * timestampNudge),
+		start.Add(time.Second),
+		start.Add(time.Second + timestampNudge),
+		start.Add(2 * time.Second),
+		start.Add(2*time.Second + timestampNudge),
+		start.Add(2*time.Second + 2*timestampNudge),
+		start,
+	}
+	var got []time.Time
+	for ev := range out {
+		got = append(got, ev.Timestamp)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(got))
+	}
+	for i := range got {
+		if !got[i].Equal(expected[i]) {
+			t.Errorf("event %d: expected timestamp %v, got %v", i, expected[i], got[i])
+		}
+		if i > 0 && i < len(got)-1 && !got[i].After(got[i-1]) {
+			t.Errorf("event %d: timestamp %v isn't after %v", i, got[i], got[i-1])
+		}
+	}
+}
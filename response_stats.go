@@ -3,6 +3,7 @@ package main
 import (
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -30,6 +31,10 @@ type responseStats struct {
 
 	totalCount       int
 	totalStatusCodes map[int]int
+
+	// linesShed counts lines dropped by full tail backlogs before they were
+	// parsed. It's updated by the tailers, so is read atomically.
+	linesShed *int64
 }
 
 // newResponseStats initializes the struct's complex data types
@@ -37,6 +42,7 @@ func newResponseStats() *responseStats {
 	r := &responseStats{}
 	r.totalStatusCodes = make(map[int]int)
 	r.lock = &sync.Mutex{}
+	r.linesShed = new(int64)
 	r.reset()
 	return r
 }
@@ -91,6 +97,7 @@ func (r *responseStats) log() {
 		"count_per_status": r.statusCodes,
 		"response_bodies":  r.bodies,
 		"errors":           r.errors,
+		"lines_shed":       atomic.LoadInt64(r.linesShed),
 	}).Info("Summary of sent events")
 	if r.event != nil {
 		fields := make(map[string]interface{})
@@ -111,6 +118,7 @@ func (r *responseStats) logFinal() {
 	logrus.WithFields(logrus.Fields{
 		"total attempted sends":               r.totalCount,
 		"number sent by response status code": r.totalStatusCodes,
+		"lines shed by a full backlog":        atomic.LoadInt64(r.linesShed),
 	}).Info("Total number of events sent")
 }
 
@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// jsonEvent is the representation of an event.Event written by JSONFile
+type jsonEvent struct {
+	Timestamp  time.Time              `json:"time"`
+	SampleRate int                    `json:"samplerate,omitempty"`
+	Dataset    string                 `json:"dataset,omitempty"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// JSONFile writes events to a file as one line of JSON per event. It is safe
+// to call Write from multiple goroutines.
+type JSONFile struct {
+	lock sync.Mutex
+	fh   *os.File
+	buf  *bufio.Writer
+	enc  *json.Encoder
+}
+
+// NewJSONFile opens path for appending and returns a JSONFile writing to it
+func NewJSONFile(path string) (*JSONFile, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(fh)
+	return &JSONFile{
+		fh:  fh,
+		buf: buf,
+		enc: json.NewEncoder(buf),
+	}, nil
+}
+
+// Write writes ev to the file as a line of JSON. The timestamp is written in
+// RFC3339 format with nanoseconds.
+func (j *JSONFile) Write(ev event.Event) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.enc.Encode(jsonEvent{
+		Timestamp:  ev.Timestamp,
+		SampleRate: ev.SampleRate,
+		Dataset:    ev.Dataset,
+		Data:       ev.Data,
+	})
+}
+
+// Close flushes any buffered events and closes the file
+func (j *JSONFile) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.buf.Flush(); err != nil {
+		j.fh.Close()
+		return err
+	}
+	return j.fh.Close()
+}
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestJSONFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "events.json")
+
+	js, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2017, 11, 10, 19, 57, 38, 123456789, time.UTC)
+	// write from several goroutines at once
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			err := js.Write(event.Event{
+				Timestamp:  ts.Add(time.Duration(i) * time.Second),
+				SampleRate: 2,
+				Data:       map[string]interface{}{"n": i, "str": "val"},
+			})
+			assert.Nil(t, err)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, js.Close())
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	seen := make(map[int]bool)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var ev struct {
+			Timestamp  string                 `json:"time"`
+			SampleRate int                    `json:"samplerate"`
+			Data       map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("line %q isn't valid json: %s", scanner.Text(), err)
+		}
+		n := int(ev.Data["n"].(float64))
+		seen[n] = true
+		expectedTs := ts.Add(time.Duration(n) * time.Second).Format(time.RFC3339Nano)
+		assert.Equal(t, expectedTs, ev.Timestamp)
+		assert.Equal(t, 2, ev.SampleRate)
+		assert.Equal(t, "val", ev.Data["str"])
+	}
+	assert.Equal(t, 10, len(seen))
+}
+
+func TestJSONFileBadPath(t *testing.T) {
+	_, err := NewJSONFile("/does/not/exist/events.json")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,450 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// msgpackTimestampExt is the MessagePack extension type for timestamps, -1
+const msgpackTimestampExt = 0xff
+
+// MsgpackFile writes events to a file in MessagePack, which is smaller and
+// cheaper to produce than JSON. Each event is a map with the keys time,
+// samplerate, data and, if it has one, dataset, preceded by its length in
+// bytes as a 4 byte big-endian integer. Read the file back with a
+// MsgpackReader. It is safe to call Write from multiple goroutines.
+type MsgpackFile struct {
+	lock sync.Mutex
+	fh   *os.File
+	buf  *bufio.Writer
+}
+
+// NewMsgpackFile opens path for appending and returns a MsgpackFile writing
+// to it
+func NewMsgpackFile(path string) (*MsgpackFile, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &MsgpackFile{
+		fh:  fh,
+		buf: bufio.NewWriter(fh),
+	}, nil
+}
+
+// Write writes ev to the file. Values in ev.Data of types MessagePack has no
+// equivalent for are written as strings, and time.Time values as timestamps.
+// Map keys that aren't strings are written as strings too, so a nested
+// map[int]string comes back from a MsgpackReader keyed by "1", "2" and so on.
+func (m *MsgpackFile) Write(ev event.Event) error {
+	fields := map[string]interface{}{
+		"time":       ev.Timestamp,
+		"samplerate": ev.SampleRate,
+		"data":       ev.Data,
+	}
+	if ev.Dataset != "" {
+		fields["dataset"] = ev.Dataset
+	}
+	record := &bytes.Buffer{}
+	encodeMsgpack(record, fields)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := binary.Write(m.buf, binary.BigEndian, uint32(record.Len())); err != nil {
+		return err
+	}
+	_, err := m.buf.Write(record.Bytes())
+	return err
+}
+
+// Close flushes any buffered events and closes the file
+func (m *MsgpackFile) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.buf.Flush(); err != nil {
+		m.fh.Close()
+		return err
+	}
+	return m.fh.Close()
+}
+
+// MsgpackReader reads back the events written by a MsgpackFile
+type MsgpackReader struct {
+	r io.Reader
+}
+
+// NewMsgpackReader returns a MsgpackReader reading events from r
+func NewMsgpackReader(r io.Reader) *MsgpackReader {
+	return &MsgpackReader{r: r}
+}
+
+// Read returns the next event, or io.EOF once there are no more. Integers
+// are returned as int64 (or uint64 if too big for one), floats as float64,
+// arrays as []interface{} and maps as map[string]interface{}.
+func (m *MsgpackReader) Read() (event.Event, error) {
+	var length uint32
+	if err := binary.Read(m.r, binary.BigEndian, &length); err != nil {
+		return event.Event{}, err
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(m.r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return event.Event{}, err
+	}
+	d := &msgpackDecoder{buf: record}
+	val, err := d.decode()
+	if err != nil {
+		return event.Event{}, err
+	}
+	fields, ok := val.(map[string]interface{})
+	if !ok {
+		return event.Event{}, errors.New("msgpack record is not a map")
+	}
+	ev := event.Event{}
+	if ev.Timestamp, ok = fields["time"].(time.Time); !ok {
+		return event.Event{}, errors.New("msgpack record has no timestamp")
+	}
+	if sampleRate, ok := fields["samplerate"].(int64); ok {
+		ev.SampleRate = int(sampleRate)
+	}
+	ev.Dataset, _ = fields["dataset"].(string)
+	if ev.Data, ok = fields["data"].(map[string]interface{}); !ok && fields["data"] != nil {
+		return event.Event{}, errors.New("msgpack record's data is not a map")
+	}
+	return ev, nil
+}
+
+// encodeMsgpack appends the MessagePack encoding of v to buf. Map keys are
+// always encoded as strings, with fmt.Sprint if they aren't one.
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+		return
+	case time.Time:
+		// timestamp 96: nanoseconds as a uint32 then seconds as an int64
+		buf.Write([]byte{0xc7, 12, msgpackTimestampExt})
+		binary.Write(buf, binary.BigEndian, uint32(val.Nanosecond()))
+		binary.Write(buf, binary.BigEndian, val.Unix())
+		return
+	case []byte:
+		writeMsgpackLen(buf, len(val), 0xc4, 0xc5, 0xc6)
+		buf.Write(val)
+		return
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeMsgpackInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encodeMsgpackUint(buf, rv.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(rv.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(rv.Float()))
+	case reflect.String:
+		s := rv.String()
+		if len(s) < 32 {
+			buf.WriteByte(0xa0 | byte(len(s)))
+		} else {
+			writeMsgpackLen(buf, len(s), 0xd9, 0xda, 0xdb)
+		}
+		buf.WriteString(s)
+	case reflect.Slice, reflect.Array:
+		if rv.Len() < 16 {
+			buf.WriteByte(0x90 | byte(rv.Len()))
+		} else {
+			writeMsgpackLen(buf, rv.Len(), 0, 0xdc, 0xdd)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			encodeMsgpack(buf, rv.Index(i).Interface())
+		}
+	case reflect.Map:
+		if rv.Len() < 16 {
+			buf.WriteByte(0x80 | byte(rv.Len()))
+		} else {
+			writeMsgpackLen(buf, rv.Len(), 0, 0xde, 0xdf)
+		}
+		for _, key := range rv.MapKeys() {
+			encodeMsgpack(buf, fmt.Sprint(key.Interface()))
+			encodeMsgpack(buf, rv.MapIndex(key).Interface())
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			buf.WriteByte(0xc0)
+		} else {
+			encodeMsgpack(buf, rv.Elem().Interface())
+		}
+	default:
+		encodeMsgpack(buf, fmt.Sprint(v))
+	}
+}
+
+// writeMsgpackLen writes the smallest of the 8, 16 and 32 bit headers that
+// fits n. Types with no 8 bit header pass 0 for h8.
+func writeMsgpackLen(buf *bytes.Buffer, n int, h8, h16, h32 byte) {
+	switch {
+	case n <= math.MaxUint8 && h8 != 0:
+		buf.Write([]byte{h8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(h16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(h32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0:
+		encodeMsgpackUint(buf, uint64(n))
+	case n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(int8(n))})
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeMsgpackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 128:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// msgpackDecoder decodes the MessagePack values in buf in turn
+type msgpackDecoder struct {
+	buf []byte
+}
+
+var errMsgpackShort = errors.New("msgpack record ends in the middle of a value")
+
+// next returns the next n bytes of buf
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n > len(d.buf) {
+		return nil, errMsgpackShort
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), bin...), nil
+	case 0xc7:
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(int(n))
+	case 0xd6:
+		return d.decodeExt(4)
+	case 0xd7:
+		return d.decodeExt(8)
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("unsupported msgpack type 0x%x", c)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	// every element takes at least a byte, so a length that can't fit in
+	// what's left is a short record rather than something to allocate for
+	if n < 0 || n > len(d.buf) {
+		return nil, errMsgpackShort
+	}
+	arr := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		val, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, val)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	// and every entry at least two
+	if n < 0 || n > len(d.buf)/2 {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		val, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(key)] = val
+	}
+	return m, nil
+}
+
+// decodeExt decodes an extension value of n bytes. Only timestamps are
+// supported.
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	typ, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	if typ[0] != msgpackTimestampExt {
+		return nil, fmt.Errorf("unsupported msgpack extension type %d", int8(typ[0]))
+	}
+	switch n {
+	case 4:
+		secs, err := d.uint(4)
+		return time.Unix(int64(secs), 0).UTC(), err
+	case 8:
+		// 30 bits of nanoseconds then 34 bits of seconds
+		n, err := d.uint(8)
+		return time.Unix(int64(n&(1<<34-1)), int64(n>>34)).UTC(), err
+	case 12:
+		nsecs, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		secs, err := d.uint(8)
+		return time.Unix(int64(secs), int64(nsecs)).UTC(), err
+	}
+	return nil, fmt.Errorf("invalid msgpack timestamp length %d", n)
+}
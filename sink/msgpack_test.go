@@ -0,0 +1,128 @@
+package sink
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestMsgpackFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "events.msgpack")
+
+	ts := time.Date(2017, 11, 10, 19, 57, 38, 123456789, time.UTC)
+	evs := []event.Event{
+		{
+			Timestamp:  ts,
+			SampleRate: 2,
+			Dataset:    "access",
+			Data: map[string]interface{}{
+				"str":      "val",
+				"long_str": strings.Repeat("x", 300),
+				"small":    int64(7),
+				"negative": int64(-1000),
+				"big":      int64(math.MaxInt64),
+				"float":    1.5,
+				"bool":     true,
+				"nil":      nil,
+				"list":     []interface{}{"a", int64(1)},
+				"nested":   map[string]interface{}{"k": "v"},
+				"time":     ts.Add(time.Hour),
+			},
+		},
+		{
+			Timestamp: ts.Add(-50 * 365 * 24 * time.Hour),
+			Data:      map[string]interface{}{},
+		},
+	}
+	ms, err := NewMsgpackFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range evs {
+		assert.Nil(t, ms.Write(ev))
+	}
+	assert.Nil(t, ms.Close())
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	r := NewMsgpackReader(fh)
+	for _, expected := range evs {
+		ev, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected.Timestamp, ev.Timestamp)
+		assert.Equal(t, expected.SampleRate, ev.SampleRate)
+		assert.Equal(t, expected.Dataset, ev.Dataset)
+		assert.Equal(t, expected.Data, ev.Data)
+	}
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMsgpackEncodeTypes(t *testing.T) {
+	// go types msgpack has no separate equivalent for decode to the widest
+	// type of their kind
+	tsts := []struct {
+		in, out interface{}
+	}{
+		{int(-5), int64(-5)},
+		{int32(-70000), int64(-70000)},
+		{uint8(200), int64(200)},
+		{uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{float32(0.5), 0.5},
+		{[]string{"a", "b"}, []interface{}{"a", "b"}},
+		{map[string]int{"a": 1}, map[string]interface{}{"a": int64(1)}},
+		{[]byte("raw"), []byte("raw")},
+		{time.Second, int64(time.Second)},
+		{struct{ A int }{1}, "{1}"},
+	}
+	for _, tst := range tsts {
+		buf := &bytes.Buffer{}
+		encodeMsgpack(buf, tst.in)
+		d := &msgpackDecoder{buf: buf.Bytes()}
+		out, err := d.decode()
+		assert.Nil(t, err)
+		assert.Equal(t, tst.out, out, "encoding %#v", tst.in)
+		assert.Equal(t, 0, len(d.buf), "encoding %#v left bytes over", tst.in)
+	}
+}
+
+func TestMsgpackReaderTruncated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	encodeMsgpack(buf, map[string]interface{}{"time": time.Now()})
+	record := buf.Bytes()
+	// a length prefix promising more than there is
+	r := NewMsgpackReader(bytes.NewReader(append([]byte{0, 0, 0, byte(len(record) + 1)}, record...)))
+	_, err := r.Read()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// array and map lengths promising more than there is
+	for _, record := range [][]byte{
+		{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01},
+		{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'a'},
+		{0x82, 0xa1, 'a', 0x01},
+	} {
+		d := &msgpackDecoder{buf: record}
+		_, err := d.decode()
+		assert.Equal(t, errMsgpackShort, err, "decoding %x", record)
+	}
+}
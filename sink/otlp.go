@@ -0,0 +1,273 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+)
+
+// otlpBatchSize is how many log records OTLPLogs sends in one request
+const otlpBatchSize = 100
+
+// otlpQueuedBatches is how many full batches OTLPLogs holds while waiting to
+// send them. More are dropped rather than holding up the caller.
+const otlpQueuedBatches = 10
+
+// otlpFlushInterval is how long OTLPLogs holds on to log records before
+// sending a partial batch. It's a var so tests can shorten it.
+var otlpFlushInterval = time.Second
+
+// OTLPLogs sends events as OpenTelemetry log records to an OTLP/HTTP endpoint,
+// using the JSON encoding. Each field of the event becomes an attribute of the
+// record, and the event's timestamp its time; its observed time is when it was
+// written. Records are sent in batches, in the background so a slow or
+// unreachable endpoint doesn't hold up the other outputs; batches that can't
+// be queued or fail to send are dropped and reported by Close. It is safe to
+// call Write from multiple goroutines.
+type OTLPLogs struct {
+	// dropped counts the batches and records that were dropped. They're
+	// accessed atomically, so come first to be 64 bit aligned on 32 bit
+	// platforms.
+	droppedBatches int64
+	droppedRecords int64
+
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+
+	lock    sync.Mutex
+	pending []otlpLogRecord
+	batches chan []otlpLogRecord
+	done    chan struct{}
+	flushWG sync.WaitGroup
+	sendWG  sync.WaitGroup
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+}
+
+// NewOTLPLogs returns an OTLPLogs sending to endpoint, eg
+// http://localhost:4318/v1/logs, with headers added to each request
+func NewOTLPLogs(endpoint string, headers map[string]string) *OTLPLogs {
+	o := &OTLPLogs{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		batches:  make(chan []otlpLogRecord, otlpQueuedBatches),
+		done:     make(chan struct{}),
+	}
+	o.sendWG.Add(1)
+	go func() {
+		defer o.sendWG.Done()
+		for records := range o.batches {
+			if err := o.send(records); err != nil {
+				logrus.WithField("error", err).Error("Unexpected error sending OTLP log records")
+				o.drop(records)
+			}
+		}
+	}()
+	// send partial batches so quiet logs don't sit around unsent
+	o.flushWG.Add(1)
+	go func() {
+		defer o.flushWG.Done()
+		ticker := time.NewTicker(otlpFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.flush()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+	return o
+}
+
+// Write adds ev to the batch being built, queueing the batch to be sent if it
+// is full
+func (o *OTLPLogs) Write(ev event.Event) error {
+	record := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(ev.Timestamp.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(httime.Now().UnixNano(), 10),
+		Attributes:           otlpAttributes(ev.Data),
+	}
+	o.lock.Lock()
+	o.pending = append(o.pending, record)
+	full := len(o.pending) >= otlpBatchSize
+	o.lock.Unlock()
+	if full {
+		o.flush()
+	}
+	return nil
+}
+
+// Close sends any records still waiting to go, and returns an error if any
+// were dropped
+func (o *OTLPLogs) Close() error {
+	close(o.done)
+	o.flushWG.Wait()
+	// the last batch waits for room rather than being dropped
+	o.lock.Lock()
+	records := o.pending
+	o.pending = nil
+	o.lock.Unlock()
+	if len(records) > 0 {
+		o.batches <- records
+	}
+	close(o.batches)
+	o.sendWG.Wait()
+	if batches := atomic.LoadInt64(&o.droppedBatches); batches > 0 {
+		return fmt.Errorf("dropped %d batches of log records (%d records) for %s",
+			batches, atomic.LoadInt64(&o.droppedRecords), o.endpoint)
+	}
+	return nil
+}
+
+// flush queues the pending records to be sent, if there are any, dropping
+// them if the queue is full
+func (o *OTLPLogs) flush() {
+	o.lock.Lock()
+	records := o.pending
+	o.pending = nil
+	o.lock.Unlock()
+	if len(records) == 0 {
+		return
+	}
+	select {
+	case o.batches <- records:
+	default:
+		// only warn on the first drop; Close reports the total
+		if o.drop(records) == 1 {
+			logrus.WithField("endpoint", o.endpoint).Warn(
+				"Sending OTLP log records is falling behind; dropping batches")
+		}
+	}
+}
+
+// drop counts records as dropped, returning the number of batches dropped so
+// far
+func (o *OTLPLogs) drop(records []otlpLogRecord) int64 {
+	atomic.AddInt64(&o.droppedRecords, int64(len(records)))
+	return atomic.AddInt64(&o.droppedBatches, 1)
+}
+
+// send posts records to the endpoint
+func (o *OTLPLogs) send(records []otlpLogRecord) error {
+	payload := map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue("honeytail")}},
+				},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]interface{}{"name": "honeytail"},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sending %d log records to %s: %s", len(records), o.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// otlpAttributes turns data into a list of attributes, sorted by key
+func otlpAttributes(data map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		attrs[i] = otlpKeyValue{Key: k, Value: otlpValue(data[k])}
+	}
+	return attrs
+}
+
+// otlpValue turns v into the JSON encoding of an OTLP AnyValue. 64 bit
+// integers are encoded as strings, as protobuf's JSON mapping has them.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch val := v.(type) {
+	case nil:
+		return map[string]interface{}{}
+	case string:
+		return map[string]interface{}{"stringValue": val}
+	case bool:
+		return map[string]interface{}{"boolValue": val}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(val), 10)}
+	case int32:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(val), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+	case uint:
+		return map[string]interface{}{"intValue": strconv.FormatUint(uint64(val), 10)}
+	case uint64:
+		return map[string]interface{}{"intValue": strconv.FormatUint(val, 10)}
+	case float32:
+		return map[string]interface{}{"doubleValue": float64(val)}
+	case float64:
+		return map[string]interface{}{"doubleValue": val}
+	case time.Time:
+		return map[string]interface{}{"stringValue": val.Format(time.RFC3339Nano)}
+	case []interface{}:
+		values := make([]map[string]interface{}, len(val))
+		for i, elem := range val {
+			values[i] = otlpValue(elem)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case []string:
+		values := make([]map[string]interface{}, len(val))
+		for i, elem := range val {
+			values[i] = otlpValue(elem)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case map[string]interface{}:
+		return map[string]interface{}{"kvlistValue": map[string]interface{}{"values": otlpAttributes(val)}}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
@@ -0,0 +1,168 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/httime/httimetest"
+)
+
+func TestOTLPLogs(t *testing.T) {
+	nower := &httimetest.FakeNower{}
+	httime.DefaultNower = nower
+	defer func() { httime.DefaultNower = &httime.RealNower{} }()
+
+	var lock sync.Mutex
+	var bodies [][]byte
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, body)
+		headers = append(headers, r.Header)
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	o := NewOTLPLogs(server.URL+"/v1/logs", map[string]string{"x-honeycomb-team": "abc123"})
+	ts := time.Date(2017, 11, 10, 19, 57, 38, 123456789, time.UTC)
+	assert.Nil(t, o.Write(event.Event{
+		Timestamp: ts,
+		Data: map[string]interface{}{
+			"msg":      "hello",
+			"status":   200,
+			"duration": 1.5,
+			"ok":       true,
+			"tags":     []interface{}{"a", int64(1)},
+			"nested":   map[string]interface{}{"k": "v"},
+			"missing":  nil,
+		},
+	}))
+	assert.Nil(t, o.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !assert.Len(t, bodies, 1) {
+		return
+	}
+	assert.Equal(t, "application/json", headers[0].Get("Content-Type"))
+	assert.Equal(t, "abc123", headers[0].Get("X-Honeycomb-Team"))
+	var payload struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					TimeUnixNano         string                   `json:"timeUnixNano"`
+					ObservedTimeUnixNano string                   `json:"observedTimeUnixNano"`
+					Attributes           []map[string]interface{} `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(bodies[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	records := payload.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if !assert.Len(t, records, 1) {
+		return
+	}
+	assert.Equal(t, "1510343858123456789", records[0].TimeUnixNano)
+	assert.Equal(t, strconv.FormatInt(nower.Now().UnixNano(), 10), records[0].ObservedTimeUnixNano)
+	expected := []map[string]interface{}{
+		{"key": "duration", "value": map[string]interface{}{"doubleValue": 1.5}},
+		{"key": "missing", "value": map[string]interface{}{}},
+		{"key": "msg", "value": map[string]interface{}{"stringValue": "hello"}},
+		{"key": "nested", "value": map[string]interface{}{"kvlistValue": map[string]interface{}{"values": []interface{}{
+			map[string]interface{}{"key": "k", "value": map[string]interface{}{"stringValue": "v"}},
+		}}}},
+		{"key": "ok", "value": map[string]interface{}{"boolValue": true}},
+		{"key": "status", "value": map[string]interface{}{"intValue": "200"}},
+		{"key": "tags", "value": map[string]interface{}{"arrayValue": map[string]interface{}{"values": []interface{}{
+			map[string]interface{}{"stringValue": "a"},
+			map[string]interface{}{"intValue": "1"},
+		}}}},
+	}
+	assert.Equal(t, expected, records[0].Attributes)
+}
+
+func TestOTLPLogsReportsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	o := NewOTLPLogs(server.URL, nil)
+	assert.Nil(t, o.Write(event.Event{Timestamp: time.Now(), Data: map[string]interface{}{"a": "b"}}))
+	assert.NotNil(t, o.Close())
+}
+
+func TestOTLPLogsDoesNotHoldUpOtherSinks(t *testing.T) {
+	defer func(d time.Duration) { otlpFlushInterval = d }(otlpFlushInterval)
+	otlpFlushInterval = time.Hour
+	// a collector that accepts connections and doesn't answer until released
+	arrived := make(chan struct{}, 100)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	js, err := NewJSONFile(filepath.Join(tmpdir, "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOTLPLogs(server.URL, nil)
+
+	// write to both outputs, one after the other, as leash does, waiting for
+	// the first batch to get stuck before writing the rest
+	const numEvents = 30 * otlpBatchSize
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < numEvents; i++ {
+			if i == otlpBatchSize {
+				<-arrived
+			}
+			ev := event.Event{Timestamp: time.Now(), Data: map[string]interface{}{"n": i}}
+			for _, s := range []Sink{o, js} {
+				assert.Nil(t, s.Write(ev))
+			}
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing stalled behind the OTLP endpoint")
+	}
+	assert.Nil(t, js.Close())
+	contents, err := ioutil.ReadFile(filepath.Join(tmpdir, "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, numEvents, bytes.Count(contents, []byte("\n")))
+
+	// one batch is stuck being sent and otlpQueuedBatches wait behind it; the
+	// rest are dropped, and Close says so once the collector lets go
+	close(release)
+	err = o.Close()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "dropped 19 batches of log records (1900 records)")
+	}
+}
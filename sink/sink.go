@@ -0,0 +1,13 @@
+// Package sink contains outputs other than Honeycomb to which events can be
+// written, eg for local validation of parser configs.
+package sink
+
+import (
+	"github.com/honeycombio/honeytail/event"
+)
+
+// Sink is an output events can be written to
+type Sink interface {
+	Write(ev event.Event) error
+	Close() error
+}
@@ -0,0 +1,85 @@
+package tail
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// shed policies for when a backlog is full
+const (
+	ShedDropOldest = "drop_oldest"
+	ShedDropNewest = "drop_newest"
+	ShedBlock      = "block"
+)
+
+func validShedPolicy(policy string) error {
+	switch policy {
+	case ShedDropOldest, ShedDropNewest, ShedBlock:
+		return nil
+	}
+	return fmt.Errorf("unknown option to --tail.shed_policy: %s", policy)
+}
+
+// backlogLines reads lines as fast as they arrive and holds up to size of
+// them until the returned channel's reader is ready, so a reader that falls
+// behind doesn't make memory grow without bound. When the backlog is full the
+// policy decides what happens to the next line: drop_oldest makes room by
+// dropping the oldest line waiting, drop_newest drops the new line, and block
+// stops reading until there's room. Every dropped line is added to shed. Lines
+// still waiting when lines closes are sent before the returned channel closes.
+func backlogLines(lines chan string, size int, policy string, file string, shed *int64) chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		// a ring of the waiting lines, from head
+		ring := make([]string, size)
+		head, waiting := 0, 0
+		in := lines
+		for in != nil || waiting > 0 {
+			var send chan string
+			var next string
+			if waiting > 0 {
+				send, next = out, ring[head]
+			}
+			receive := in
+			if waiting == size && policy == ShedBlock {
+				receive = nil
+			}
+			select {
+			case line, ok := <-receive:
+				if !ok {
+					in = nil
+					continue
+				}
+				if waiting == size {
+					if atomic.AddInt64(shed, 1) == 1 {
+						logrus.WithFields(logrus.Fields{
+							"file":        file,
+							"max_backlog": size,
+						}).Warn("Backlog of lines to parse is full; shedding lines")
+					}
+					if policy == ShedDropNewest {
+						continue
+					}
+					head = (head + 1) % size
+					waiting--
+				}
+				ring[(head+waiting)%size] = line
+				waiting++
+			case send <- next:
+				ring[head] = ""
+				head = (head + 1) % size
+				waiting--
+			}
+		}
+		if n := atomic.LoadInt64(shed); n > 0 {
+			logrus.WithFields(logrus.Fields{
+				"file": file,
+				"shed": n,
+			}).Warn("Lines were shed because the backlog of lines to parse was full")
+		}
+	}()
+	return out
+}
@@ -0,0 +1,105 @@
+package tail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestBacklogLines(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	var all []string
+	for i := 0; i < 1000; i++ {
+		all = append(all, fmt.Sprint(i))
+	}
+	tsts := []struct {
+		policy   string
+		expected []string
+		shed     int64
+	}{
+		// the reader takes one line and sleeps on it, so it's one ahead of
+		// the 10 waiting
+		{ShedDropOldest, append([]string{all[0]}, all[990:]...), 989},
+		{ShedDropNewest, all[:11], 989},
+		{ShedBlock, all, 0},
+	}
+	for _, tst := range tsts {
+		in := make(chan string)
+		var shed int64
+		out := backlogLines(in, 10, tst.policy, "file", &shed)
+		// a parser that's stuck on its first line until everything has
+		// been written, or until the writer blocks with the block policy
+		in <- all[0]
+		got := []string{<-out}
+		done := make(chan struct{})
+		go func() {
+			for _, line := range all[1:] {
+				in <- line
+			}
+			close(in)
+			close(done)
+		}()
+		if tst.policy == ShedBlock {
+			select {
+			case <-done:
+				t.Fatalf("block: wrote every line while the reader was stuck")
+			case <-time.After(50 * time.Millisecond):
+			}
+		} else {
+			<-done
+		}
+		for line := range out {
+			got = append(got, line)
+		}
+		if !reflect.DeepEqual(got, tst.expected) {
+			t.Errorf("%s: got %d lines %q, expected %q", tst.policy, len(got), got, tst.expected)
+		}
+		if n := atomic.LoadInt64(&shed); n != tst.shed {
+			t.Errorf("%s: shed %d lines, expected %d", tst.policy, n, tst.shed)
+		}
+	}
+}
+
+func TestGetEntriesCountsShed(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	filename := ts.tmpdir + "/shed.log"
+	ts.writeFile(t, filename, "one\ntwo\nthree\nfour\n")
+	var shed int64
+	conf := Config{
+		Paths:   []string{filename},
+		Options: TailOptions{ReadFrom: "beginning", Stop: true, MaxBacklog: 1, ShedPolicy: ShedDropNewest},
+		Shed:    &shed,
+	}
+	lineChans, err := GetEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with nobody reading, the first line waits and the rest are shed
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&shed) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	checkLinesChan(t, lineChans[0], []string{"one"})
+	if n := atomic.LoadInt64(&shed); n != 3 {
+		t.Errorf("expected 3 lines shed, got %d", n)
+	}
+}
+
+func TestGetEntriesShedPolicy(t *testing.T) {
+	conf := Config{Paths: []string{"-"}, Options: TailOptions{MaxBacklog: 10, ShedPolicy: "drop_some"}}
+	if _, err := GetEntries(context.Background(), conf); err == nil || err.Error() != "unknown option to --tail.shed_policy: drop_some" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
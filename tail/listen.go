@@ -0,0 +1,116 @@
+package tail
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ListenTCP accepts connections on addr and sends each line received on any
+// of them down the returned channel, along with the address it is listening
+// on (useful when addr has port 0). When ctx is cancelled the listener and any
+// open connections are closed, followed by the channel.
+func ListenTCP(ctx context.Context, addr string) (chan string, net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		conns := sync.WaitGroup{}
+		defer conns.Wait()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					// eg out of file descriptors; wait for some to free up
+					logrus.WithField("error", err).Warn("failed to accept a connection; retrying")
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				logrus.WithField("error", err).Error("failed to accept a connection; no longer listening")
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				// tailReader's lines close on ctx cancellation, which gets us
+				// to close the connection it's blocked reading from
+				defer conn.Close()
+				for line := range tailReader(ctx, conn, 0, '\n') {
+					select {
+					case lines <- line:
+					case <-ctx.Done():
+					}
+				}
+			}()
+		}
+	}()
+	return lines, ln.Addr(), nil
+}
+
+// maxDatagramSize is the most of a datagram ListenUDP keeps; enough for any
+// UDP payload. It's a var so tests can lower it.
+var maxDatagramSize = 65535
+
+// ListenUDP reads datagrams sent to addr, eg by devices sending syslog, and
+// sends each one down the returned channel as a line, without any trailing
+// newline. Datagrams longer than maxDatagramSize are truncated. It also
+// returns the address it is listening on (useful when addr has port 0). When
+// ctx is cancelled the socket is closed, followed by the channel.
+func ListenUDP(ctx context.Context, addr string) (chan string, net.Addr, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		// one byte spare to tell when a datagram didn't fit
+		buf := make([]byte, maxDatagramSize+1)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				logrus.WithField("error", err).Error("failed to read a datagram; no longer listening")
+				return
+			}
+			if n > maxDatagramSize {
+				logrus.WithFields(logrus.Fields{
+					"from":     from.String(),
+					"max_size": maxDatagramSize,
+				}).Warn("datagram too long; truncating it")
+				n = maxDatagramSize
+			}
+			line := strings.TrimSuffix(string(buf[:n]), "\n")
+			line = strings.TrimSuffix(line, "\r")
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return lines, conn.LocalAddr(), nil
+}
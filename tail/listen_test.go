@@ -0,0 +1,123 @@
+package tail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestListenTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines, addr, err := ListenTCP(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lines from several clients all arrive, whichever order they're sent in
+	for _, payload := range []string{"a=1\nb=2\r\n", "c=3\npartial=4"} {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, payload)
+		conn.Close()
+	}
+	var got []string
+	for len(got) < 4 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines; got %q", got)
+		}
+	}
+	sort.Strings(got)
+	expected := []string{"a=1", "b=2", "c=3", "partial=4"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected lines %q, got %q", expected, got)
+	}
+
+	// a connection that's still open doesn't hold up shutting down
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "d=5\n")
+	if line := <-lines; line != "d=5" {
+		t.Errorf("expected d=5, got %q", line)
+	}
+	cancel()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Error("expected lines to be closed after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for lines to close")
+	}
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Error("expected the listener to be closed after cancelling")
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(os.Stderr)
+	defer func(max int) { maxDatagramSize = max }(maxDatagramSize)
+	maxDatagramSize = 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines, addr, err := ListenUDP(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	datagrams := []string{
+		"<34>Oct 11 22:14:15 host su: failed",
+		"a=1\n",
+		"b=2\r\n",
+		"two\nlines",
+	}
+	expected := []string{
+		"<34>Oct 11 22:14",
+		"a=1",
+		"b=2",
+		"two\nlines",
+	}
+	for i, datagram := range datagrams {
+		fmt.Fprint(conn, datagram)
+		select {
+		case line := <-lines:
+			if line != expected[i] {
+				t.Errorf("sent %q, expected %q, got %q", datagram, expected[i], line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", datagram)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Error("expected lines to be closed after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for lines to close")
+	}
+}
@@ -0,0 +1,262 @@
+package tail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// newestPollInterval is how often tailNewest checks for more lines and for a
+// newer file once it has read everything. It's a var so tests can shorten it.
+var newestPollInterval = 250 * time.Millisecond
+
+// rotationNumber is the number at the end of a rotated file's name, eg 3 for
+// app.log.3. Files without one come out highest, as the file being written
+// to in app.log, app.log.1, ... style rotation.
+func rotationNumber(name string) int64 {
+	base := filepath.Base(name)
+	digits := len(base)
+	for digits > 0 && base[digits-1] >= '0' && base[digits-1] <= '9' {
+		digits--
+	}
+	n, err := strconv.ParseInt(base[digits:], 10, 64)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return n
+}
+
+// newer reports whether file a is newer than file b: modified more recently
+// or, if they were modified at the same time, with the higher rotation number
+func newer(aName string, a os.FileInfo, bName string, b os.FileInfo) bool {
+	if !a.ModTime().Equal(b.ModTime()) {
+		return a.ModTime().After(b.ModTime())
+	}
+	return rotationNumber(aName) > rotationNumber(bName)
+}
+
+// newestFile returns the newest of the files matching pattern, skipping
+// statefiles
+func newestFile(pattern string, conf Config) (string, os.FileInfo, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	var newestName string
+	var newestInfo os.FileInfo
+	for _, file := range removeStateFiles(files, conf) {
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if newestInfo == nil || newer(file, info, newestName, newestInfo) {
+			newestName, newestInfo = file, info
+		}
+	}
+	if newestInfo == nil {
+		return "", nil, errors.New("no files match " + pattern)
+	}
+	return newestName, newestInfo, nil
+}
+
+// newestStart works out which file tailNewest starts with and where in it.
+// read_from last looks for the file recorded in stateFile among those
+// matching pattern, so a file that has been rotated since is picked up
+// where it was left. As with a single file, a missing statefile means the
+// end of the newest file and a recorded file that's gone means its start.
+func newestStart(conf Config, pattern string, stateFile string) (string, int64, error) {
+	name, info, err := newestFile(pattern, conf)
+	if err != nil {
+		return "", 0, err
+	}
+	switch conf.Options.ReadFrom {
+	case "start", "beginning":
+		return name, 0, nil
+	case "end":
+		return name, info.Size(), nil
+	case "last":
+	default:
+		return "", 0, fmt.Errorf("unknown option to --read_from: %s", conf.Options.ReadFrom)
+	}
+	state, err := readStateFile(stateFile)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"starting at": "end", "error": err,
+		}).Debug("follow_newest failed to read the statefile")
+		return name, info.Size(), nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, file := range removeStateFiles(files, conf) {
+		logStat := unix.Stat_t{}
+		if unix.Stat(file, &logStat) != nil || logStat.Ino != state.INode {
+			continue
+		}
+		if state.Offset > logStat.Size {
+			// truncated since; whatever's there now is new
+			return file, 0, nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"file": file, "starting at": state.Offset,
+		}).Debug("follow_newest resuming from the statefile")
+		return file, state.Offset, nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"starting at": "beginning",
+	}).Debug("follow_newest found no file with the statefile's inode number")
+	return name, 0, nil
+}
+
+// tailNewest follows the newest of the files matching pattern, for apps
+// that write to one file of a numbered set at a time. When a newer file
+// appears the current one is read to the end and the newer one is read from
+// the start. Files are followed by the descriptor honeytail has open, so
+// lines written to a file after it is renamed by rotation aren't lost. The
+// file and the position reached are saved to stateFile once a second.
+func tailNewest(ctx context.Context, conf Config, pattern string, stateFile string) (chan string, error) {
+	name, offset, err := newestStart(conf, pattern, stateFile)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	stateFh, err := os.OpenFile(stateFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"logfile":   pattern,
+			"statefile": stateFile,
+		}).Warn("Failed to open statefile for writing. File location will not be saved.")
+	}
+	// state is where the lines sent so far end, shared with the ticker that
+	// saves it
+	var stateMu sync.Mutex
+	state := State{INode: inode(fh), Offset: offset}
+	saveState := func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		writeStateFile(&state, stateFh)
+	}
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		for range ticker.C {
+			saveState()
+		}
+	}()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		defer func() {
+			ticker.Stop()
+			saveState()
+			stateFh.Close()
+			fh.Close()
+		}()
+		reader := bufio.NewReader(fh)
+		var partial string
+		send := func(line string) bool {
+			select {
+			case lines <- strings.TrimSpace(line):
+				stateMu.Lock()
+				state.Offset += int64(len(line))
+				stateMu.Unlock()
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// readToEnd sends every complete line up to the end of the file
+		readToEnd := func() bool {
+			for {
+				line, err := reader.ReadString('\n')
+				partial += line
+				if err != nil {
+					return true
+				}
+				if !send(partial) {
+					return false
+				}
+				partial = ""
+			}
+		}
+		for {
+			if !readToEnd() {
+				return
+			}
+			next, nextInfo, err := newestFile(pattern, conf)
+			current, statErr := fh.Stat()
+			if err == nil && statErr == nil && !os.SameFile(nextInfo, current) &&
+				newer(next, nextInfo, name, current) {
+				// pick up anything written since we last looked before
+				// moving on
+				if !readToEnd() {
+					return
+				}
+				if partial != "" && !send(partial) {
+					return
+				}
+				partial = ""
+				nextFh, err := os.Open(next)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"file":  next,
+						"error": err,
+					}).Warn("failed to open the newest file; will try again")
+				} else {
+					logrus.WithFields(logrus.Fields{
+						"from": name,
+						"to":   next,
+					}).Debug("moving on to a newer file")
+					fh.Close()
+					fh, name = nextFh, next
+					reader.Reset(fh)
+					stateMu.Lock()
+					state = State{INode: inode(fh), Offset: 0}
+					stateMu.Unlock()
+					continue
+				}
+			}
+			if conf.Options.Stop {
+				if partial != "" {
+					send(partial)
+				}
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(newestPollInterval):
+			}
+		}
+	}()
+	return lines, nil
+}
+
+// inode returns the inode number of the open file fh, or 0 if it can't be
+// had
+func inode(fh *os.File) uint64 {
+	logStat := unix.Stat_t{}
+	if err := unix.Fstat(int(fh.Fd()), &logStat); err != nil {
+		return 0
+	}
+	return logStat.Ino
+}
@@ -0,0 +1,179 @@
+package tail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expectLines reads len(expected) lines from lines and checks they match
+func expectLines(t *testing.T, lines chan string, expected ...string) {
+	var got []string
+	for len(got) < len(expected) {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("lines closed early; got %q, expected %q", got, expected)
+			}
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out; got %q, expected %q", got, expected)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// appendTo appends text to path and sets its modification time to mtime
+func appendTo(t *testing.T, path, text string, mtime time.Time) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(fh, text)
+	fh.Close()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailNewestNumbered(t *testing.T) {
+	defer func(d time.Duration) { newestPollInterval = d }(newestPollInterval)
+	newestPollInterval = 10 * time.Millisecond
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "newest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	start := time.Now().Add(-time.Hour)
+
+	// an app that moves on to app.log.N+1, leaving the older files behind
+	appendTo(t, filepath.Join(tmpdir, "app.log.1"), "old\n", start)
+	appendTo(t, filepath.Join(tmpdir, "app.log.2"), "first\n", start.Add(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf := Config{Options: TailOptions{ReadFrom: "beginning", FollowNewest: true}}
+	lines, err := tailNewest(ctx, conf, filepath.Join(tmpdir, "app.log*"), filepath.Join(tmpdir, "app.leash.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, lines, "first")
+
+	// the last lines of one file and the start of the next, written before
+	// honeytail gets a look in, all arrive in order
+	appendTo(t, filepath.Join(tmpdir, "app.log.2"), "second\n", start.Add(2*time.Minute))
+	appendTo(t, filepath.Join(tmpdir, "app.log.3"), "third\n", start.Add(2*time.Minute))
+	expectLines(t, lines, "second", "third")
+
+	// logrotate style: app.log.3 is renamed away while honeytail has it
+	// open, and is written to once more before a new app.log is started
+	writer, err := os.OpenFile(filepath.Join(tmpdir, "app.log.3"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(tmpdir, "app.log.3"), filepath.Join(tmpdir, "app.log.4.old")); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(writer, "fourth\n")
+	writer.Close()
+	os.Chtimes(filepath.Join(tmpdir, "app.log.4.old"), start.Add(3*time.Minute), start.Add(3*time.Minute))
+	appendTo(t, filepath.Join(tmpdir, "app.log"), "fifth\n", start.Add(4*time.Minute))
+	expectLines(t, lines, "fourth", "fifth")
+
+	cancel()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Error("expected lines to be closed after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for lines to close")
+	}
+}
+
+func TestTailNewestStop(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "newest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	now := time.Now()
+	appendTo(t, filepath.Join(tmpdir, "app.log.1"), "older\n", now.Add(-time.Minute))
+	// same modification time; the unnumbered file is the one being written
+	appendTo(t, filepath.Join(tmpdir, "app.log.2"), "old\n", now)
+	appendTo(t, filepath.Join(tmpdir, "app.log"), "current\npartial", now)
+	conf := Config{Options: TailOptions{ReadFrom: "beginning", Stop: true, FollowNewest: true}}
+	lines, err := tailNewest(context.Background(), conf, filepath.Join(tmpdir, "app.log*"), filepath.Join(tmpdir, "app.leash.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, lines, "current", "partial")
+	if _, ok := <-lines; ok {
+		t.Error("expected lines to be closed at the end of the file")
+	}
+
+	if _, err := tailNewest(context.Background(), conf, filepath.Join(tmpdir, "missing*"), filepath.Join(tmpdir, "missing.leash.state")); err == nil {
+		t.Error("expected an error when no files match")
+	}
+}
+
+func TestTailNewestResumesFromStateFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "newest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	pattern := filepath.Join(tmpdir, "app.log*")
+	stateFile := filepath.Join(tmpdir, "app.leash.state")
+	start := time.Now().Add(-time.Hour)
+	appendTo(t, filepath.Join(tmpdir, "app.log.1"), "first\nsecond\n", start)
+	// readAll runs honeytail over the files until it reaches the end
+	readAll := func(readFrom string) []string {
+		conf := Config{Options: TailOptions{ReadFrom: readFrom, Stop: true, FollowNewest: true}}
+		lines, err := tailNewest(context.Background(), conf, pattern, stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for line := range lines {
+			got = append(got, line)
+		}
+		return got
+	}
+
+	// without a statefile, last starts at the end
+	if got := readAll("last"); len(got) != 0 {
+		t.Errorf("expected no lines, got %q", got)
+	}
+	appendTo(t, filepath.Join(tmpdir, "app.log.1"), "third\n", start.Add(time.Minute))
+	if got := readAll("last"); !reflect.DeepEqual(got, []string{"third"}) {
+		t.Errorf("expected the line written since, got %q", got)
+	}
+
+	// the file is written to and rotated away, and a newer one started,
+	// while honeytail isn't running
+	appendTo(t, filepath.Join(tmpdir, "app.log.1"), "fourth\n", start.Add(2*time.Minute))
+	if err := os.Rename(filepath.Join(tmpdir, "app.log.1"), filepath.Join(tmpdir, "app.log.old")); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(t, filepath.Join(tmpdir, "app.log.2"), "fifth\n", start.Add(3*time.Minute))
+	if got := readAll("last"); !reflect.DeepEqual(got, []string{"fourth", "fifth"}) {
+		t.Errorf("expected to pick up in the rotated file, got %q", got)
+	}
+
+	// and once the file honeytail was reading is gone, the newest is read
+	// from the start
+	appendTo(t, filepath.Join(tmpdir, "app.log.3"), "sixth\n", start.Add(4*time.Minute))
+	if err := os.Remove(filepath.Join(tmpdir, "app.log.2")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll("last"); !reflect.DeepEqual(got, []string{"sixth"}) {
+		t.Errorf("expected the newest file from the start, got %q", got)
+	}
+}
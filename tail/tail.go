@@ -5,14 +5,16 @@
 package tail
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +38,14 @@ type TailOptions struct {
 	Stop      bool   `long:"stop" description:"Stop reading the file after reaching the end rather than continuing to tail. When --backfill is set, it will override this option=true"`
 	Poll      bool   `long:"poll" description:"use poll instead of inotify to tail files"`
 	StateFile string `long:"statefile" description:"File in which to store the last read position. Defaults to a file in /tmp named $logfile.leash.state. If tailing multiple files, default is forced."`
+
+	FlushIntervalMs uint   `long:"flush_interval_ms" description:"When reading from STDIN, send along a partial line if no newline has arrived after this many milliseconds. 0 waits for the newline."`
+	LineDelimiter   string `long:"line_delimiter" description:"When reading from STDIN, end lines at this byte instead of a newline. Takes a single character or an escape such as \\0 or \\x1e"`
+
+	FollowNewest bool `long:"follow_newest" description:"Treat each file glob (eg app.log*) as a set of rotated files of which only the newest is written to. Follow the most recently modified file that matches, and when a newer one appears finish reading the current one and move on to the start of the newer one. Ties go to a file without a number at the end of its name, then the highest number. The statefile records the file and position reached, and read_from last resumes there even if the file has since been rotated"`
+
+	MaxBacklog int    `long:"max_backlog" description:"Hold up to this many lines from each file waiting to be parsed, reading ahead of the parser until the backlog is full. 0 disables the backlog"`
+	ShedPolicy string `long:"shed_policy" description:"What to do with a new line when the backlog is full. Values: drop_oldest (drop the oldest line waiting to make room), drop_newest (drop the new line), block (stop reading until there is room). The number of lines dropped is logged, and reported in the periodic status" default:"block"`
 }
 
 // Statefile mechanics when ReadFrom is 'last'
@@ -51,6 +61,9 @@ type Config struct {
 	Type RotateStyle
 	// Tail specific options
 	Options TailOptions
+	// Shed counts the lines dropped because a file's backlog was full,
+	// across every file. GetEntries makes one if it's nil.
+	Shed *int64
 }
 
 // State is what's stored in a statefile
@@ -106,22 +119,27 @@ func GetEntries(ctx context.Context, conf Config) ([]chan string, error) {
 	if conf.Type != RotateStyleSyslog {
 		return nil, errors.New("Only Syslog style rotation currently supported")
 	}
-	// expand any globs in the list of files so our list all represents real files
-	var filenames []string
-	for _, filePath := range conf.Paths {
-		if filePath == "-" {
-			filenames = append(filenames, filePath)
-		} else {
-			files, err := filepath.Glob(filePath)
-			if err != nil {
-				return nil, err
-			}
-			files = removeStateFiles(files, conf)
-			filenames = append(filenames, files...)
+	delimiter, err := parseLineDelimiter(conf.Options.LineDelimiter)
+	if err != nil {
+		return nil, err
+	}
+	filenames, err := ExpandPaths(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Options.FollowNewest && delimiter != '\n' {
+		return nil, errors.New("line_delimiter is only supported when reading from STDIN")
+	}
+	if conf.Options.MaxBacklog < 0 {
+		return nil, errors.New("max_backlog can't be negative")
+	}
+	if conf.Options.MaxBacklog > 0 {
+		if err := validShedPolicy(conf.Options.ShedPolicy); err != nil {
+			return nil, err
 		}
 	}
-	if len(filenames) == 0 {
-		return nil, errors.New("After removing missing files and state files from the list, there are no files left to tail")
+	if conf.Shed == nil {
+		conf.Shed = new(int64)
 	}
 
 	// make our lines channel list; we'll get one channel for each file
@@ -130,8 +148,16 @@ func GetEntries(ctx context.Context, conf Config) ([]chan string, error) {
 	for _, file := range filenames {
 		var lines chan string
 		if file == "-" {
-			lines = tailStdIn(ctx)
+			lines = tailStdIn(ctx, time.Duration(conf.Options.FlushIntervalMs)*time.Millisecond, delimiter)
+		} else if conf.Options.FollowNewest {
+			stateFile := getStateFile(conf, file, numFiles)
+			if lines, err = tailNewest(ctx, conf, file, stateFile); err != nil {
+				return nil, err
+			}
 		} else {
+			if delimiter != '\n' {
+				return nil, errors.New("line_delimiter is only supported when reading from STDIN")
+			}
 			stateFile := getStateFile(conf, file, numFiles)
 			tailer, err := getTailer(conf, file, stateFile)
 			if err != nil {
@@ -139,12 +165,46 @@ func GetEntries(ctx context.Context, conf Config) ([]chan string, error) {
 			}
 			lines = tailSingleFile(ctx, tailer, file, stateFile)
 		}
+		if conf.Options.MaxBacklog > 0 {
+			lines = backlogLines(lines, conf.Options.MaxBacklog, conf.Options.ShedPolicy, file, conf.Shed)
+		}
 		linesChans = append(linesChans, lines)
 	}
 
 	return linesChans, nil
 }
 
+// ExpandPaths expands any globs in the configured list of paths so the list
+// all represents real files, and removes any statefiles from it. The returned
+// filenames are in the same order as the channels returned by GetEntries.
+// With follow_newest the globs are left as they are, as each is followed as
+// a whole.
+func ExpandPaths(conf Config) ([]string, error) {
+	if conf.Options.FollowNewest {
+		if len(conf.Paths) == 0 {
+			return nil, errors.New("there are no files to tail")
+		}
+		return conf.Paths, nil
+	}
+	var filenames []string
+	for _, filePath := range conf.Paths {
+		if filePath == "-" {
+			filenames = append(filenames, filePath)
+		} else {
+			files, err := filepath.Glob(filePath)
+			if err != nil {
+				return nil, err
+			}
+			files = removeStateFiles(files, conf)
+			filenames = append(filenames, files...)
+		}
+	}
+	if len(filenames) == 0 {
+		return nil, errors.New("After removing missing files and state files from the list, there are no files left to tail")
+	}
+	return filenames, nil
+}
+
 // removeStateFiles goes through the list of files and removes any that appear
 // to be statefiles to avoid .leash.state.leash.state.leash.state from appearing
 // when you use an overly permissive glob
@@ -187,17 +247,21 @@ func tailSingleFile(ctx context.Context, tailer *tail.Tail, file string, stateFi
 	state := State{}
 	go func() {
 		for range ticker.C {
-			updateStateFile(&state, tailer, file, stateFh)
+			updateStateFile(&state, tailer, file, stateFh, false)
 		}
 	}()
 
 	go func() {
+		drained := false
 	ReadLines:
 		for {
 			select {
 			case line, ok := <-tailer.Lines:
 				if !ok {
-					// tailer.Lines is closed
+					// tailer.Lines is closed. Only a tailer that isn't
+					// following and stopped without an error is sure to
+					// have read to the end of the file.
+					drained = !tailer.Follow && tailer.Err() == nil
 					break ReadLines
 				}
 				if line.Err != nil {
@@ -210,41 +274,128 @@ func tailSingleFile(ctx context.Context, tailer *tail.Tail, file string, stateFi
 				break ReadLines
 			}
 		}
-		close(lines)
 		ticker.Stop()
-		updateStateFile(&state, tailer, file, stateFh)
+		updateStateFile(&state, tailer, file, stateFh, drained)
 		stateFh.Close()
+		// close lines last so the position is saved by the time whoever is
+		// reading sees we're done
+		close(lines)
 	}()
 	return lines
 }
 
 // tailStdIn is a special case to tail STDIN without any of the
 // fancy stuff that the tail module provides
-func tailStdIn(ctx context.Context) chan string {
+func tailStdIn(ctx context.Context, flushInterval time.Duration, delimiter byte) chan string {
+	return tailReader(ctx, os.Stdin, flushInterval, delimiter)
+}
+
+// parseLineDelimiter turns the line_delimiter option into the byte that ends
+// lines. It defaults to a newline.
+func parseLineDelimiter(spec string) (byte, error) {
+	switch spec {
+	case "":
+		return '\n', nil
+	case `\0`:
+		return 0, nil
+	}
+	delimiter, err := strconv.Unquote(`"` + spec + `"`)
+	if err != nil || len(delimiter) != 1 {
+		return 0, fmt.Errorf("line_delimiter %q must be a single byte", spec)
+	}
+	return delimiter[0], nil
+}
+
+// tailReader sends each line read from input down the returned channel as
+// soon as its delimiter arrives. If flushInterval is non-zero, a partial line
+// that has been waiting for its delimiter for longer than flushInterval is
+// sent as is.
+func tailReader(ctx context.Context, input io.Reader, flushInterval time.Duration, delimiter byte) chan string {
 	lines := make(chan string)
-	input := bufio.NewReader(os.Stdin)
+	chunks := make(chan []byte)
+	// read whatever is available rather than waiting to fill a buffer
 	go func() {
-		defer close(lines)
+		defer close(chunks)
+		buf := make([]byte, 32*1024)
 		for {
-			// check for signal triggered exit
-			select {
-			case <-ctx.Done():
-				return
-			default:
+			n, err := input.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				select {
+				case chunks <- chunk:
+				case <-ctx.Done():
+					return
+				}
 			}
-			line, partialLine, err := input.ReadLine()
 			if err != nil {
-				logrus.Debug("stdin is closed")
-				// bail when STDIN closes
+				logrus.Debug("input is closed")
+				// bail when the input closes
 				return
 			}
-			var parts []string
-			parts = append(parts, string(line))
-			for partialLine {
-				line, partialLine, _ = input.ReadLine()
-				parts = append(parts, string(line))
+		}
+	}()
+	go func() {
+		defer close(lines)
+		var partial []byte
+		var flushTimer *time.Timer
+		var flush <-chan time.Time
+		stopFlush := func() {
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+			flushTimer, flush = nil, nil
+		}
+		sendLine := func(line []byte) bool {
+			text := string(line)
+			if delimiter == '\n' {
+				text = strings.TrimSuffix(text, "\r")
+			}
+			select {
+			case lines <- text:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case chunk, ok := <-chunks:
+				if !ok {
+					if len(partial) > 0 {
+						sendLine(partial)
+					}
+					stopFlush()
+					return
+				}
+				partial = append(partial, chunk...)
+				for {
+					idx := bytes.IndexByte(partial, delimiter)
+					if idx == -1 {
+						break
+					}
+					if !sendLine(partial[:idx]) {
+						return
+					}
+					partial = partial[idx+1:]
+					// the pending partial line was completed
+					stopFlush()
+				}
+				if len(partial) > 0 && flushInterval > 0 && flushTimer == nil {
+					flushTimer = time.NewTimer(flushInterval)
+					flush = flushTimer.C
+				}
+			case <-flush:
+				flushTimer, flush = nil, nil
+				if !sendLine(partial) {
+					return
+				}
+				partial = nil
+			case <-ctx.Done():
+				// check for signal triggered exit
+				stopFlush()
+				return
 			}
-			lines <- strings.Join(parts, "")
 		}
 	}()
 	return lines
@@ -255,30 +406,11 @@ func tailStdIn(ctx context.Context) chan string {
 func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
 	beginning := &tail.SeekInfo{}
 	end := &tail.SeekInfo{0, 2}
-	fh, err := os.Open(stateFile)
+	state, err := readStateFile(stateFile)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to open the statefile")
-		return end
-	}
-	defer fh.Close()
-	// read the contents of the state file (JSON)
-	content := make([]byte, 1024)
-	bytesRead, err := fh.Read(content)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to read the statefile contents")
-		return end
-	}
-	content = content[:bytesRead]
-	// decode the contents of the statefile
-	state := State{}
-	if err := json.Unmarshal(content, &state); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to json decode the statefile")
+		}).Debug("getStartLocation failed to read the statefile")
 		return end
 	}
 	// get the details of the existing log file
@@ -307,6 +439,24 @@ func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
 	}
 }
 
+// readStateFile reads the State saved in stateFile
+func readStateFile(stateFile string) (State, error) {
+	state := State{}
+	fh, err := os.Open(stateFile)
+	if err != nil {
+		return state, err
+	}
+	defer fh.Close()
+	// read the contents of the state file (JSON)
+	content := make([]byte, 1024)
+	bytesRead, err := fh.Read(content)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(content[:bytesRead], &state)
+	return state, err
+}
+
 // getTailer configures the *tail.Tail correctly to begin actually tailing the
 // specified file.
 func getTailer(conf Config, file string, stateFile string) (*tail.Tail, error) {
@@ -386,16 +536,31 @@ func getStateFile(conf Config, filename string, numFiles int) string {
 }
 
 // updateStateFile updates the state file once per second with the current
-// values for the logfile's inode number and offset
-func updateStateFile(state *State, t *tail.Tail, file string, stateFh *os.File) {
+// values for the logfile's inode number and offset. drained says the tailer
+// has already sent every line it is going to.
+func updateStateFile(state *State, t *tail.Tail, file string, stateFh *os.File, drained bool) {
 	logStat := unix.Stat_t{}
 	unix.Stat(file, &logStat)
-	currentPos, err := t.Tell()
-	if err != nil {
-		return
+	var currentPos int64
+	if drained {
+		// a tailer that isn't following closes the file once it has read
+		// every line, after which Tell reports 0. It stopped at the end of
+		// the file, though, so that's where to resume.
+		currentPos = logStat.Size
+	} else {
+		var err error
+		currentPos, err = t.Tell()
+		if err != nil {
+			return
+		}
 	}
 	state.INode = logStat.Ino
 	state.Offset = currentPos
+	writeStateFile(state, stateFh)
+}
+
+// writeStateFile replaces the contents of stateFh with state
+func writeStateFile(state *State, stateFh *os.File) {
 	out, err := json.Marshal(state)
 	if err != nil {
 		return
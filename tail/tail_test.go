@@ -3,6 +3,7 @@ package tail
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -41,6 +42,89 @@ func TestTailSingleFile(t *testing.T) {
 	checkLinesChan(t, lines, jsonLines)
 }
 
+func TestTailResumesFromStateFile(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	filename := ts.tmpdir + "/resume.log"
+	statefilename := filename + ".mystate"
+	tailFile := func(readFrom string, expected []string) {
+		conf := Config{
+			Options: TailOptions{ReadFrom: readFrom, Stop: true},
+		}
+		tailer, err := getTailer(conf, filename, statefilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLinesChan(t, tailSingleFile(ts.ctx, tailer, filename, statefilename), expected)
+	}
+
+	ts.writeFile(t, filename, "one\ntwo\n")
+	tailFile("beginning", []string{"one", "two"})
+
+	// restarting picks up after the lines already read
+	fh, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(fh, "three\nfour\n")
+	fh.Close()
+	tailFile("last", []string{"three", "four"})
+	// and with nothing new to read, reads nothing
+	tailFile("last", []string{})
+
+	// a rotated file has a new inode, so is read from the beginning
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile(t, filename, "five\nsix\n")
+	tailFile("last", []string{"five", "six"})
+}
+
+func TestTailStoppedEarlyKeepsPosition(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	filename := ts.tmpdir + "/stopped.log"
+	statefilename := filename + ".mystate"
+	ts.writeFile(t, filename, "one\ntwo\n")
+	conf := Config{
+		Options: TailOptions{ReadFrom: "beginning"},
+	}
+	tailer, err := getTailer(conf, filename, statefilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := tailSingleFile(ts.ctx, tailer, filename, statefilename)
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Fatalf("expected %q, got %q", expected, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	// a line still being written when the tailer is stopped hasn't been
+	// read, so the end of the file isn't where to resume
+	fh, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(fh, "thr")
+	fh.Close()
+	tailer.Stop()
+	for range lines {
+	}
+	state, _ := readStateFile(statefilename)
+	if state.Offset > int64(len("one\ntwo\n")) {
+		t.Errorf("expected the saved position not to be past the last line read, got %d", state.Offset)
+	}
+}
+
 func TestTailSTDIN(t *testing.T) {
 	ts := &testSetup{}
 	ts.start(t)
@@ -59,6 +143,79 @@ func TestTailSTDIN(t *testing.T) {
 	}
 }
 
+func TestTailReaderFlushesPromptly(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	pr, pw := io.Pipe()
+	lines := tailReader(ts.ctx, pr, 50*time.Millisecond, '\n')
+
+	readLine := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a line")
+		}
+		return ""
+	}
+
+	// a slow producer writes one line at a time; each should arrive without
+	// waiting for more input
+	go pw.Write([]byte("first\n"))
+	if line := readLine(); line != "first" {
+		t.Errorf("got line '%s', expected 'first'", line)
+	}
+	go pw.Write([]byte("second\r\nthi"))
+	if line := readLine(); line != "second" {
+		t.Errorf("got line '%s', expected 'second'", line)
+	}
+	// the partial line is flushed after the flush interval
+	if line := readLine(); line != "thi" {
+		t.Errorf("got line '%s', expected 'thi'", line)
+	}
+	go func() {
+		pw.Write([]byte("rd\n"))
+		pw.Close()
+	}()
+	if line := readLine(); line != "rd" {
+		t.Errorf("got line '%s', expected 'rd'", line)
+	}
+	checkLinesChanClosed(t, lines)
+}
+
+func TestTailReaderNoFlushInterval(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	input := strings.NewReader("one\ntwo\nthree")
+	lines := tailReader(ts.ctx, input, 0, '\n')
+	checkLinesChan(t, lines, []string{"one", "two", "three"})
+}
+
+func TestTailReaderLineDelimiter(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	delimiter, err := parseLineDelimiter(`\0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newlines and carriage returns are just part of the line
+	input := strings.NewReader("one\x00two\nlines\r\x00\x00three")
+	lines := tailReader(ts.ctx, input, 0, delimiter)
+	checkLinesChan(t, lines, []string{"one", "two\nlines\r", "", "three"})
+
+	for spec, expected := range map[string]byte{"": '\n', `\x1e`: 0x1e, "|": '|'} {
+		if delimiter, err := parseLineDelimiter(spec); err != nil || delimiter != expected {
+			t.Errorf("parseLineDelimiter(%q): got %q, %v, expected %q", spec, delimiter, err, expected)
+		}
+	}
+	if _, err := parseLineDelimiter("||"); err == nil {
+		t.Error("expected an error for a delimiter longer than a byte")
+	}
+}
+
 func TestGetSampledEntries(t *testing.T) {
 	ts := &testSetup{}
 	ts.start(t)